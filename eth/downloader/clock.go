@@ -0,0 +1,48 @@
+// Contains the time source of the synchronisation, allowing tests to replace the
+// real time timers and tickers with deterministically controllable ones.
+
+package downloader
+
+import "time"
+
+// clock is the source of the current time, and the timers and tickers of the
+// sync machinery.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+	NewTicker(d time.Duration) ticker
+}
+
+// timer is a single shot event source, the equivalent of a time.Timer.
+type timer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// ticker is a periodic event source, the equivalent of a time.Ticker.
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock implementation backed by the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time                   { return time.Now() }
+func (realClock) NewTimer(d time.Duration) timer   { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) ticker { return realTicker{time.NewTicker(d)} }
+
+// realTimer wraps a time.Timer into the timer interface.
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) Chan() <-chan time.Time { return t.C }
+
+// realTicker wraps a time.Ticker into the ticker interface.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
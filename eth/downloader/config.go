@@ -0,0 +1,473 @@
+// Contains the optional tuning parameters of the downloader.
+
+package downloader
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// InsertPolicy defines when the downloaded blocks are fed into the chain insertion
+// callback during a sync. Blocks are inserted as soon as any of the triggers fires,
+// and once more at the end of the sync, flushing any remaining ones.
+type InsertPolicy struct {
+	Blocks     int                // Insert if at least this many blocks are takeable (0 = disabled)
+	Bytes      common.StorageSize // Insert if the takeable blocks are at least this large (0 = disabled)
+	Interval   time.Duration      // Insert if this much time passed since the last insertion (0 = disabled)
+	OnThrottle bool               // Insert whenever the download is throttled by a full cache
+}
+
+// DefaultInsertPolicy is the insertion policy used if none was configured.
+var DefaultInsertPolicy = InsertPolicy{
+	Blocks:     256,
+	Interval:   time.Second,
+	OnThrottle: true,
+}
+
+// SyncPhase is a stage of a synchronisation, reported to the phase observer.
+type SyncPhase int
+
+const (
+	PhaseHashes   SyncPhase = iota // Hash chain discovery started
+	PhaseBlocks                    // Hash discovery completed, block download started
+	PhaseComplete                  // Block download completed
+)
+
+// String implements fmt.Stringer.
+func (p SyncPhase) String() string {
+	switch p {
+	case PhaseHashes:
+		return "hashes"
+	case PhaseBlocks:
+		return "blocks"
+	case PhaseComplete:
+		return "complete"
+	default:
+		return "unknown"
+	}
+}
+
+// SyncMode is the kind of data a synchronisation retrieves for the blocks of the
+// hash chain.
+type SyncMode int
+
+const (
+	FullSync   SyncMode = iota // Retrieve the full blocks, bodies included
+	HeaderSync                 // Retrieve only the block headers, deferring the bodies
+)
+
+// String implements fmt.Stringer.
+func (m SyncMode) String() string {
+	switch m {
+	case FullSync:
+		return "full"
+	case HeaderSync:
+		return "header"
+	default:
+		return "unknown"
+	}
+}
+
+// Config contains the optional parameters to tune the behaviour of a block
+// downloader. The zero value of every field preserves the default behaviour.
+type Config struct {
+	// MemoryPool is a node-wide memory budget the block cache is accounted
+	// against. The queue throttles the download once the cached blocks plus the
+	// estimated size of the in-flight ones would exhaust the pool. The budget
+	// doesn't replace the per-queue blockCacheLimit, they are both honored and
+	// whichever is hit first will throttle the download.
+	MemoryPool *MemoryPool
+
+	// MaxCacheAlloc caps the number of blocks the download cache may be allocated
+	// for. If the discovered chain would require a bigger cache, the sync is aborted
+	// with errAllocLimit instead. Zero allows allocating up to blockCacheLimit.
+	MaxCacheAlloc int
+
+	// MaxQueuedBlocks is a hard ceiling on the number of blocks downloaded (or being
+	// downloaded) but not yet taken, independent of the block cache size. Once hit,
+	// no new blocks are requested until the cached ones are taken. Zero doesn't
+	// limit the queued blocks beyond the cache size.
+	MaxQueuedBlocks int
+
+	// MaxCacheCapacity enables an adaptive block cache, which starts each sync with
+	// MinCacheCapacity blocks and doubles whenever the download is throttled by the
+	// in-flight requests filling it up, up to MaxCacheCapacity blocks. Small syncs
+	// thus don't over-allocate, while fast networks get larger buffers. Zero keeps
+	// the cache fixed at blockCacheLimit.
+	MaxCacheCapacity int
+
+	// MinCacheCapacity is the initial capacity of the adaptive block cache. Zero
+	// defaults to the maximum number of blocks fetched in a single request.
+	MinCacheCapacity int
+
+	// CoalesceBatch is the minimum number of blocks TakeBlocks yields while the
+	// download is throttled and reservations are still in flight. Holding back
+	// short runs lets adjacent ranges complete and merge into one contiguous
+	// batch, reducing the per-batch overhead of a slow consumer. Zero disables
+	// coalescing, yielding whatever is available.
+	CoalesceBatch int
+
+	// PrefetchChunks is the number of block chunks to keep downloading beyond the
+	// throttle threshold while the consumer (e.g. InsertChain) is the bottleneck,
+	// keeping the peers warm and the data ready once it catches up. The cache is
+	// allocated that many chunks larger, capped at 8. Zero stops the download right
+	// at the threshold.
+	PrefetchChunks int
+
+	// MaxFutureBlockTime is the allowance by which a delivered block's timestamp
+	// may be ahead of the local clock. Blocks beyond it are dropped before being
+	// cached, and the delivering peer demoted. Zero accepts any timestamp.
+	MaxFutureBlockTime time.Duration
+
+	// VerifyPoW is an optional callback to check the proof-of-work of the delivered
+	// blocks before caching them. Blocks failing it are dropped, and the delivering
+	// peer demoted.
+	VerifyPoW func(block *types.Block) bool
+
+	// ValidateBlock is an optional callback to sanity check the delivered blocks
+	// (e.g. proof-of-work or timestamp) before handing them to the queue. If any
+	// block of a delivery fails it, the whole delivery is rejected, and the peer
+	// demoted.
+	ValidateBlock func(block *types.Block) error
+
+	// PersistBlock is an optional callback invoked with every accepted block as it
+	// is delivered, before it's cached waiting to be taken, e.g. to write it to disk
+	// so a crash doesn't lose the downloaded blocks. If it fails, the block is not
+	// cached but returned to the queue, and the delivering peer demoted.
+	PersistBlock func(block *types.Block) error
+
+	// PoWSampleRate limits the proof-of-work verification to a random one in every
+	// PoWSampleRate delivered blocks, trading security for CPU time. Zero or one
+	// verifies all of them.
+	PoWSampleRate int
+
+	// VerifyWorkers is the number of goroutines verifying the proof-of-work of the
+	// blocks of a delivery concurrently, capped at 16. The order of the takeable
+	// blocks is unaffected. Zero or one verifies them inline on the sync goroutine.
+	VerifyWorkers int
+
+	// HashRequestInterval is the minimum time between two successive hash requests
+	// to the same peer. Zero doesn't rate limit the requests.
+	HashRequestInterval time.Duration
+
+	// HashTimeout is the time allowance for a hash request to be answered, after
+	// which the discovery moves on to another peer. Zero defaults to 20 seconds.
+	HashTimeout time.Duration
+
+	// HashBackoffBase is the time allowance of the first hash request following a
+	// timed out one, multiplied by HashBackoffFactor on every further consecutive
+	// timeout (with some jitter), up to HashBackoffCap. The allowance drops back to
+	// HashTimeout once a valid batch of hashes arrives. Zero defaults to HashTimeout.
+	HashBackoffBase time.Duration
+
+	// HashBackoffFactor is the growth of the hash request time allowance on every
+	// consecutive timeout. Zero defaults to 2, values below one keep it flat.
+	HashBackoffFactor float64
+
+	// HashBackoffCap is the upper bound of the backed off hash request time
+	// allowance. Zero defaults to 2 minutes.
+	HashBackoffCap time.Duration
+
+	// BlockTimeout is the time allowance for a block (or state trie node) request to
+	// be answered, after which its hashes are returned to the queue, to be reassigned
+	// to other peers. Zero defaults to 20 seconds.
+	BlockTimeout time.Duration
+
+	// HashDiscoveryTimeout bounds the entire hash discovery phase, independent of
+	// the responsiveness of the individual requests. Zero defaults to an hour.
+	HashDiscoveryTimeout time.Duration
+
+	// ParallelHashFetch retrieves sections of the hash chain from multiple peers in
+	// parallel, each walking down from a different peer's advertised head, and the
+	// sections spliced together once the main discovery reaches them. It's only
+	// worthwhile if the peers advertise heads along the chain being synced.
+	ParallelHashFetch bool
+
+	// MaxPeerSwitches caps the number of times the hash discovery may move on to a
+	// new peer after the active one failed, aborting the sync afterwards. Zero
+	// doesn't limit the switches.
+	MaxPeerSwitches int
+
+	// MaxHashChain caps the number of hashes the discovery may accumulate without
+	// reaching a common ancestor, protecting against peers never serving a known
+	// hash. Exceeding it demotes the active peer and aborts the sync with
+	// errTooManyHashes. Zero defaults to 4M hashes.
+	MaxHashChain int
+
+	// ExtendDiscovery makes a head advance reported via Preempt during the hash
+	// discovery extend it to the new head once the stale one was reached, instead
+	// of aborting and restarting it.
+	ExtendDiscovery bool
+
+	// MaxHeadAdvances caps the number of head advances a single sync accepts via
+	// Preempt, protecting against peers constantly advancing their heads to keep
+	// the sync running forever. Zero defaults to 16.
+	MaxHeadAdvances int
+
+	// NextPeer is an optional callback overriding the built-in selection of the
+	// peer to continue the hash discovery with if the active one failed. It's given
+	// the set of already attempted peer ids, and returns the id of the replacement,
+	// or an empty one to abort the sync.
+	NextPeer func(attempted map[string]bool) string
+
+	// EmptyHashRetries is the number of times an empty hash set response is retried
+	// from the same peer (which may momentarily be catching up) before switching to
+	// another one.
+	EmptyHashRetries int
+
+	// EmptyHashSwitches is the number of times the hash discovery switches to another
+	// peer (demoting the failing one) after empty hash set responses, before aborting
+	// the sync with errEmptyHashSet. Zero defaults to 3, a negative value aborts on
+	// the first empty response not retried.
+	EmptyHashSwitches int
+
+	// EmptyHashRetryDelay is the base delay before retrying an empty hash response.
+	// The actual delay is randomised between one and two times the base. Zero
+	// defaults to half a second.
+	EmptyHashRetryDelay time.Duration
+
+	// InsertChain is an optional callback to insert the downloaded blocks into the
+	// local chain during the sync, instead of waiting for the caller to take them.
+	InsertChain chainInsertFn
+
+	// InsertPolicy defines when InsertChain is invoked. If nil, the default policy
+	// is used.
+	InsertPolicy *InsertPolicy
+
+	// AutoDrain makes Synchronise feed any leftover blocks of a previous sync into
+	// InsertChain before starting, instead of failing with ErrPendingQueue. Only the
+	// blocks linking up with the local chain are inserted, the rest are discarded.
+	// It has no effect without an InsertChain callback.
+	AutoDrain bool
+
+	// SalvagePartial makes a failed sync keep the contiguous blocks downloaded so far
+	// instead of discarding them, feeding them into InsertChain, or, without one,
+	// keeping them for the next TakeBlocks. By default a failed sync is all-or-nothing.
+	SalvagePartial bool
+
+	// SlowPeerPercentile enables demoting the peers whose average block delivery
+	// latency is above this percentile (0-1) of the peer set, even if they respond
+	// within the request timeout. Zero disables slow peer detection.
+	SlowPeerPercentile float64
+
+	// SlowPeerFactor is the minimum factor by which a peer's delivery latency needs
+	// to exceed the median of the peer set to be considered slow. Zero defaults
+	// to two.
+	SlowPeerFactor float64
+
+	// MaxPeerRequests is the maximum number of block requests in flight to a single
+	// peer. If no peer is idle while blocks are still pending, additional concurrent
+	// requests are assigned to the fastest busy peers, as long as they correlate
+	// their deliveries with the requests. Zero or one disables concurrent requests.
+	MaxPeerRequests int
+
+	// HealthWeights are the weights of the inputs of the peer health score. If set,
+	// the idle peers are assigned blocks in the order of their health instead of
+	// their reputation.
+	HealthWeights *HealthWeights
+
+	// MinPeerHealth is the health score (0-1) below which a delivering peer gets
+	// demoted instead of promoted. Zero disables health based demotion.
+	MinPeerHealth float64
+
+	// MinFetchPeers is the number of healthy peers below which the block download is
+	// aborted with errTooFewPeers, instead of crawling along with too few of them,
+	// allowing the caller to retry once more peers are available. Zero aborts only
+	// if no peers are left at all.
+	MinFetchPeers int
+
+	// BufferOverflow makes the blocks delivered beyond the target of the sync (i.e.
+	// the chain advanced during a long sync) be buffered, up to 256 of them, instead
+	// of dropped. The buffered blocks fill in for their retrievals once a follow-up
+	// sync (or head advance) schedules them. Either way, the overflown blocks don't
+	// fail the sync, and are counted in the sync summary. By default they're dropped,
+	// as the follow-up sync may well target a different fork.
+	BufferOverflow bool
+
+	// DescendingFetch schedules the newest pending blocks first, making them takeable
+	// soonest, for consumers where recent blocks matter most (e.g. light validation).
+	// TakeBlocks yields the newest contiguous run of downloaded blocks, regardless of
+	// whether its parent is known, so successive runs arrive newest first (each in
+	// ascending order). With an InsertChain callback the blocks are still inserted
+	// oldest first, once the whole remaining chain is downloaded.
+	DescendingFetch bool
+
+	// Scheduler is an optional strategy deciding which of the pending blocks are
+	// assigned to each idle peer. If nil, blocks are assigned sequentially.
+	Scheduler Scheduler
+
+	// PreferFullPeers prioritises the archival peers for block retrievals, and avoids
+	// assigning historical blocks to light or pruned peers unable to serve them, as
+	// long as any archival peer is available.
+	PreferFullPeers bool
+
+	// PreferFastPeers hands out the block retrievals to the idle peers in the order
+	// of their average block delivery round trip time, fastest first, instead of
+	// by reputation. Peers not yet measured are served last.
+	PreferFastPeers bool
+
+	// BlockChunkSize is the maximum number of blocks requested at once from a peer,
+	// clamped at 1024 to keep the responses within the protocol message limit. The
+	// per peer limits still apply. Zero defaults to 128.
+	BlockChunkSize int
+
+	// PeerScoreTTL is the age after which the imported peer scores are discarded as
+	// stale. Zero defaults to a day.
+	PeerScoreTTL time.Duration
+
+	// OnPhaseChange is an optional callback invoked on the sync goroutine whenever
+	// the synchronisation enters a new phase, along with the number of hashes pending
+	// retrieval at the transition.
+	OnPhaseChange func(phase SyncPhase, pending int)
+
+	// OnProgress is an optional callback invoked on the sync goroutine as hashes get
+	// discovered and blocks delivered, with the number of blocks already taken, the
+	// hashes pending retrieval and the blocks cached but not yet taken. It's called
+	// at most once every 100ms.
+	OnProgress func(pulled, pending, cached int)
+
+	// OnThrottleChange is an optional callback invoked on the sync goroutine every
+	// time the block download throttling engages or releases. If the download ends
+	// while throttled, the release is reported on termination.
+	OnThrottleChange func(engaged bool)
+
+	// TieBreak is an optional callback to choose which peer to synchronise with,
+	// if multiple peers advertise the same highest total difficulty, but different
+	// heads. It returns the chosen peer id, or an empty one to abort the sync. If
+	// it's not set, Synchronise fails with ErrAmbiguousHead instead.
+	TieBreak func(candidates []string) string
+
+	// LocalTd is an optional callback retrieving the total difficulty of the local
+	// chain. If set, synchronising with the best peer (empty id) only picks peers
+	// advertising a higher total difficulty, failing with errLowTd otherwise.
+	LocalTd tdRetrievalFn
+
+	// OnUnknownDelivery is an optional callback invoked when blocks are delivered by
+	// a peer not in the peer set (e.g. late deliveries of dropped peers, or spoofed
+	// messages). Such deliveries are ignored either way.
+	OnUnknownDelivery func(id string)
+
+	// MaxUnknownDeliveries enables a strict mode, aborting the sync with
+	// errUnknownDeliveries if more deliveries from unknown peers arrive within a
+	// second, treating the burst as an attack. Zero silently ignores them all.
+	MaxUnknownDeliveries int
+
+	// Genesis is the hash of the local genesis block. If set, peers advertising a
+	// different genesis are skipped when selecting peers to retrieve hashes and
+	// blocks from, and syncing with one fails with errIncompatibleChain. Peers not
+	// advertising any genesis are assumed compatible.
+	Genesis common.Hash
+
+	// MinDesiredPeers is the number of registered peers WaitForPeers waits for if
+	// not given explicitly, e.g. lower on test networks with only a few nodes. Zero
+	// defaults to 5.
+	MinDesiredPeers int
+
+	// MaxPeers caps the number of registered peers, bounding the resources spent on
+	// them under churn. Registrations beyond it fail with errTooManyPeers. Zero
+	// doesn't limit the peer set.
+	MaxPeers int
+
+	// EvictPeers makes registrations into a full peer set evict the registered peer
+	// with the lowest reputation instead of failing.
+	EvictPeers bool
+
+	// OnPeerDrop is an optional callback invoked when a registered peer is dropped
+	// from the download by blacklisting, banning or evicting it, allowing the
+	// embedder to disconnect it.
+	OnPeerDrop func(id string)
+
+	// OnPeerReadmit is an optional callback invoked when a blacklisted peer is
+	// whitelisted again, allowing the embedder to reconnect it.
+	OnPeerReadmit func(id string)
+
+	// BanDemotions is the number of demotions within BanWindow after which a peer
+	// is banned from the download for BanCooldown, dropping it from the peer set
+	// and rejecting its registrations until the cooldown expires. Zero never bans.
+	BanDemotions int
+
+	// BanWindow is the time window within which the demotions of a peer are
+	// counted towards a ban. Zero defaults to a minute.
+	BanWindow time.Duration
+
+	// BanCooldown is the duration of a ban, after which the peer is automatically
+	// eligible for registration again. Zero defaults to ten minutes.
+	BanCooldown time.Duration
+
+	// MinHealthyPeers is the number of registered peers below which Healthy reports
+	// the downloader unhealthy. Zero defaults to a single peer.
+	MinHealthyPeers int
+
+	// StallTimeout is the time without any data delivered after which a running
+	// sync is reported stuck by Healthy. Zero defaults to a minute.
+	StallTimeout time.Duration
+
+	// HeadStallTimeout is the time the cached head block of a running sync may keep
+	// missing its parent locally, with no blocks taken meanwhile, before the sync is
+	// aborted with errStalledSync, catching gaps in the download. Zero never aborts.
+	HeadStallTimeout time.Duration
+
+	// MinSyncInterval is the minimum time between two Synchronise calls. Calls made
+	// more frequently are rejected right away with errTooFrequent, protecting the
+	// downloader from accidental busy loops. Zero doesn't limit the call rate.
+	MinSyncInterval time.Duration
+
+	// TrafficBudget caps the number of bytes a single synchronisation may receive
+	// from the network, aborting it with errBudgetExceeded once surpassed. Zero
+	// doesn't limit the traffic.
+	TrafficBudget uint64
+
+	// FastSync enables downloading the state trie of the sync target, in parallel
+	// to its blocks, from the peers supporting state retrieval. The sync completes
+	// only once all the state trie nodes have been retrieved and stored.
+	FastSync bool
+
+	// StateStore is the callback to persist a retrieved and validated state trie
+	// node. It is required in fast sync mode.
+	StateStore func(hash common.Hash, blob []byte) error
+
+	// StateChildren is an optional callback to extract the child references of a
+	// retrieved state node (e.g. to follow an account's storage trie and code). If
+	// not set, only the hash references of the trie node itself are followed.
+	StateChildren func(hash common.Hash, blob []byte) ([]common.Hash, error)
+
+	// StateKnown is an optional callback to check whether a state node is already
+	// available locally, skipping its retrieval (along with its whole subtrie).
+	StateKnown func(hash common.Hash) bool
+}
+
+// Settings is a read-only snapshot of the effective tuning parameters of a block
+// downloader, with all the defaults of the unset configuration fields resolved.
+type Settings struct {
+	HashTtl              time.Duration // Time allowance for a hash request to be answered
+	HashBackoffBase      time.Duration // Time allowance of the first hash request after a timeout
+	HashBackoffFactor    float64       // Growth of the hash request time allowance on consecutive timeouts
+	HashBackoffCap       time.Duration // Upper bound of the backed off hash request time allowance
+	BlockTtl             time.Duration // Time allowance for a block request to be answered
+	HashDiscoveryTimeout time.Duration // Time allowance for the entire hash discovery phase
+	HashRequestInterval  time.Duration // Minimum time between two hash requests to the same peer
+	MaxPeerSwitches      int           // Maximum number of peer switches during hash discovery (0 = unlimited)
+	MaxHashChain         int           // Maximum number of hashes discovered without finding a common ancestor
+	MaxHeadAdvances      int           // Maximum number of head advances accepted by a single sync
+	MinSyncInterval      time.Duration // Minimum time between two admitted Synchronise calls (0 = unlimited)
+	EmptyHashRetries     int           // Number of empty hash set responses retried per peer
+	EmptyHashSwitches    int           // Number of peer switches after empty hash set responses
+	EmptyHashRetryDelay  time.Duration // Base delay before retrying an empty hash set response
+
+	MinDesiredPeers int // Number of peers waited for before syncing
+	MaxBlockFetch   int // Maximum number of blocks requested at once from a peer
+	MaxStateFetch   int // Maximum number of state trie nodes requested at once from a peer
+	MaxPeerRequests int // Maximum number of block requests in flight to a single peer
+
+	BlockCacheLimit    int           // Maximum number of blocks cached before throttling
+	MaxQueuedBlocks    int           // Hard ceiling on the blocks queued but not taken (0 = cache size)
+	MemoryLimit        uint64        // Size of the shared memory budget throttling the cache (0 = none)
+	CoalesceBatch      int           // Minimum batch size yielded while throttled (0 = disabled)
+	PrefetchBlocks     int           // Number of blocks fetched beyond the throttle threshold
+	MaxFutureBlockTime time.Duration // Allowance of block timestamps ahead of the local clock (0 = unlimited)
+
+	InsertPolicy InsertPolicy // Policy triggering the block insertions (if an inserter is set)
+	FastSync     bool         // Whether the state trie of the sync target is retrieved too
+}
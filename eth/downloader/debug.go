@@ -0,0 +1,192 @@
+// Contains the debug dump of the downloader, capturing its entire state into a
+// single JSON snapshot for post-mortem analysis of misbehaving syncs.
+
+package downloader
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PeerReport is the state and quality statistics of a single registered peer.
+type PeerReport struct {
+	Id         string        `json:"id"`         // Unique identifier of the peer
+	Head       string        `json:"head"`       // Hash of the peer's latest known block
+	Idle       bool          `json:"idle"`       // Whether the peer is idle for block retrievals
+	Rep        int32         `json:"rep"`        // Reputation of the peer
+	Latency    time.Duration `json:"latency"`    // Moving average of the block delivery latency
+	Samples    int           `json:"samples"`    // Number of block deliveries measured
+	Throughput float64       `json:"throughput"` // Moving average of the block delivery throughput in blocks/s
+	Timeouts   int           `json:"timeouts"`   // Number of block requests timed out
+	Failures   int           `json:"failures"`   // Number of invalid block deliveries
+	Health     float64       `json:"health"`     // Health score of the peer in the [0, 1] range
+}
+
+// Reservation is a block retrieval request currently in flight.
+type Reservation struct {
+	Peer   string        `json:"peer"`   // Identifier of the peer the request was sent to
+	Id     uint64        `json:"id"`     // Correlation id of the request (0 = not correlated)
+	Blocks int           `json:"blocks"` // Number of blocks still awaited
+	Age    time.Duration `json:"age"`    // Time elapsed since the request was made
+}
+
+// DebugMetrics are the resource usage counters of the downloader.
+type DebugMetrics struct {
+	Memory    uint64        `json:"memory"`    // Bytes the cached blocks are accounted for in the memory pool
+	Allocated int           `json:"allocated"` // Number of blocks the cache is allocated for
+	Capacity  int           `json:"capacity"`  // Number of blocks the cache may currently hold
+	Resources ResourceStats `json:"resources"` // Live resources allocated by the sync
+}
+
+// DebugState is a snapshot of the entire state of the downloader.
+type DebugState struct {
+	Config       Settings      `json:"config"`       // Effective tuning parameters of the downloader
+	Peers        []PeerReport  `json:"peers"`        // Registered peers, ordered by id
+	Blacklist    []string      `json:"blacklist"`    // Identifiers of the banned peers
+	Gaps         []Gap         `json:"gaps"`         // Ranges of blocks still missing from the download
+	Reservations []Reservation `json:"reservations"` // Block requests currently in flight
+	Progress     Progress      `json:"progress"`     // Progress of the current (or last) sync
+	LastError    string        `json:"lasterror"`    // Error the last sync terminated with (empty = none)
+	Metrics      DebugMetrics  `json:"metrics"`      // Resource usage counters
+}
+
+// queueDump is a snapshot of the block queue, taken under a single lock.
+type queueDump struct {
+	pending, cached            int
+	throttled                  bool
+	starting, current, highest uint64
+	gaps                       []Gap
+	reservations               []Reservation
+	metrics                    DebugMetrics
+}
+
+// dump captures the state of the queue atomically, so the reported gaps, the in
+// flight requests and the cache counters are consistent with each other.
+func (q *queue) dump() queueDump {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	dump := queueDump{
+		pending:   len(q.hashPool),
+		cached:    len(q.blockPool),
+		gaps:      q.gaps(),
+		throttled: q.throttle(),
+		metrics: DebugMetrics{
+			Memory:    q.memory,
+			Allocated: len(q.blockCache),
+			Capacity:  q.cacheLimit(),
+		},
+	}
+	dump.starting, dump.current, dump.highest = q.span()
+
+	reserve := func(request *fetchRequest) {
+		dump.reservations = append(dump.reservations, Reservation{
+			Peer:   request.Peer.id,
+			Id:     request.Id,
+			Blocks: len(request.Hashes),
+			Age:    time.Since(request.Time),
+		})
+	}
+	for _, request := range q.pendPool {
+		reserve(request)
+	}
+	for _, request := range q.extraPool {
+		reserve(request)
+	}
+	sort.Sort(reservationsByPeer(dump.reservations))
+
+	return dump
+}
+
+// reservationsByPeer orders reservations by peer id, and then by request id.
+type reservationsByPeer []Reservation
+
+func (r reservationsByPeer) Len() int      { return len(r) }
+func (r reservationsByPeer) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r reservationsByPeer) Less(i, j int) bool {
+	if r[i].Peer != r[j].Peer {
+		return r[i].Peer < r[j].Peer
+	}
+	return r[i].Id < r[j].Id
+}
+
+// report retrieves the state and quality statistics of the peer.
+func (p *peer) report(weights HealthWeights) PeerReport {
+	health := p.Health(weights)
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return PeerReport{
+		Id:         p.id,
+		Head:       p.head.Hex(),
+		Idle:       atomic.LoadInt32(&p.idle) == 0,
+		Rep:        atomic.LoadInt32(&p.rep),
+		Latency:    p.latency,
+		Samples:    p.samples,
+		Throughput: p.throughput,
+		Timeouts:   p.timeouts,
+		Failures:   p.failures,
+		Health:     health,
+	}
+}
+
+// DebugDump serialises the entire state of the downloader into JSON: its config,
+// peers, missing blocks, in-flight requests, progress, last error and metrics.
+// It is safe to call while a sync is running. The sync summary and the queue are
+// captured under their locks held together, so the progress never tears against
+// the reported gaps and requests.
+func (d *Downloader) DebugDump() ([]byte, error) {
+	state := DebugState{
+		Config:    d.Config(),
+		Blacklist: d.BlacklistedPeers(),
+	}
+	// Report the peers, each of them consistent in itself
+	weights := DefaultHealthWeights
+	if d.config.HealthWeights != nil {
+		weights = *d.config.HealthWeights
+	}
+	peers := d.peers.AllPeers()
+	sort.Sort(peersById(peers))
+	for _, p := range peers {
+		state.Peers = append(state.Peers, p.report(weights))
+	}
+	// Capture the sync summary and the queue together
+	d.mu.RLock()
+	result := d.result
+	queue := d.queue.dump()
+	d.mu.RUnlock()
+
+	state.Gaps, state.Reservations = queue.gaps, queue.reservations
+	state.Progress = Progress{
+		Peer:      result.Peer,
+		Head:      result.Head,
+		Active:    atomic.LoadInt32(&d.synchronising) == 1,
+		Pending:   queue.pending,
+		InFlight:  len(queue.reservations),
+		Throttled: queue.throttled,
+		Cached:    queue.cached,
+		Bytes:     result.Bytes,
+		Elapsed:   time.Since(result.Start),
+
+		StartingBlock: queue.starting,
+		CurrentBlock:  queue.current,
+		HighestBlock:  queue.highest,
+	}
+	if result.Err != nil {
+		state.LastError = result.Err.Error()
+	}
+	state.Metrics = queue.metrics
+	state.Metrics.Resources = d.resources.stats()
+
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// peersById orders peers by their identifiers.
+type peersById []*peer
+
+func (p peersById) Len() int           { return len(p) }
+func (p peersById) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p peersById) Less(i, j int) bool { return p[i].id < p[j].id }
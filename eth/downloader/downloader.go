@@ -1,8 +1,13 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,25 +16,42 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
+	"gopkg.in/fatih/set.v0"
 )
 
 const (
 	maxBlockFetch    = 128              // Amount of max blocks to be fetched per chunk
+	maxBlockChunk    = 1024             // Maximum configurable chunk size, keeping responses within the message limit
 	peerCountTimeout = 12 * time.Second // Amount of time it takes for the peer handler to ignore minDesiredPeerCount
-	hashTtl          = 20 * time.Second // The amount of time it takes for a hash request to time out
+	hashDiscoveryTtl = time.Hour        // The amount of time it takes for the entire hash discovery to time out
+	emptyHashDelay   = time.Second / 2  // Base delay before retrying an empty hash set response
+	slowPeerSamples  = 3                // Number of deliveries to measure before judging a peer slow
+	slowPeerFactor   = 2.0              // Default factor by which a slow peer exceeds the median latency
+	maxHeadAdvances  = 16               // Default number of head advances a single sync accepts
+	emptyHashSwitch  = 3                // Default number of peer switches after empty hash sets
+	progressInterval = time.Second / 10 // Minimum time between two progress callback invocations
+	banWindow        = time.Minute      // Default time window within which demotions are counted towards a ban
+	banCooldown      = 10 * time.Minute // Default duration of a peer ban
+	hashBackoffRate  = 2.0              // Default growth of the hash request time allowance on consecutive timeouts
+	hashBackoffCap   = 2 * time.Minute  // Default upper bound of the backed off hash request time allowance
+	maxHashChain     = 4 * 1024 * 1024  // Default number of hashes discovered without finding a common ancestor
 )
 
 var (
 	minDesiredPeerCount = 5                // Amount of peers desired to start syncing
+	hashTtl             = 20 * time.Second // The amount of time it takes for a hash request to time out
 	blockTtl            = 20 * time.Second // The amount of time it takes for a block request to time out
+	unknownDeliveryTtl  = time.Second      // Time window within which deliveries from unknown peers are counted
 
 	errLowTd               = errors.New("peer's TD is too low")
 	ErrBusy                = errors.New("busy")
+	ErrDeliveryBusy        = errors.New("delivery still pending processing")
 	errUnknownPeer         = errors.New("peer's unknown or unhealthy")
 	errBadPeer             = errors.New("action from bad peer ignored")
 	errNoPeers             = errors.New("no peers to keep download active")
 	ErrPendingQueue        = errors.New("pending items in queue")
 	ErrTimeout             = errors.New("timeout")
+	ErrAmbiguousHead       = errors.New("best peers advertise different heads")
 	errEmptyHashSet        = errors.New("empty hash set by peer")
 	errPeersUnavailable    = errors.New("no peers available or all peers tried for block download process")
 	errAlreadyInPool       = errors.New("hash already in pool")
@@ -37,16 +59,87 @@ var (
 	errCancelHashFetch     = errors.New("hash fetching cancelled (requested)")
 	errCancelBlockFetch    = errors.New("block downloading cancelled (requested)")
 	errNoSyncActive        = errors.New("no sync active")
+	errPreempted           = errors.New("sync preempted by newer head")
+	errFutureBlock         = errors.New("block timestamp too far in the future")
+	errInvalidPoW          = errors.New("block proof-of-work invalid")
+	errTooFrequent         = errors.New("synchronisation requested too frequently")
+	errBlacklistedPeer     = errors.New("peer is blacklisted")
+	errNotBlacklisted      = errors.New("peer is not blacklisted")
+	errBudgetExceeded      = errors.New("sync traffic budget exceeded")
+	errHashCycle           = errors.New("cycle detected in hash chain")
+	errDiscoveryTimeout    = errors.New("hash discovery timed out")
+	errNoPausedSync        = errors.New("no paused sync to resume")
+	errNoPendingHashes     = errors.New("no discovered hashes pending download")
+	errAllocLimit          = errors.New("block cache allocation limit exceeded")
+	errHeadAdvanceLimit    = errors.New("sync head advanced too many times")
+	errNoInserter          = errors.New("no chain insertion callback configured")
+	errInvalidSlot         = errors.New("block doesn't map to its cache slot")
+	errUnknownDeliveries   = errors.New("too many deliveries from unknown peers")
+	errInvalidPeerFetcher  = errors.New("peer has no hash or block fetcher")
+	errNoSubsetPeers       = errors.New("none of the requested peers are registered")
+	errTooFewPeers         = errors.New("too few healthy peers to continue")
+	errPeerWaitTimeout     = errors.New("timed out waiting for peers")
+	errIncompatibleChain   = errors.New("peer is on an incompatible chain")
+	errInvalidBlock        = errors.New("delivered block failed validation")
+	errUnknownParent       = errors.New("parent of the queued head block is unknown")
+	errUnknownRangeEnd     = errors.New("end of the range to synchronise is unknown")
+	errRangeEndSkipped     = errors.New("hash chain skipped the end of the range to synchronise")
+	errStalledSync         = errors.New("sync stalled, head block never linking to the chain")
+	errTooManyHashes       = errors.New("hash chain too long without a common ancestor")
 )
 
+// PeersUnavailableError is returned by the block download if no peers are left
+// to request the pending blocks from, all of them having been tried already.
+type PeersUnavailableError struct {
+	Idle         int // Number of idle peers a request was attempted with
+	Total        int // Total number of peers taking part in the sync
+	HashesNeeded int // Number of hashes still pending retrieval
+}
+
+func (e *PeersUnavailableError) Error() string {
+	return fmt.Sprintf("%v peers available = %d. total peers = %d. hashes needed = %d", errPeersUnavailable, e.Idle, e.Total, e.HashesNeeded)
+}
+
+// Unwrap returns the sentinel error the failure is an instance of.
+func (e *PeersUnavailableError) Unwrap() error {
+	return errPeersUnavailable
+}
+
+// StatePeersUnavailableError is returned by the state retrieval of a fast sync if
+// no peers are left to request the pending trie nodes from.
+type StatePeersUnavailableError struct {
+	Idle        int // Number of idle state peers a request was attempted with
+	NodesNeeded int // Number of trie nodes still pending retrieval
+}
+
+func (e *StatePeersUnavailableError) Error() string {
+	return fmt.Sprintf("%v state peers available = %d. nodes needed = %d", errPeersUnavailable, e.Idle, e.NodesNeeded)
+}
+
+// Unwrap returns the sentinel error the failure is an instance of.
+func (e *StatePeersUnavailableError) Unwrap() error {
+	return errPeersUnavailable
+}
+
 type hashCheckFn func(common.Hash) bool
 type getBlockFn func(common.Hash) *types.Block
 type chainInsertFn func(types.Blocks) (int, error)
 type hashIterFn func() (common.Hash, error)
+type tdRetrievalFn func() *big.Int
 
 type blockPack struct {
-	peerId string
-	blocks []*types.Block
+	peerId    string
+	requestId uint64 // Id of the request answered (0 = not correlated)
+	blocks    []*types.Block
+	accepted  chan int // Channel to report the number of accepted blocks on (nil = not awaited)
+}
+
+// reply reports the number of blocks accepted from the pack to its deliverer, if
+// it's awaiting it.
+func (p blockPack) reply(accepted int) {
+	if p.accepted != nil {
+		p.accepted <- accepted
+	}
 }
 
 type hashPack struct {
@@ -54,35 +147,109 @@ type hashPack struct {
 	hashes []common.Hash
 }
 
+type nodePack struct {
+	peerId string
+	nodes  [][]byte
+}
+
 type Downloader struct {
+	lastSync int64 // Time of the last admitted Synchronise call in nanoseconds (atomic, 64 bit aligned)
+
 	mu    sync.RWMutex
 	queue *queue
+	state *stateQueue
 	peers *peerSet
 
+	blacklist *set.Set             // Set of peer ids banned from the download
+	scores    map[string]peerScore // Imported scores of previously seen peers (guarded by mu)
+
 	// Callbacks
 	hasBlock hashCheckFn
 	getBlock getBlockFn
 
+	// Configuration
+	config Config
+
 	// Status
 	synchronising int32
+	mode          SyncMode    // Kind of data retrieved by the current sync
+	preemptHead   common.Hash // Newer head to restart the sync with (guarded by mu)
+	preserve      int32       // Whether the cancellation should preserve the download state
+	draining      int32       // Whether new block requests are suspended, pending a graceful cancel
+	maintaining   int32       // Whether Flush or Reset operates on the download state, excluding syncs
+	advances      int         // Number of head advances accepted by the current sync (guarded by mu)
+	paused        bool        // Whether a sync was paused, waiting for resumption (guarded by mu)
+	cancelled     bool        // Whether the cancel channel of the current sync was closed (guarded by mu)
+	failed        bool        // Whether the block phase of the last sync failed, retryable (guarded by mu)
+	discovered    bool        // Whether the hash discovery of the current sync completed
+	stateTarget   common.Hash // Hash of the block whose state is being retrieved in fast sync mode
+	stateStarted  bool        // Whether the state retrieval of the target block has started
+	lastInsert    time.Time   // Time of the last block insertion via the callback
+	lastProgress  time.Time   // Time of the last data delivery of the current sync (guarded by mu)
+	lastReport    time.Time   // Time of the last progress callback invocation
+	result        SyncResult  // Summary of the last synchronisation run (guarded by mu)
+	clock         clock       // Source of the time and the timers of the sync (real time outside of tests)
+	resources     resourceTracker
+
+	salvaged types.Blocks           // Contiguous blocks salvaged from a failed sync, not yet taken (guarded by mu)
+	sessions map[string]*Downloader // Secondary range syncs, keyed by the id of their lent peer (guarded by mu)
+	rangeEnd common.Hash            // Known block ending the hash discovery of a range sync (zero if unbounded)
 
 	// Channels
 	newPeerCh chan *peer
 	hashCh    chan hashPack
 	blockCh   chan blockPack
+	nodeCh    chan nodePack
 	cancelCh  chan struct{}
+	doneCh    chan struct{} // Closed once the current sync run terminates (guarded by mu)
+	drainCh   chan struct{} // Signalled once a graceful cancel drained the in-flight requests
+	preemptCh chan struct{}
+	events    chan SyncEvent
 }
 
 func New(hasBlock hashCheckFn, getBlock getBlockFn) *Downloader {
+	return NewWithConfig(hasBlock, getBlock, Config{})
+}
+
+// NewWithConfig creates a new downloader, tuned by the optional parameters of
+// the given configuration.
+func NewWithConfig(hasBlock hashCheckFn, getBlock getBlockFn, config Config) *Downloader {
 	downloader := &Downloader{
 		queue:     newQueue(),
+		state:     newStateQueue(),
 		peers:     newPeerSet(),
+		blacklist: set.New(),
+		scores:    make(map[string]peerScore),
+		sessions:  make(map[string]*Downloader),
 		hasBlock:  hasBlock,
 		getBlock:  getBlock,
+		config:    config,
 		newPeerCh: make(chan *peer, 1),
 		hashCh:    make(chan hashPack, 1),
 		blockCh:   make(chan blockPack, 1),
+		nodeCh:    make(chan nodePack, 1),
+		doneCh:    make(chan struct{}),
+		drainCh:   make(chan struct{}, 1),
+		preemptCh: make(chan struct{}, 1),
+		events:    make(chan SyncEvent, syncEventBuffer),
+		clock:     realClock{},
 	}
+	close(downloader.doneCh)
+	downloader.queue.clock = downloader.clock
+	downloader.state.clock = downloader.clock
+	downloader.queue.pool = config.MemoryPool
+	downloader.queue.maxFuture = config.MaxFutureBlockTime
+	downloader.queue.verifyPoW = config.VerifyPoW
+	downloader.queue.persist = config.PersistBlock
+	downloader.queue.verifySample = config.PoWSampleRate
+	downloader.queue.verifyWorkers = config.VerifyWorkers
+	downloader.queue.scheduler = config.Scheduler
+	downloader.queue.allocLimit = config.MaxCacheAlloc
+	downloader.queue.maxQueued = config.MaxQueuedBlocks
+	downloader.queue.descending = config.DescendingFetch
+	downloader.queue.bufferOverflow = config.BufferOverflow
+	downloader.queue.prefetch = prefetchBlocks(config.PrefetchChunks)
+	downloader.queue.setCapacity(config.MinCacheCapacity, config.MaxCacheCapacity)
 
 	return downloader
 }
@@ -91,21 +258,294 @@ func (d *Downloader) Stats() (current int, max int) {
 	return d.queue.Size()
 }
 
+// setClock replaces the time source of the downloader and its queue, allowing
+// tests to drive the timeouts deterministically.
+func (d *Downloader) setClock(c clock) {
+	d.clock = c
+	d.queue.clock = c
+	d.state.clock = c
+}
+
+// Synchronising checks whether a synchronisation is currently running, i.e. the
+// downloader accepts hash and block deliveries. It's safe to call concurrently.
+func (d *Downloader) Synchronising() bool {
+	return atomic.LoadInt32(&d.synchronising) == 1
+}
+
+// MemoryUsage retrieves the number of bytes the cached blocks are accounted for
+// in the shared memory pool. If no pool was configured, it always returns 0.
+func (d *Downloader) MemoryUsage() uint64 {
+	return d.queue.Memory()
+}
+
+// CacheAllocation retrieves the number of blocks the download cache is currently
+// allocated for.
+func (d *Downloader) CacheAllocation() int {
+	return d.queue.Allocated()
+}
+
+// CacheCapacity retrieves the number of blocks the download cache may currently
+// hold. With an adaptive cache, it reflects the capacity grown to so far.
+func (d *Downloader) CacheCapacity() int {
+	return d.queue.Capacity()
+}
+
+// Config retrieves a snapshot of the effective tuning parameters of the downloader,
+// resolving the defaults of any unconfigured ones.
+func (d *Downloader) Config() Settings {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	settings := Settings{
+		HashTtl:              hashTtl,
+		HashBackoffBase:      d.config.HashBackoffBase,
+		HashBackoffFactor:    d.config.HashBackoffFactor,
+		HashBackoffCap:       d.config.HashBackoffCap,
+		BlockTtl:             d.blockTimeout(),
+		HashDiscoveryTimeout: d.config.HashDiscoveryTimeout,
+		HashRequestInterval:  d.config.HashRequestInterval,
+		MaxPeerSwitches:      d.config.MaxPeerSwitches,
+		MaxHashChain:         d.config.MaxHashChain,
+		MaxHeadAdvances:      d.config.MaxHeadAdvances,
+		MinSyncInterval:      d.config.MinSyncInterval,
+		EmptyHashRetries:     d.config.EmptyHashRetries,
+		EmptyHashSwitches:    d.config.EmptyHashSwitches,
+		EmptyHashRetryDelay:  d.config.EmptyHashRetryDelay,
+		MinDesiredPeers:      d.config.MinDesiredPeers,
+		MaxBlockFetch:        d.blockChunkSize(),
+		MaxStateFetch:        maxStateFetch,
+		MaxPeerRequests:      d.config.MaxPeerRequests,
+		BlockCacheLimit:      blockCacheLimit,
+		MaxQueuedBlocks:      d.config.MaxQueuedBlocks,
+		CoalesceBatch:        d.config.CoalesceBatch,
+		PrefetchBlocks:       prefetchBlocks(d.config.PrefetchChunks),
+		MaxFutureBlockTime:   d.config.MaxFutureBlockTime,
+		InsertPolicy:         DefaultInsertPolicy,
+		FastSync:             d.config.FastSync,
+	}
+	if d.config.HashTimeout > 0 {
+		settings.HashTtl = d.config.HashTimeout
+	}
+	if settings.HashBackoffBase == 0 {
+		settings.HashBackoffBase = settings.HashTtl
+	}
+	if settings.HashBackoffFactor == 0 {
+		settings.HashBackoffFactor = hashBackoffRate
+	}
+	if settings.HashBackoffCap == 0 {
+		settings.HashBackoffCap = hashBackoffCap
+	}
+	if settings.HashDiscoveryTimeout == 0 {
+		settings.HashDiscoveryTimeout = hashDiscoveryTtl
+	}
+	if settings.MaxHashChain == 0 {
+		settings.MaxHashChain = maxHashChain
+	}
+	if d.config.MaxCacheCapacity > 0 {
+		settings.BlockCacheLimit = d.config.MaxCacheCapacity
+	}
+	if d.config.MaxCacheAlloc > 0 && d.config.MaxCacheAlloc < settings.BlockCacheLimit {
+		settings.BlockCacheLimit = d.config.MaxCacheAlloc
+	}
+	if settings.MinDesiredPeers == 0 {
+		settings.MinDesiredPeers = minDesiredPeerCount
+	}
+	if settings.MaxHeadAdvances == 0 {
+		settings.MaxHeadAdvances = maxHeadAdvances
+	}
+	if settings.MaxPeerRequests == 0 {
+		settings.MaxPeerRequests = 1
+	}
+	if settings.EmptyHashSwitches == 0 {
+		settings.EmptyHashSwitches = emptyHashSwitch
+	} else if settings.EmptyHashSwitches < 0 {
+		settings.EmptyHashSwitches = 0
+	}
+	if settings.EmptyHashRetryDelay == 0 {
+		settings.EmptyHashRetryDelay = emptyHashDelay
+	}
+	if d.config.MemoryPool != nil {
+		settings.MemoryLimit = d.config.MemoryPool.Limit()
+	}
+	if d.config.InsertPolicy != nil {
+		settings.InsertPolicy = *d.config.InsertPolicy
+	}
+	return settings
+}
+
+// PendingHashes retrieves a snapshot of the hashes scheduled for download, which
+// are neither in flight nor delivered yet, ordered by their block numbers. The
+// returned slice is a copy, safe to use while a sync runs.
+func (d *Downloader) PendingHashes() []common.Hash {
+	return d.queue.PendingHashes()
+}
+
+// Gaps retrieves the ranges of block numbers still missing from the download,
+// pinpointing the ones the peers are failing to deliver.
+func (d *Downloader) Gaps() []Gap {
+	return d.queue.Gaps()
+}
+
+// PeerStats retrieves the block delivery statistics of the registered peers, keyed
+// by their ids. The returned stats are copies, safe to use while a sync runs.
+func (d *Downloader) PeerStats() map[string]PeerStat {
+	stats := make(map[string]PeerStat)
+	for _, p := range d.peers.AllPeers() {
+		stats[p.id] = p.Stats()
+	}
+	return stats
+}
+
+// Resources retrieves the live resources (goroutines, timers, channels) allocated
+// by the synchronisation. It is meant for debugging leaks, all values should be
+// zero whenever no sync is running.
+func (d *Downloader) Resources() ResourceStats {
+	return d.resources.stats()
+}
+
 // RegisterPeer injects a new download peer into the set of block source to be
 // used for fetching hashes and blocks from.
 func (d *Downloader) RegisterPeer(id string, head common.Hash, getHashes hashFetcherFn, getBlocks blockFetcherFn) error {
-	glog.V(logger.Detail).Infoln("Registering peer", id)
-	if err := d.peers.Register(newPeer(id, head, getHashes, getBlocks)); err != nil {
+	return d.RegisterPeerConfig(PeerConfig{
+		Id:        id,
+		Head:      head,
+		GetHashes: getHashes,
+		GetBlocks: getBlocks,
+	})
+}
+
+// RegisterPeerConfig injects a new download peer into the set of block sources,
+// using the optional peer specific parameters of the given configuration.
+func (d *Downloader) RegisterPeerConfig(config PeerConfig) error {
+	glog.V(logger.Detail).Infoln("Registering peer", config.Id)
+	if d.blacklist.Has(config.Id) {
+		return errBlacklistedPeer
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	evicted, err := d.peers.RegisterCapped(d.configPeer(config), d.config.MaxPeers, d.config.EvictPeers)
+	if err != nil {
 		glog.V(logger.Error).Infoln("Register failed:", err)
 		return err
 	}
+	// If a peer was evicted to make room, reassign its requests and disconnect it
+	if evicted != "" {
+		glog.V(logger.Detail).Infoln("Evicted peer", evicted)
+		d.queue.Revoke(evicted)
+		d.state.Revoke(evicted)
+		if d.config.OnPeerDrop != nil {
+			d.config.OnPeerDrop(evicted)
+		}
+	}
+	d.notifyPeer()
+	return nil
+}
+
+// ReplacePeers atomically swaps the entire peer set for the peers of the given
+// configurations. If any of them is invalid (blacklisted, banned, duplicate or
+// missing its fetchers), or there are too many of them, the peer set is left
+// untouched.
+//
+// Peers present in both the old and the new set are retained as they are, along
+// with their reputation and requests in flight, their new configurations being
+// ignored. The reservations of the dropped peers are cancelled right away, so an
+// active sync reassigns their blocks and state nodes to the remaining peers, and
+// ignores any late deliveries from the dropped ones.
+func (d *Downloader) ReplacePeers(configs []PeerConfig) error {
+	if d.config.MaxPeers > 0 && len(configs) > d.config.MaxPeers {
+		return errTooManyPeers
+	}
+	peers := make([]*peer, 0, len(configs))
+	ids := make(map[string]bool)
+	for _, config := range configs {
+		if d.blacklist.Has(config.Id) {
+			return errBlacklistedPeer
+		}
+		if d.peers.Banned(config.Id) {
+			return errBannedPeer
+		}
+		if ids[config.Id] {
+			return errAlreadyRegistered
+		}
+		if err := config.validate(); err != nil {
+			return err
+		}
+		ids[config.Id] = true
+		peers = append(peers, d.configPeer(config))
+	}
+	for _, id := range d.peers.Replace(peers) {
+		glog.V(logger.Detail).Infoln("Replaced peer", id)
+		d.queue.Revoke(id)
+		d.state.Revoke(id)
+	}
+	d.notifyPeer()
 	return nil
 }
 
+// notifyPeer signals a waiting WaitForPeers of a peer set change, without ever
+// blocking (a pending signal already makes the waiter recheck the peer count).
+func (d *Downloader) notifyPeer() {
+	select {
+	case d.newPeerCh <- nil:
+	default:
+	}
+}
+
+// WaitForPeers blocks until at least min peers are registered, or fails with
+// errPeerWaitTimeout once timeout elapses. A non-positive min defaults to the
+// configured MinDesiredPeers, and a zero timeout to 12 seconds. It is meant to be
+// called by a single orchestrator before starting a sync.
+func (d *Downloader) WaitForPeers(min int, timeout time.Duration) error {
+	if min <= 0 {
+		if min = d.config.MinDesiredPeers; min == 0 {
+			min = minDesiredPeerCount
+		}
+	}
+	if timeout == 0 {
+		timeout = peerCountTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for d.peers.Len() < min {
+		select {
+		case <-d.newPeerCh:
+		case <-timer.C:
+			glog.V(logger.Debug).Infof("Timed out waiting for %d peers, have %d", min, d.peers.Len())
+			return errPeerWaitTimeout
+		}
+	}
+	return nil
+}
+
+// configPeer creates a new download peer from its configuration, restoring any
+// previously imported score of it.
+func (d *Downloader) configPeer(config PeerConfig) *peer {
+	p := newPeer(config.Id, config.Head, config.GetHashes, config.GetBlocks)
+	p.hashOrder = config.HashOrder
+	p.getNodeData = config.GetNodeData
+	p.getHeaders = config.GetHeaders
+	p.getBlocksWithId = config.GetBlocksWithId
+	p.maxBlockFetch = config.MaxBlockFetch
+	p.light, p.oldest = config.Light, config.Oldest
+	p.genesis = config.Genesis
+	p.clock = d.clock
+	if config.Td != nil {
+		p.td = new(big.Int).Set(config.Td)
+	}
+	d.applyScore(p)
+
+	return p
+}
+
 // UnregisterPeer remove a peer from the known list, preventing any action from
 // the specified peer.
 func (d *Downloader) UnregisterPeer(id string) error {
 	glog.V(logger.Detail).Infoln("Unregistering peer", id)
+	if session := d.session(id); session != nil {
+		session.UnregisterPeer(id)
+	}
 	if err := d.peers.Unregister(id); err != nil {
 		glog.V(logger.Error).Infoln("Unregister failed:", err)
 		return err
@@ -113,45 +553,375 @@ func (d *Downloader) UnregisterPeer(id string) error {
 	return nil
 }
 
+// Blacklist bans a peer from the download, dropping it from the peer set if it's
+// currently registered and rejecting any registration attempts until whitelisted.
+func (d *Downloader) Blacklist(id string) {
+	glog.V(logger.Detail).Infoln("Blacklisting peer", id)
+
+	d.blacklist.Add(id)
+	if d.peers.Unregister(id) == nil && d.config.OnPeerDrop != nil {
+		d.config.OnPeerDrop(id)
+	}
+}
+
+// Whitelist fully reverses a previous blacklisting of a peer, allowing it to be
+// registered again.
+func (d *Downloader) Whitelist(id string) error {
+	if !d.blacklist.Has(id) {
+		return errNotBlacklisted
+	}
+	glog.V(logger.Detail).Infoln("Whitelisting peer", id)
+
+	d.blacklist.Remove(id)
+	if d.config.OnPeerReadmit != nil {
+		d.config.OnPeerReadmit(id)
+	}
+	return nil
+}
+
+// BlacklistedPeers retrieves the sorted list of the currently banned peer ids.
+func (d *Downloader) BlacklistedPeers() []string {
+	ids := set.StringSlice(d.blacklist)
+	sort.Strings(ids)
+	return ids
+}
+
+// BannedPeers retrieves the sorted list of the peer ids serving a temporary ban
+// for repeated demotions.
+func (d *Downloader) BannedPeers() []string {
+	return d.peers.BannedPeers()
+}
+
+// demote decreases the reputation of a peer, banning it from the download if it
+// was demoted too many times recently, in which case its reservations are handed
+// back to the queue.
+func (d *Downloader) demote(p *peer) {
+	window, cooldown := d.config.BanWindow, d.config.BanCooldown
+	if window == 0 {
+		window = banWindow
+	}
+	if cooldown == 0 {
+		cooldown = banCooldown
+	}
+	if !d.peers.Demote(p, d.config.BanDemotions, window, cooldown) {
+		return
+	}
+	glog.V(logger.Detail).Infof("Banned peer %s for %v", p.id, cooldown)
+	d.queue.Revoke(p.id)
+	d.state.Revoke(p.id)
+	if d.config.OnPeerDrop != nil {
+		d.config.OnPeerDrop(p.id)
+	}
+}
+
 // Synchronise will select the peer and use it for synchronising. If an empty string is given
 // it will use the best peer possible and synchronize if it's TD is higher than our own. If any of the
 // checks fail an error will be returned. This method is synchronous
 func (d *Downloader) Synchronise(id string, hash common.Hash) error {
+	return d.SynchroniseContext(context.Background(), id, hash)
+}
+
+// SynchroniseBest synchronises with the registered peer advertising the highest
+// total difficulty, towards its own head. It fails with errNoPeers if there are
+// no peers, or errLowTd if none of them is ahead of the local chain (if LocalTd
+// is configured). This method is synchronous.
+func (d *Downloader) SynchroniseBest() error {
+	return d.synchroniseContext(context.Background(), "", common.Hash{}, nil, FullSync)
+}
+
+// SynchroniseContext runs a synchronisation as Synchronise does, additionally
+// aborting it once the given context is done, as if Cancel was called. In that
+// case the queue is reset and the context's error returned.
+func (d *Downloader) SynchroniseContext(ctx context.Context, id string, hash common.Hash) error {
+	return d.synchroniseContext(ctx, id, hash, nil, FullSync)
+}
+
+// SynchroniseMode runs a synchronisation as Synchronise does, retrieving the data
+// of the blocks according to the given mode. In HeaderSync mode only the headers
+// are retrieved, from the peers supporting it, and TakeBlocks yields header-only
+// blocks, leaving the bodies to be retrieved later.
+func (d *Downloader) SynchroniseMode(id string, hash common.Hash, mode SyncMode) error {
+	return d.synchroniseContext(context.Background(), id, hash, nil, mode)
+}
+
+// SynchroniseWith runs a synchronisation using only the given subset of the
+// registered peers, both for the hash discovery (failing over among themselves)
+// and the block retrievals, e.g. to isolate the behaviour of specific peers. The
+// sync is started with the first registered peer of the subset towards the given
+// head, or if it's empty, with the best peer of the subset towards its own.
+func (d *Downloader) SynchroniseWith(ids []string, hash common.Hash) error {
+	if ids == nil {
+		ids = []string{}
+	}
+	return d.synchroniseContext(context.Background(), "", hash, ids, FullSync)
+}
+
+// synchroniseContext runs a synchronisation, cancelling it once the context is
+// done and reporting the context's error instead of the cancellation.
+func (d *Downloader) synchroniseContext(ctx context.Context, id string, hash common.Hash, subset []string, mode SyncMode) error {
+	err := d.synchronise(ctx.Done(), id, hash, subset, mode)
+	if (err == errCancelHashFetch || err == errCancelBlockFetch) && ctx.Err() != nil {
+		d.publish(SyncCancelled, d.LastSync().Peer, nil)
+		return ctx.Err()
+	}
+	return err
+}
+
+// synchronise runs a synchronisation with the given peer towards the given head in
+// the given mode, restricting the retrievals to a subset of the peers if set. If
+// the done channel is closed midflight, the sync is cancelled.
+func (d *Downloader) synchronise(done <-chan struct{}, id string, hash common.Hash, subset []string, mode SyncMode) error {
+	// Reject the call outright if the previous one was too recent
+	if interval := d.config.MinSyncInterval; interval > 0 {
+		now, last := time.Now().UnixNano(), atomic.LoadInt64(&d.lastSync)
+		if now-last < int64(interval) || !atomic.CompareAndSwapInt64(&d.lastSync, last, now) {
+			return errTooFrequent
+		}
+	}
 	// Make sure only one goroutine is ever allowed past this point at once
-	if !atomic.CompareAndSwapInt32(&d.synchronising, 0, 1) {
+	if !d.beginSync() {
 		return ErrBusy
 	}
 	defer atomic.StoreInt32(&d.synchronising, 0)
 
+	d.mode = mode
+
 	// Create cancel channel for aborting midflight
-	d.cancelCh = make(chan struct{})
+	d.newCancel()
+	defer d.resources.releaseChannel()
+	defer d.finishRun()
+
+	// Cancel the sync if the caller gives up on it, waiting for the watcher to
+	// exit before the sync terminates
+	if done != nil {
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		d.resources.spawn(func() {
+			defer close(stopped)
+			select {
+			case <-done:
+				d.closeCancel()
+			case <-stop:
+			}
+		})
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+	atomic.StoreInt32(&d.preserve, 0)
 
-	// Abort if the queue still contains some leftover data
-	if _, cached := d.queue.Size(); cached > 0 && d.queue.GetHeadBlock() != nil {
-		return ErrPendingQueue
+	// Abort if the queue still contains some leftover data (unless it's only kept
+	// around for retrying a failed block download, which is discarded now), or
+	// if blocks salvaged from a failed sync are still waiting to be taken
+	d.mu.Lock()
+	failed, salvaged := d.failed, len(d.salvaged)
+	d.failed = false
+	d.mu.Unlock()
+
+	if _, cached := d.queue.Size(); salvaged > 0 || !failed && cached > 0 && d.queue.GetHeadBlock() != nil {
+		if !d.config.AutoDrain || d.config.InsertChain == nil {
+			return ErrPendingQueue
+		}
+		if err := d.drainBlocks(); err != nil {
+			return err
+		}
 	}
+	d.discovered = false
+
 	// Reset the queue and peer set to clean any internal leftover state
 	d.queue.Reset()
+	d.state.Reset()
 	d.peers.Reset()
 
+	d.mu.Lock()
+	d.paused = false
+	d.advances = 0
+	d.mu.Unlock()
+
+	select {
+	case <-d.preemptCh:
+	default:
+	}
+
+	// Restrict the sync to the requested peer subset, picking its origin peer
+	if subset != nil {
+		d.peers.Restrict(subset)
+		defer d.peers.Restrict(nil)
+
+		if len(d.peers.AllPeers()) == 0 {
+			return errNoSubsetPeers
+		}
+		if (hash != common.Hash{}) {
+			for _, sid := range subset {
+				if d.peers.Peer(sid) != nil {
+					id = sid
+					break
+				}
+			}
+		}
+	}
 	// Retrieve the origin peer and initiate the downloading process
+	if id == "" {
+		p, err := d.bestPeer()
+		if err != nil {
+			return err
+		}
+		if !d.compatible(p) {
+			return errIncompatibleChain
+		}
+		return d.syncWithPeer(p, p.head)
+	}
 	p := d.peers.Peer(id)
 	if p == nil {
 		return errUnknownPeer
 	}
+	if !d.compatible(p) {
+		return errIncompatibleChain
+	}
 	return d.syncWithPeer(p, hash)
 }
 
+// bestPeer selects the peer advertising the highest total difficulty. If multiple
+// such peers exist with different heads (i.e. a fork at the tip), the choice is
+// delegated to the configured tie breaker, or ErrAmbiguousHead returned if none.
+func (d *Downloader) bestPeer() (*peer, error) {
+	best := d.peers.BestPeers()
+	if len(best) == 0 {
+		return nil, errNoPeers
+	}
+	// Only consider the peers if they're ahead of the local chain
+	if d.config.LocalTd != nil {
+		if td := d.config.LocalTd(); td != nil && best[0].td.Cmp(td) <= 0 {
+			return nil, errLowTd
+		}
+	}
+	// If all the best peers agree on the head, any will do
+	ambiguous := false
+	for _, p := range best[1:] {
+		if p.head != best[0].head {
+			ambiguous = true
+			break
+		}
+	}
+	if !ambiguous {
+		return best[0], nil
+	}
+	// Otherwise let the tie breaker select a peer from the candidates
+	if d.config.TieBreak == nil {
+		return nil, ErrAmbiguousHead
+	}
+	candidates := make([]string, len(best))
+	for i, p := range best {
+		candidates[i] = p.id
+	}
+	id := d.config.TieBreak(candidates)
+	for _, p := range best {
+		if p.id == id {
+			return p, nil
+		}
+	}
+	return nil, ErrAmbiguousHead
+}
+
 // TakeBlocks takes blocks from the queue and yields them to the blockTaker handler
 // it's possible it yields no blocks
 func (d *Downloader) TakeBlocks() types.Blocks {
+	return d.takeBlocks(0)
+}
+
+// TakeBlocksN takes at most max consecutive blocks from the queue, starting from
+// the head, just like TakeBlocks does, leaving the rest of them in place for the
+// next call. It allows importers to insert the blocks in smaller batches.
+func (d *Downloader) TakeBlocksN(max int) types.Blocks {
+	if max <= 0 {
+		return nil
+	}
+	return d.takeBlocks(max)
+}
+
+// takeBlocks takes a batch of at most max blocks from the queue (zero meaning no
+// limit), handing out any salvaged blocks first.
+func (d *Downloader) takeBlocks(max int) types.Blocks {
+	// Hand out any blocks salvaged from a failed sync first
+	d.mu.Lock()
+	if blocks := d.salvaged; len(blocks) > 0 {
+		if max > 0 && len(blocks) > max {
+			d.salvaged = blocks[max:]
+			blocks = blocks[:max]
+		} else {
+			d.salvaged = nil
+		}
+		d.mu.Unlock()
+		return blocks
+	}
+	d.mu.Unlock()
+
+	// If the newest blocks are fetched first, yield them without waiting for their
+	// parents, unless they're inserted into the chain
+	if d.config.DescendingFetch && d.config.InsertChain == nil {
+		return d.queue.TakeBlocksN(nil, max)
+	}
 	// Check that there are blocks available and its parents are known
 	head := d.queue.GetHeadBlock()
 	if head == nil || !d.hasBlock(head.ParentHash()) {
 		return nil
 	}
-	// Retrieve a full batch of blocks
-	return d.queue.TakeBlocks(head)
+	// If the consumer is slow (download throttled), hold back short runs until
+	// the in-flight reservations complete and coalesce with them
+	if limit := d.config.CoalesceBatch; limit > 0 && d.queue.Throttle() {
+		if d.queue.InFlight() > 0 && d.queue.Contiguous() < limit {
+			return nil
+		}
+	}
+	// Retrieve a full (or limited) batch of blocks
+	return d.queue.TakeBlocksN(head, max)
+}
+
+// Flush feeds all the currently takeable blocks into the chain insertion callback,
+// independent of the insertion policy, allowing the embedder to force progress at
+// a convenient time while no sync is running. It returns the number of blocks
+// inserted, and the insertion error if any, in which case the peer that delivered
+// the offending block is demoted. Without an InsertChain callback the blocks can
+// be retrieved via TakeBlocks instead.
+func (d *Downloader) Flush() (int, error) {
+	if d.config.InsertChain == nil {
+		return 0, errNoInserter
+	}
+	// Make sure no sync inserts blocks concurrently
+	if !d.beginMaintenance() {
+		return 0, ErrBusy
+	}
+	defer d.endMaintenance()
+
+	flushed := 0
+	for {
+		head := d.queue.GetHeadBlock()
+		if head == nil || !d.hasBlock(head.ParentHash()) {
+			return flushed, nil
+		}
+		blocks, origins := d.queue.TakeBlocksWithOrigins(head)
+		if len(blocks) == 0 {
+			return flushed, nil
+		}
+		if index, err := d.config.InsertChain(blocks); err != nil {
+			glog.V(logger.Debug).Infof("Failed to flush %d blocks: %v", len(blocks), err)
+			if index >= 0 && index < len(origins) {
+				if peer := d.peers.Peer(origins[index]); peer != nil {
+					d.demote(peer)
+				}
+			}
+			return flushed + index, err
+		}
+		flushed += len(blocks)
+	}
+}
+
+// BlockSource retrieves the id of the peer that delivered a downloaded block, so
+// that the embedder may penalize it if the block is rejected upon insertion. The
+// attribution is available until the next sync starts (or the current one fails),
+// the flag being false for unknown blocks.
+func (d *Downloader) BlockSource(hash common.Hash) (string, bool) {
+	return d.queue.BlockSource(hash)
 }
 
 func (d *Downloader) Has(hash common.Hash) bool {
@@ -162,274 +932,1655 @@ func (d *Downloader) Has(hash common.Hash) bool {
 // specified peer and head hash.
 func (d *Downloader) syncWithPeer(p *peer, hash common.Hash) (err error) {
 	defer func() {
-		// reset on error
-		if err != nil {
-			d.queue.Reset()
+		// Wrap up the sync and publish its outcome (cancellations are published by
+		// the cancel itself, pauses are not terminal)
+		switch err = d.finishSync(err); err {
+		case nil:
+			d.publish(SyncDone, p.id, nil)
+		case errCancelHashFetch, errCancelBlockFetch:
+		default:
+			d.publish(SyncFailed, p.id, err)
 		}
 	}()
+	d.publish(SyncStarted, p.id, nil)
 
 	glog.V(logger.Debug).Infoln("Synchronizing with the network using:", p.id)
-	if err = d.fetchHashes(p, hash); err != nil {
-		return err
+	d.lastInsert = d.clock.Now()
+	d.startResult(p.id, hash)
+	d.stateStarted = false
+
+	// Download the hash chain and the blocks until done or preempted by a newer head
+	var prev common.Hash // Head of the already discovered hash chain, if any
+	for {
+		d.phaseChange(PhaseHashes)
+		if err = d.fetchHashes(p, hash, prev); err == nil {
+			prev, d.stateTarget, d.stateStarted = hash, hash, false
+			d.discovered = true
+			err = d.downloadBlocks()
+		}
+		if err != errPreempted {
+			break
+		}
+		// If the preemption interrupted the initial discovery, nothing to preserve
+		if (prev == common.Hash{}) {
+			d.queue.Reset()
+		}
+		d.mu.RLock()
+		hash = d.preemptHead
+		d.mu.RUnlock()
+		glog.V(logger.Debug).Infof("Synchronization preempted by newer head %x", hash[:4])
 	}
-	if err = d.fetchBlocks(); err != nil {
+	return err
+}
+
+// downloadBlocks runs the block download phase of a synchronisation, notifying
+// the phase observer of its start and successful completion.
+func (d *Downloader) downloadBlocks() error {
+	d.phaseChange(PhaseBlocks)
+	if err := d.fetchBlocks(); err != nil {
 		return err
 	}
-	glog.V(logger.Debug).Infoln("Synchronization completed")
-
+	d.phaseChange(PhaseComplete)
 	return nil
 }
 
-// Cancel cancels all of the operations and resets the queue. It returns true
-// if the cancel operation was completed.
-func (d *Downloader) Cancel() bool {
-	hs, bs := d.queue.Size()
-	// If we're not syncing just return.
-	if atomic.LoadInt32(&d.synchronising) == 0 && hs == 0 && bs == 0 {
-		return false
+// reportProgress notifies the progress observer, if any, of the state of the sync,
+// unless it was notified too recently.
+func (d *Downloader) reportProgress() {
+	if d.config.OnProgress == nil || d.clock.Now().Sub(d.lastReport) < progressInterval {
+		return
 	}
+	d.lastReport = d.clock.Now()
 
-	close(d.cancelCh)
+	pending, cached := d.queue.Size()
+	d.config.OnProgress(d.queue.Taken(), pending, cached)
+}
 
-	// clean up
-hashDone:
-	for {
-		select {
-		case <-d.hashCh:
-		default:
-			break hashDone
-		}
+// phaseChange notifies the phase observer, if any, of a sync phase transition.
+func (d *Downloader) phaseChange(phase SyncPhase) {
+	if d.config.OnPhaseChange != nil {
+		d.config.OnPhaseChange(phase, d.queue.Pending())
 	}
+}
 
-blockDone:
-	for {
-		select {
-		case <-d.blockCh:
-		default:
-			break blockDone
+// finishSync wraps up a synchronisation on any of its terminating paths. On
+// success the remaining blocks are flushed into the chain (if an inserter is set),
+// whereas on failure the queue is reset, unless the block download was paused.
+// The outcome is recorded in the sync summary.
+func (d *Downloader) finishSync(err error) error {
+	defer func() { d.finishResult(err) }()
+
+	if err == nil {
+		if err = d.insertBlocks(true); err == nil {
+			glog.V(logger.Debug).Infoln("Synchronization completed")
+			return nil
 		}
 	}
+	if err == errCancelBlockFetch && atomic.LoadInt32(&d.preserve) == 1 {
+		glog.V(logger.Debug).Infoln("Synchronization paused")
 
-	// reset the queue
-	d.queue.Reset()
+		d.mu.Lock()
+		d.paused = true
+		d.mu.Unlock()
 
-	return true
-}
+		return err
+	}
+	// Rescue the contiguous blocks of a failed sync if requested, making at least
+	// some progress (cancellations are not failures, nothing to rescue there)
+	if d.config.SalvagePartial && err != errCancelBlockFetch && err != errCancelHashFetch {
+		d.salvage()
+	}
+	// If the block download failed after a successful discovery, keep the hashes
+	// around, allowing the block phase to be retried
+	if err != errCancelBlockFetch && d.discovered && d.queue.Pending()+d.queue.InFlight() > 0 {
+		glog.V(logger.Debug).Infoln("Block download failed, retryable:", err)
 
-// XXX Make synchronous
-func (d *Downloader) fetchHashes(p *peer, h common.Hash) error {
-	glog.V(logger.Debug).Infof("Downloading hashes (%x) from %s", h[:4], p.id)
+		d.mu.Lock()
+		d.failed = true
+		d.mu.Unlock()
 
-	start := time.Now()
+		return err
+	}
+	d.queue.Reset()
+	d.state.Reset()
+	return err
+}
 
-	// Add the hash to the queue first
-	d.queue.Insert([]common.Hash{h})
+// salvage takes the contiguous blocks of a failed sync from the queue before it's
+// discarded, inserting them into the chain if an inserter is set, or otherwise
+// keeping them around for the next TakeBlocks.
+func (d *Downloader) salvage() {
+	head := d.queue.GetHeadBlock()
+	if head == nil || !d.hasBlock(head.ParentHash()) {
+		return
+	}
+	blocks := d.queue.TakeBlocks(head)
+	if len(blocks) == 0 {
+		return
+	}
+	glog.V(logger.Debug).Infof("Salvaging %d blocks of failed sync", len(blocks))
 
-	// Get the first batch of hashes
-	p.getHashes(h)
+	d.mu.Lock()
+	d.result.Salvaged += len(blocks)
+	if d.config.InsertChain == nil {
+		d.salvaged = append(d.salvaged, blocks...)
+	}
+	d.mu.Unlock()
 
-	var (
-		failureResponseTimer = time.NewTimer(hashTtl)
-		attemptedPeers       = make(map[string]bool) // attempted peers will help with retries
-		activePeer           = p                     // active peer will help determine the current active peer
-		hash                 common.Hash             // common and last hash
-	)
+	if d.config.InsertChain != nil {
+		if _, err := d.config.InsertChain(blocks); err != nil {
+			glog.V(logger.Debug).Infof("Failed to insert %d salvaged blocks: %v", len(blocks), err)
+		}
+	}
+}
+
+// RetryBlocks re-runs the block download phase of a synchronisation which failed
+// after its hash discovery succeeded (e.g. because all peers became unavailable),
+// fetching the remaining blocks from the currently registered peers without
+// repeating the hash discovery. Any requests still in flight from the failed
+// attempt are returned to the queue first.
+func (d *Downloader) RetryBlocks() error {
+	// Make sure only one goroutine is ever allowed past this point at once
+	if !d.beginSync() {
+		return ErrBusy
+	}
+	defer atomic.StoreInt32(&d.synchronising, 0)
+
+	// Make sure there is a failed block download to retry
+	d.mu.Lock()
+	failed := d.failed
+	d.failed = false
+	d.mu.Unlock()
+
+	if !failed || d.queue.Pending()+d.queue.InFlight() == 0 {
+		return errNoPendingHashes
+	}
+	// Create a new cancel channel and reschedule everything from a clean peer set
+	d.newCancel()
+	defer d.resources.releaseChannel()
+	defer d.finishRun()
+
+	atomic.StoreInt32(&d.preserve, 0)
+
+	d.queue.Expire(0)
+	d.state.Expire(0)
+	d.peers.Reset()
+
+	glog.V(logger.Debug).Infoln("Retrying block download")
+	return d.finishSync(d.downloadBlocks())
+}
+
+// Resume continues an interrupted synchronisation from the cached queue state,
+// either paused via CancelPreserve or failed after its hash discovery completed,
+// downloading the remaining blocks of the already discovered hash chain without
+// re-running hash discovery. The given peer is recorded as the origin of the
+// resumed sync, but the blocks are fetched from any of the registered peers.
+//
+// If the head block of the queue is already cached, its parent must be known
+// locally, otherwise the queue is stale and Resume fails with errUnknownParent,
+// leaving the state untouched.
+func (d *Downloader) Resume(id string) error {
+	// Make sure only one goroutine is ever allowed past this point at once
+	if !d.beginSync() {
+		return ErrBusy
+	}
+	defer atomic.StoreInt32(&d.synchronising, 0)
+
+	p := d.peers.Peer(id)
+	if p == nil {
+		return errUnknownPeer
+	}
+	if !d.compatible(p) {
+		return errIncompatibleChain
+	}
+	// Make sure there is an interrupted sync to continue, linking to the chain
+	d.mu.RLock()
+	paused := d.paused
+	d.mu.RUnlock()
+
+	if !paused && d.queue.Pending()+d.queue.InFlight() == 0 {
+		return errNoPausedSync
+	}
+	if head := d.queue.GetHeadBlock(); head != nil && !d.hasBlock(head.ParentHash()) {
+		return errUnknownParent
+	}
+	d.mu.Lock()
+	d.paused, d.failed = false, false
+	d.result.Peer = id
+	d.mu.Unlock()
+
+	// Create a new cancel channel and continue downloading the blocks
+	d.newCancel()
+	defer d.resources.releaseChannel()
+	defer d.finishRun()
+
+	atomic.StoreInt32(&d.preserve, 0)
+
+	// Unless paused, the in-flight requests of the interrupted sync are lost
+	if !paused {
+		d.queue.Expire(0)
+		d.state.Expire(0)
+		d.peers.Reset()
+	}
+	glog.V(logger.Debug).Infoln("Resuming synchronization using:", id)
+	return d.finishSync(d.downloadBlocks())
+}
+
+// Preempt aborts the running synchronisation, and restarts it from the same peer
+// towards the given newer head.
+//
+// If the new head is a descendant of the one being synchronised, all the download
+// state (cached blocks, pending hashes and in-flight requests) survives, and only
+// the new chain segment is discovered and scheduled after the existing ones. If
+// on the other hand the new head forks off below the previous target, the queue
+// is reset and the sync restarts from scratch.
+//
+// With ExtendDiscovery set, a running hash discovery is not aborted, rather it's
+// completed towards the stale head and extended to the new one afterwards. To
+// avoid a peer keeping the sync running forever, only a limited number of head
+// advances are accepted per sync, the rest failing with errHeadAdvanceLimit.
+func (d *Downloader) Preempt(head common.Hash) error {
+	// Make sure the downloader is active
+	if atomic.LoadInt32(&d.synchronising) == 0 {
+		return errNoSyncActive
+	}
+	limit := d.config.MaxHeadAdvances
+	if limit == 0 {
+		limit = maxHeadAdvances
+	}
+	// Replace any previous, not yet processed preemption and notify the sync
+	d.mu.Lock()
+	if d.advances >= limit {
+		d.mu.Unlock()
+		return errHeadAdvanceLimit
+	}
+	d.advances++
+	d.preemptHead = head
+	d.mu.Unlock()
+
+	select {
+	case d.preemptCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Cancel cancels all of the operations and resets the queue. It returns true
+// if the cancel operation was completed. It is idempotent and safe to call
+// repeatedly or concurrently, only one of the calls cancelling the sync and
+// returning true, the rest being no-ops returning false. It may also be called
+// from within the callbacks invoked by the sync (e.g. InsertChain), aborting it
+// with errCancelBlockFetch once the callback returns.
+func (d *Downloader) Cancel() bool {
+	hs, bs := d.queue.Size()
+	// If we're not syncing just return.
+	if atomic.LoadInt32(&d.synchronising) == 0 && hs == 0 && bs == 0 {
+		return false
+	}
+	// Abort the running sync (a paused one's cancel channel is already closed)
+	d.mu.Lock()
+	stale := d.paused || d.failed
+	d.paused, d.failed = false, false
+	d.mu.Unlock()
+
+	closed := d.closeCancel()
+
+	// clean up
+	d.drainDeliveries()
+
+	// reset the queue
+	d.queue.Reset()
+	d.state.Reset()
+
+	if closed || stale {
+		d.publish(SyncCancelled, d.LastSync().Peer, nil)
+	}
+	return closed || stale
+}
+
+// Reset wipes all the download state between unrelated synchronisations (e.g.
+// when switching networks) without starting a new one: the queue, the state
+// retrieval, any paused or failed sync along with its salvaged blocks, and the
+// reputation, latency, ban and imported score data of the peers. The peers stay
+// registered. It fails with ErrBusy if a sync is currently running.
+func (d *Downloader) Reset() error {
+	// Make sure no sync starts while the state is being wiped
+	if !d.beginMaintenance() {
+		return ErrBusy
+	}
+	defer d.endMaintenance()
+
+	// Deliveries are rejected from now on, discard any which got in beforehand
+	d.drainDeliveries()
+
+	d.queue.Reset()
+	d.state.Reset()
+	d.peers.Reset()
+	d.peers.Forget()
+
+	d.mu.Lock()
+	d.paused, d.failed = false, false
+	d.salvaged = nil
+	d.scores = make(map[string]peerScore)
+	d.mu.Unlock()
+
+	d.discovered = false
+	return nil
+}
+
+// beginSync marks a sync run as started, unless another one is already running,
+// or Flush or Reset are operating on the download state.
+func (d *Downloader) beginSync() bool {
+	if atomic.LoadInt32(&d.maintaining) == 1 || !atomic.CompareAndSwapInt32(&d.synchronising, 0, 1) {
+		return false
+	}
+	if atomic.LoadInt32(&d.maintaining) == 1 {
+		atomic.StoreInt32(&d.synchronising, 0)
+		return false
+	}
+	return true
+}
+
+// beginMaintenance marks the download state as operated on outside of a sync run,
+// excluding new syncs until endMaintenance is called. It fails if a sync (or
+// another maintenance operation) is already running. Contrary to a sync, the
+// deliveries stay rejected meanwhile.
+func (d *Downloader) beginMaintenance() bool {
+	if !atomic.CompareAndSwapInt32(&d.maintaining, 0, 1) {
+		return false
+	}
+	if atomic.LoadInt32(&d.synchronising) == 1 {
+		atomic.StoreInt32(&d.maintaining, 0)
+		return false
+	}
+	return true
+}
+
+// endMaintenance releases the download state, allowing syncs to start again.
+func (d *Downloader) endMaintenance() {
+	atomic.StoreInt32(&d.maintaining, 0)
+}
+
+// drainDeliveries discards any hash, block and state deliveries not yet processed.
+func (d *Downloader) drainDeliveries() {
+hashDone:
+	for {
+		select {
+		case <-d.hashCh:
+		default:
+			break hashDone
+		}
+	}
+
+blockDone:
+	for {
+		select {
+		case <-d.blockCh:
+		default:
+			break blockDone
+		}
+	}
+
+nodeDone:
+	for {
+		select {
+		case <-d.nodeCh:
+		default:
+			break nodeDone
+		}
+	}
+}
+
+// CancelPreserve pauses the running synchronisation, stopping all activity but
+// keeping the download queue and the in-flight reservations intact, so that the
+// sync can later be continued via Resume. It returns true if the sync was paused.
+//
+// The download state survives only if hash discovery has already completed, a
+// sync paused during discovery is discarded as with Cancel. Between pausing and
+// resuming the following invariants hold:
+//   - No new sync may be started, as Synchronise discards the paused state (or
+//     fails with ErrPendingQueue if cached blocks are still waiting to be taken).
+//   - Blocks delivered while paused are dropped, their reservations expiring
+//     normally after the resumption.
+//   - Peers may freely come and go, the resumed sync uses the peer set as is.
+func (d *Downloader) CancelPreserve() bool {
+	// If we're not syncing just return
+	if atomic.LoadInt32(&d.synchronising) == 0 {
+		return false
+	}
+	atomic.StoreInt32(&d.preserve, 1)
+	d.closeCancel()
+
+	return true
+}
+
+// CancelGraceful cancels the running sync as Cancel does, but first suspends the
+// issuing of new block requests, waiting up to the given timeout for the ones in
+// flight to be delivered. The contiguous blocks downloaded so far are salvaged
+// before the queue is reset, inserted into the chain if an inserter is set, or
+// otherwise kept around for the next TakeBlocks, so they needn't be downloaded
+// again by the next sync.
+func (d *Downloader) CancelGraceful(timeout time.Duration) bool {
+	// If we're not syncing just return
+	if atomic.LoadInt32(&d.synchronising) == 0 {
+		return false
+	}
+	// Drop any stale signal of a previous drain, and suspend the new requests
+	select {
+	case <-d.drainCh:
+	default:
+	}
+	atomic.StoreInt32(&d.draining, 1)
+	defer atomic.StoreInt32(&d.draining, 0)
+
+	// Wait for the outstanding reservations to complete, the deadline to pass, or
+	// the sync run to terminate by itself
+	if d.queue.InFlight() > 0 {
+		d.mu.RLock()
+		done := d.doneCh
+		d.mu.RUnlock()
+
+		timer := d.resources.newTimer(d.clock, timeout)
+		defer d.resources.stopTimer(timer)
+
+		select {
+		case <-d.drainCh:
+		case <-done:
+		case <-timer.Chan():
+		}
+	}
+	d.salvage()
+
+	return d.Cancel()
+}
+
+// signalDrained notifies a graceful cancel awaiting the in-flight requests once
+// none are left.
+func (d *Downloader) signalDrained() {
+	if atomic.LoadInt32(&d.draining) == 1 && d.queue.InFlight() == 0 {
+		select {
+		case d.drainCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// newCancel creates a new cancel channel for aborting a sync run midflight.
+func (d *Downloader) newCancel() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cancelCh = d.resources.newCancelCh()
+	d.cancelled = false
+	d.doneCh = make(chan struct{})
+}
+
+// finishRun closes the done channel of the current sync run, releasing any block
+// deliveries still awaiting their processing.
+func (d *Downloader) finishRun() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	close(d.doneCh)
+}
+
+// closeCancel closes the cancel channel of the current sync run, unless it was
+// already closed, returning whether it did. It is safe to call from within any
+// callback invoked by the sync.
+func (d *Downloader) closeCancel() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cancelled {
+		return false
+	}
+	close(d.cancelCh)
+	d.cancelled = true
+	return true
+}
+
+// interrupted checks whether the current sync run was cancelled, allowing the
+// fetchers to notice a cancellation requested from within a callback.
+func (d *Downloader) interrupted() bool {
+	select {
+	case <-d.cancelCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// XXX Make synchronous
+//
+// If prev is non-zero, the queue already contains the hash chain up to prev, and
+// only the segment between h and prev is retrieved and scheduled.
+func (d *Downloader) fetchHashes(p *peer, h common.Hash, prev common.Hash) error {
+	glog.V(logger.Debug).Infof("Downloading hashes (%x) from %s", h[:4], p.id)
+
+	start := d.clock.Now()
+
+	// Add the hash to the queue first, or collect the segment if extending the chain
+	extend := prev != (common.Hash{})
+
+	var segment []common.Hash
+	if extend {
+		segment = []common.Hash{h}
+	} else {
+		d.queue.Insert([]common.Hash{h})
+	}
+
+	// Get the first batch of hashes
+	if err := d.requestHashes(p, h); err != nil {
+		return err
+	}
+
+	// Wait for the replies at most for the configured hash request time allowance
+	ttl := d.config.HashTimeout
+	if ttl == 0 {
+		ttl = hashTtl
+	}
+	var (
+		failureResponseTimer = d.resources.newTimer(d.clock, ttl)
+		attemptedPeers       = make(map[string]bool) // attempted peers will help with retries
+		activePeer           = p                     // active peer will help determine the current active peer
+		hash                 common.Hash             // common and last hash
+		from                 = h                     // hash from which the last request started
+		visited              = make(map[common.Hash]bool)
+		advanced             = false                // whether a head advance was deferred until the discovery completes
+		emptyRetries         = make(map[string]int) // number of empty responses retried per peer
+		emptySwitches        = 0                    // number of peer switches after empty responses
+		switches             = 0                    // number of times the active peer was replaced
+		timeouts             = 0                    // number of consecutive hash request timeouts
+	)
+	visited[h] = true
 	attemptedPeers[p.id] = true
+	defer d.resources.stopTimer(failureResponseTimer)
+
+	// Bound the entire discovery phase, independent of the individual requests
+	timeout := d.config.HashDiscoveryTimeout
+	if timeout == 0 {
+		timeout = hashDiscoveryTtl
+	}
+	deadline := d.resources.newTimer(d.clock, timeout-d.clock.Now().Sub(start))
+	defer d.resources.stopTimer(deadline)
+
+	// Retrieve further sections of the chain in parallel if requested, starting at
+	// the heads of the other peers
+	var segments *hashSegments
+	if d.config.ParallelHashFetch && !extend {
+		segments = d.startSegments(p, h)
+	}
+
+	// nextPeer finds a new peer to continue the hash retrieval with. Unless chosen
+	// by the embedder, it's done by checking inclusion of the peers' best hash in our
+	// already fetched hash list. This can't guarantee 100% correctness but does a
+	// fair job.
+	nextPeer := func() *peer {
+		if limit := d.config.MaxPeerSwitches; limit > 0 && switches >= limit {
+			glog.V(logger.Debug).Infof("Hash fetching peer switch limit (%d) reached\n", limit)
+			return nil
+		}
+		if d.config.NextPeer != nil {
+			attempted := make(map[string]bool, len(attemptedPeers))
+			for id := range attemptedPeers {
+				attempted[id] = true
+			}
+			peer := d.peers.Peer(d.config.NextPeer(attempted))
+			if peer != nil && !d.compatible(peer) {
+				glog.V(logger.Debug).Infof("Skipping peer %s on incompatible chain\n", peer.id)
+				peer = nil
+			}
+			if peer != nil {
+				attemptedPeers[peer.id] = true
+				switches++
+			}
+			return peer
+		}
+		for _, peer := range d.peers.AllPeers() {
+			if d.queue.Has(peer.head) && !attemptedPeers[peer.id] && d.compatible(peer) {
+				attemptedPeers[peer.id] = true
+				switches++
+				return peer
+			}
+		}
+		return nil
+	}
+	// switchPeer moves the hash discovery over to a new peer, continuing from the
+	// given hash. It returns whether a replacement peer was found.
+	switchPeer := func(origin common.Hash) (bool, error) {
+		p := nextPeer()
+		if p == nil {
+			return false, nil
+		}
+		segments.drop(p.id)
+		activePeer, from = p, origin
+		if err := d.requestHashes(p, origin); err != nil {
+			return true, err
+		}
+		failureResponseTimer.Reset(d.hashBackoff(ttl, timeouts))
+		glog.V(logger.Debug).Infof("Hash fetching switched to new peer(%s)\n", p.id)
+		return true, nil
+	}
 
 out:
 	for {
 		select {
 		case <-d.cancelCh:
 			return errCancelHashFetch
+		case <-d.preemptCh:
+			// Abort the discovery towards the stale head, unless it should be extended
+			if !d.config.ExtendDiscovery {
+				return errPreempted
+			}
+			advanced = true
+
+		case <-deadline.Chan():
+			glog.V(logger.Debug).Infof("Hash discovery didn't complete in %v\n", timeout)
+			d.queue.Reset()
+
+			return errDiscoveryTimeout
 		case hashPack := <-d.hashCh:
-			// Make sure the active peer is giving us the hashes
+			// Enforce the discovery deadline, even if it fired while pacing the requests
+			// and deliveries keep arriving since
+			select {
+			case <-deadline.Chan():
+				glog.V(logger.Debug).Infof("Hash discovery didn't complete in %v\n", timeout)
+				d.queue.Reset()
+
+				return errDiscoveryTimeout
+			default:
+			}
+			// Account the received traffic, aborting if over budget
+			if err := d.account(uint64(len(hashPack.hashes) * len(common.Hash{}))); err != nil {
+				d.queue.Reset()
+				return err
+			}
+			// Make sure the active peer is giving us the hashes (or a parallel segment)
 			if hashPack.peerId != activePeer.id {
-				glog.V(logger.Debug).Infof("Received hashes from incorrect peer(%s)\n", hashPack.peerId)
+				if !segments.deliver(d, hashPack) {
+					glog.V(logger.Debug).Infof("Received hashes from incorrect peer(%s)\n", hashPack.peerId)
+				}
+				break
+			}
+			if segments.discard(hashPack.peerId) {
+				glog.V(logger.Debug).Infof("Dropped stale hash segment from active peer(%s)\n", hashPack.peerId)
 				break
 			}
 
-			failureResponseTimer.Reset(hashTtl)
+			failureResponseTimer.Reset(d.hashBackoff(ttl, timeouts))
 
-			// Make sure the peer actually gave something valid
+			// Bring reverse ordered deliveries into the newest first order, and drop the
+			// requested hash if echoed back
+			if activePeer.hashOrder == OldestFirst {
+				hashPack.hashes = reverseHashes(hashPack.hashes)
+			}
+			if len(hashPack.hashes) > 0 && hashPack.hashes[0] == from {
+				hashPack.hashes = hashPack.hashes[1:]
+			}
+			// Make sure the peer actually gave something valid, retrying a few times in
+			// case it's just catching up, and moving on to another peer afterwards
 			if len(hashPack.hashes) == 0 {
 				glog.V(logger.Debug).Infof("Peer (%s) responded with empty hash set\n", activePeer.id)
+				if emptyRetries[activePeer.id] < d.config.EmptyHashRetries {
+					emptyRetries[activePeer.id]++
+					if err := d.retryHashes(activePeer, from); err != nil {
+						return err
+					}
+					failureResponseTimer.Reset(d.hashBackoff(ttl, timeouts))
+					continue
+				}
+				limit := d.config.EmptyHashSwitches
+				if limit == 0 {
+					limit = emptyHashSwitch
+				}
+				if emptySwitches < limit {
+					d.demote(activePeer)
+					switched, err := switchPeer(from)
+					if err != nil {
+						return err
+					}
+					if switched {
+						emptySwitches++
+						continue
+					}
+				}
 				d.queue.Reset()
 
 				return errEmptyHashSet
 			}
+			// Valid hashes arrived, drop any backoff accumulated by the timeouts
+			timeouts = 0
+
+			// Splice in any parallel segment reached, handing the discovery over to its
+			// peer if the segment is still being retrieved
+			handover := false
+			if merged, segment := segments.merge(hashPack.hashes); segment != nil {
+				glog.V(logger.Debug).Infof("Merged %d hashes of segment from %s\n", len(segment.hashes), segment.peer.id)
+				hashPack.hashes = merged
+				if segment.pending && !segment.done {
+					activePeer, handover = segment.peer, true
+				}
+			}
+			// Abort if the delivered hash chain loops back on itself
+			for _, hash := range hashPack.hashes {
+				if visited[hash] {
+					glog.V(logger.Debug).Infof("Peer (%s) delivered hash cycle at %x\n", activePeer.id, hash[:4])
+					d.demote(activePeer)
+					d.queue.Reset()
+
+					return errHashCycle
+				}
+				visited[hash] = true
+			}
 			// Determine if we're done fetching hashes (queue up all pending), and continue if not done
 			done, index := false, 0
+			bounded := d.rangeEnd != (common.Hash{})
 			for index, hash = range hashPack.hashes {
-				if d.hasBlock(hash) || d.queue.GetBlock(hash) != nil {
+				if (bounded && hash == d.rangeEnd) || d.hasBlock(hash) || (extend && hash == prev) || (!extend && d.queue.GetBlock(hash) != nil) {
+					// A range sync must link up exactly at the end of its range
+					if bounded && hash != d.rangeEnd {
+						glog.V(logger.Debug).Infof("Range sync reached %x instead of range end %x\n", hash[:4], d.rangeEnd[:4])
+						d.queue.Reset()
+
+						return errRangeEndSkipped
+					}
 					glog.V(logger.Debug).Infof("Found common hash %x\n", hash[:4])
+					d.milestone(&d.result.CommonAncestor)
+					if !extend || hash != prev {
+						d.recordAncestor(hash)
+					}
 					hashPack.hashes = hashPack.hashes[:index]
 					done = true
 					break
 				}
 			}
-			d.queue.Insert(hashPack.hashes)
-
+			if extend {
+				segment = append(segment, hashPack.hashes...)
+			} else {
+				d.queue.Insert(hashPack.hashes)
+				d.reportProgress()
+			}
 			if !done {
-				activePeer.getHashes(hash)
+				// Abort if the chain grew too long without reaching a known block
+				limit := d.config.MaxHashChain
+				if limit == 0 {
+					limit = maxHashChain
+				}
+				if pending := d.queue.Pending() + len(segment); pending > limit {
+					glog.V(logger.Debug).Infof("Peer (%s) delivered %d hashes without a common ancestor\n", activePeer.id, pending)
+					d.demote(activePeer)
+					d.queue.Reset()
+
+					return errTooManyHashes
+				}
+				from = hash
+				if !handover {
+					if err := d.requestHashes(activePeer, hash); err != nil {
+						return err
+					}
+				}
+				failureResponseTimer.Reset(ttl)
 				continue
 			}
+			if extend {
+				// If the new segment links up with the previous head, schedule it after the
+				// existing hashes and grow the cache to accommodate the new blocks
+				if hash == prev {
+					d.queue.Extend(segment)
+					if err := d.queue.Alloc(0); err != nil {
+						return err
+					}
+					break out
+				}
+				// Otherwise the new head is on a fork, discard everything and start over
+				glog.V(logger.Debug).Infof("Preempting head forked off below previous target, resetting queue")
+				d.queue.Reset()
+				d.peers.Reset()
+				d.queue.Insert(segment)
+			}
 			// We're done, allocate the download cache and proceed pulling the blocks
 			offset := 0
 			if block := d.getBlock(hash); block != nil {
 				offset = int(block.NumberU64() + 1)
 			}
-			d.queue.Alloc(offset)
+			if err := d.queue.Alloc(offset); err != nil {
+				glog.V(logger.Debug).Infof("Cache allocation of %d hashes refused: %v\n", d.queue.Pending(), err)
+				return err
+			}
 			break out
 
-		case <-failureResponseTimer.C:
+		case <-failureResponseTimer.Chan():
 			glog.V(logger.Debug).Infof("Peer (%s) didn't respond in time for hash request\n", p.id)
+			timeouts++
 
-			var p *peer // p will be set if a peer can be found
-			// Attempt to find a new peer by checking inclusion of peers best hash in our
-			// already fetched hash list. This can't guarantee 100% correctness but does
-			// a fair job. This is always either correct or false incorrect.
-			for _, peer := range d.peers.AllPeers() {
-				if d.queue.Has(peer.head) && !attemptedPeers[peer.id] {
-					p = peer
-					break
+			// Attempt to find a new peer (this is always either correct or false incorrect),
+			// setting it as the active peer. This will invalidate any hashes that may be
+			// returned by our previous (delayed) peer. If all peers have been tried, or
+			// the hash is the zero hash, abort the process entirely.
+			switched := false
+			if (hash != common.Hash{}) {
+				var err error
+				if switched, err = switchPeer(hash); err != nil {
+					return err
 				}
 			}
-			// if all peers have been tried, abort the process entirely or if the hash is
-			// the zero hash.
-			if p == nil || (hash == common.Hash{}) {
+			if !switched {
 				d.queue.Reset()
 				return ErrTimeout
 			}
-			// set p to the active peer. this will invalidate any hashes that may be returned
-			// by our previous (delayed) peer.
-			activePeer = p
-			p.getHashes(hash)
-			glog.V(logger.Debug).Infof("Hash fetching switched to new peer(%s)\n", p.id)
 		}
 	}
-	glog.V(logger.Debug).Infof("Downloaded hashes (%d) in %v\n", d.queue.Pending(), time.Since(start))
+	glog.V(logger.Debug).Infof("Downloaded hashes (%d) in %v\n", d.queue.Pending(), d.clock.Now().Sub(start))
+
+	// If the head advanced meanwhile, re-signal it to extend the discovery
+	if advanced {
+		select {
+		case d.preemptCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// requestHashes requests a batch of hashes from a peer, waiting beforehand if the
+// previous request to the same peer was more recent than the configured minimum
+// request interval.
+func (d *Downloader) requestHashes(p *peer, from common.Hash) error {
+	if wait := p.lastHashRequest.Add(d.config.HashRequestInterval).Sub(d.clock.Now()); wait > 0 {
+		timer := d.resources.newTimer(d.clock, wait)
+		defer d.resources.stopTimer(timer)
+
+		select {
+		case <-timer.Chan():
+		case <-d.cancelCh:
+			return errCancelHashFetch
+		}
+	}
+	p.lastHashRequest = d.clock.Now()
+	p.getHashes(from)
+
+	return nil
+}
+
+// retryHashes re-requests a batch of hashes from a peer after a randomised delay,
+// giving it a chance to catch up after an empty response.
+func (d *Downloader) retryHashes(p *peer, from common.Hash) error {
+	delay := d.config.EmptyHashRetryDelay
+	if delay == 0 {
+		delay = emptyHashDelay
+	}
+	timer := d.resources.newTimer(d.clock, delay+time.Duration(rand.Int63n(int64(delay))))
+	defer d.resources.stopTimer(timer)
+
+	select {
+	case <-timer.Chan():
+	case <-d.cancelCh:
+		return errCancelHashFetch
+	}
+	return d.requestHashes(p, from)
+}
+
+// drainBlocks feeds all the takeable leftover blocks of a previous sync into the
+// chain insertion callback, before the queue is reset for a new one.
+func (d *Downloader) drainBlocks() error {
+	for {
+		blocks := d.TakeBlocks()
+		if len(blocks) == 0 {
+			return nil
+		}
+		glog.V(logger.Debug).Infof("Draining %d leftover blocks", len(blocks))
+		if _, err := d.config.InsertChain(blocks); err != nil {
+			glog.V(logger.Debug).Infof("Failed to insert %d leftover blocks: %v", len(blocks), err)
+			return err
+		}
+	}
+}
 
+// insertBlocks feeds the takeable blocks into the chain insertion callback if any
+// of the insertion policy's triggers fired, or unconditionally if forced.
+func (d *Downloader) insertBlocks(force bool) error {
+	if d.config.InsertChain == nil {
+		return nil
+	}
+	policy := DefaultInsertPolicy
+	if d.config.InsertPolicy != nil {
+		policy = *d.config.InsertPolicy
+	}
+	// Make sure there's something to insert at all
+	head := d.queue.GetHeadBlock()
+	if head == nil || !d.hasBlock(head.ParentHash()) {
+		return nil
+	}
+	// Check whether any of the insertion triggers fired
+	if !force {
+		switch {
+		case policy.Blocks > 0 && d.queue.Contiguous() >= policy.Blocks:
+		case policy.Interval > 0 && d.clock.Now().Sub(d.lastInsert) >= policy.Interval:
+		case policy.OnThrottle && d.queue.Throttle():
+		case policy.Bytes > 0 && d.queue.ContiguousSize() >= policy.Bytes:
+		default:
+			return nil
+		}
+	}
+	blocks := d.TakeBlocks()
+	if len(blocks) == 0 {
+		return nil
+	}
+	d.lastInsert = d.clock.Now()
+	if _, err := d.config.InsertChain(blocks); err != nil {
+		glog.V(logger.Debug).Infof("Failed to insert %d blocks: %v", len(blocks), err)
+		return err
+	}
+	if d.interrupted() {
+		return errCancelBlockFetch
+	}
 	return nil
 }
 
+// reverseHashes creates a copy of a hash slice in reverse order, leaving the
+// original untouched as it may be shared with the network layer.
+func reverseHashes(hashes []common.Hash) []common.Hash {
+	reversed := make([]common.Hash, len(hashes))
+	for i, hash := range hashes {
+		reversed[len(hashes)-1-i] = hash
+	}
+	return reversed
+}
+
 // fetchBlocks iteratively downloads the entire schedules block-chain, taking
 // any available peers, reserving a chunk of blocks for each, wait for delivery
 // and periodically checking for timeouts.
 func (d *Downloader) fetchBlocks() error {
 	glog.V(logger.Debug).Infoln("Downloading", d.queue.Pending(), "block(s)")
-	start := time.Now()
+	start := d.clock.Now()
 
 	// default ticker for re-fetching blocks every now and then
-	ticker := time.NewTicker(20 * time.Millisecond)
+	ticker := d.resources.newTicker(d.clock, 20*time.Millisecond)
+	defer d.resources.stopTicker(ticker)
+
+	// Throttle checker notifying the observer of any state transitions
+	throttled := false
+	throttle := func() bool {
+		// Try to grow an adaptive cache before giving in to the throttling
+		engaged := d.queue.Throttle()
+		if engaged && d.queue.Grow() {
+			engaged = d.queue.Throttle()
+		}
+		if engaged != throttled {
+			throttled = engaged
+			if d.config.OnThrottleChange != nil {
+				d.config.OnThrottleChange(engaged)
+			}
+		}
+		return throttled
+	}
+	defer func() {
+		if throttled && d.config.OnThrottleChange != nil {
+			d.config.OnThrottleChange(false)
+		}
+	}()
+	// Request gate, filling the prefetch window even while throttled
+	saturated := func() bool {
+		return throttle() && d.queue.Saturated()
+	}
+	// Stall watchdog, aborting the sync if the cached head block doesn't link to the
+	// local chain for too long, nothing being taken meanwhile
+	taken, linked := d.queue.Taken(), d.clock.Now()
+	stalled := func() error {
+		timeout := d.config.HeadStallTimeout
+		if timeout <= 0 {
+			return nil
+		}
+		head := d.queue.GetHeadBlock()
+		if n := d.queue.Taken(); n != taken || head == nil || d.hasBlock(head.ParentHash()) {
+			taken, linked = n, d.clock.Now()
+			return nil
+		}
+		if d.clock.Now().Sub(linked) < timeout {
+			return nil
+		}
+		glog.V(logger.Error).Infof("Sync stalled for %v: head block #%d [%x] missing parent [%x]", timeout, head.NumberU64(), head.Hash().Bytes()[:4], head.ParentHash().Bytes()[:4])
+		return errStalledSync
+	}
+	// Unknown peer delivery tracker, aborting the sync on bursts if requested
+	var unknown []time.Time
+	unknownDelivery := func(id string) error {
+		glog.V(logger.Debug).Infof("Delivery from unknown peer %s\n", id)
+		if d.config.OnUnknownDelivery != nil {
+			d.config.OnUnknownDelivery(id)
+		}
+		if d.config.MaxUnknownDeliveries <= 0 {
+			return nil
+		}
+		now := time.Now()
+		for len(unknown) > 0 && now.Sub(unknown[0]) > unknownDeliveryTtl {
+			unknown = unknown[1:]
+		}
+		unknown = append(unknown, now)
+		if len(unknown) > d.config.MaxUnknownDeliveries {
+			return errUnknownDeliveries
+		}
+		return nil
+	}
+	// Issue the first round of requests right away, instead of waiting for a tick
+	if d.queue.Pending() > 0 && !saturated() {
+		d.requestBlocks(saturated)
+	}
 out:
 	for {
 		select {
 		case <-d.cancelCh:
 			return errCancelBlockFetch
+		case <-d.preemptCh:
+			return errPreempted
+		case <-d.hashCh:
+			// Drop any late hash deliveries, e.g. of parallel discovery segments
 		case blockPack := <-d.blockCh:
+			// Account the received traffic, aborting if over budget
+			size := uint64(0)
+			for _, block := range blockPack.blocks {
+				size += uint64(block.Size())
+			}
+			if err := d.account(size); err != nil {
+				blockPack.reply(0)
+				return err
+			}
+			// Track the bandwidth wasted on already downloaded blocks, and the blocks
+			// delivered beyond the sync target
+			duplicates, overflown := d.queue.Duplicates(blockPack.blocks), d.queue.BeyondTip(blockPack.blocks)
+			if duplicates > 0 || overflown > 0 {
+				d.mu.Lock()
+				d.result.Duplicates += duplicates
+				d.result.Overflown += overflown
+				d.mu.Unlock()
+			}
 			// If the peer was previously banned and failed to deliver it's pack
 			// in a reasonable time frame, ignore it's message.
 			if peer := d.peers.Peer(blockPack.peerId); peer != nil {
-				// Deliver the received chunk of blocks, but drop the peer if invalid
-				if err := d.queue.Deliver(blockPack.peerId, blockPack.blocks); err != nil {
+				// Drop any repeated echoes of an already processed chunk, demoting stuck peers
+				if repeats := peer.Repeated(blockPack.blocks); repeats > 0 {
+					glog.V(logger.Debug).Infof("Peer %s repeated delivery %d times\n", peer.id, repeats)
+					if repeats >= repeatedDeliveryLimit {
+						d.demote(peer)
+					}
+					blockPack.reply(0)
+					break
+				}
+				// Drop any correlated deliveries answering a stale request
+				if blockPack.requestId != 0 && !d.queue.Requested(blockPack.peerId, blockPack.requestId) {
+					glog.V(logger.Debug).Infof("Dropping stale delivery %d from peer %s\n", blockPack.requestId, blockPack.peerId)
+					blockPack.reply(0)
+					break
+				}
+				// Reject the whole chunk if any of the blocks fails validation,
+				// returning the reservation to the queue
+				if err := d.validateBlocks(blockPack.blocks); err != nil {
+					glog.V(logger.Debug).Infof("Rejected delivery for peer %s: %v\n", blockPack.peerId, err)
+					d.queue.DeliverRequest(blockPack.peerId, blockPack.requestId, nil)
+					blockPack.reply(0)
+					peer.MarkFailure()
+					d.demote(peer)
+					break
+				}
+				// Deliver the received chunk of blocks, but drop the peer if invalid.
+				// Duplicates of already downloaded blocks are benign (e.g. overlapping
+				// retries), so only rejected blocks demote the peer.
+				result, err := d.queue.DeliverRequest(blockPack.peerId, blockPack.requestId, blockPack.blocks)
+				blockPack.reply(result.Accepted)
+				if err != nil && result.Rejected > 0 {
 					glog.V(logger.Debug).Infof("Failed delivery for peer %s: %v\n", blockPack.peerId, err)
-					peer.Demote()
+					peer.MarkFailure()
+					d.demote(peer)
+					break
+				}
+				if err != nil {
+					glog.V(logger.Debug).Infof("Ignored duplicate delivery for peer %s: %v\n", blockPack.peerId, err)
 					break
 				}
 				if glog.V(logger.Debug) {
-					glog.Infof("Added %d blocks from: %s\n", len(blockPack.blocks), blockPack.peerId)
+					glog.Infof("Added %d blocks from: %s\n", result.Accepted, blockPack.peerId)
+				}
+				d.reportProgress()
+
+				// Promote the peer (unless consistently slow or unhealthy) and update it's idle state
+				peer.MarkDelivered(result.Accepted)
+				switch {
+				case d.slowPeer(peer):
+					glog.V(logger.Debug).Infof("Peer %s delivering consistently slow\n", peer.id)
+					d.demote(peer)
+				case d.unhealthyPeer(peer):
+					glog.V(logger.Debug).Infof("Peer %s unhealthy\n", peer.id)
+					d.demote(peer)
+				default:
+					peer.Promote()
+				}
+				if !d.queue.Busy(peer.id) {
+					peer.SetIdle()
+				}
+			} else {
+				blockPack.reply(0)
+				if err := unknownDelivery(blockPack.peerId); err != nil {
+					return err
+				}
+			}
+			if _, cached := d.queue.Size(); cached > 0 {
+				d.milestone(&d.result.FirstBlock)
+			}
+			d.signalDrained()
+			d.startStateSync()
+
+		case nodePack := <-d.nodeCh:
+			// Account the received traffic, aborting if over budget
+			size := uint64(0)
+			for _, node := range nodePack.nodes {
+				size += uint64(len(node))
+			}
+			if err := d.account(size); err != nil {
+				return err
+			}
+			// Process the state trie nodes, dropping anything from unknown peers
+			if peer := d.peers.Peer(nodePack.peerId); peer != nil {
+				if err := d.processNodeData(peer, nodePack.nodes); err != nil {
+					return err
 				}
-				// Promote the peer and update it's idle state
-				peer.Promote()
-				peer.SetIdle()
 			}
-		case <-ticker.C:
+		case <-ticker.Chan():
+			// Insert the downloaded blocks if the insertion policy says so
+			if err := d.insertBlocks(false); err != nil {
+				return err
+			}
+			if err := stalled(); err != nil {
+				return err
+			}
 			// Check for bad peers. Bad peers may indicate a peer not responding
 			// to a `getBlocks` message. A timeout of 5 seconds is set. Peers
 			// that badly or poorly behave are removed from the peer set (not banned).
 			// Bad peers are excluded from the available peer set and therefor won't be
 			// reused. XXX We could re-introduce peers after X time.
-			badPeers := d.queue.Expire(blockTtl)
+			badPeers := d.queue.Expire(d.blockTimeout())
 			for _, pid := range badPeers {
 				// XXX We could make use of a reputation system here ranking peers
 				// in their performance
-				// 1) Time for them to respond;
+				// 1) Time for them to respond (see PreferFastPeers);
 				// 2) Measure their speed;
 				// 3) Amount and availability.
 				if peer := d.peers.Peer(pid); peer != nil {
-					peer.Demote()
+					peer.MarkTimeout()
+					d.demote(peer)
 				}
 			}
 			// After removing bad peers make sure we actually have sufficient peer left to keep downloading
-			if d.peers.Len() == 0 {
-				d.queue.Reset()
+			if d.peers.ActiveLen() == 0 {
 				return errNoPeers
 			}
+			if min := d.config.MinFetchPeers; min > 0 && d.healthyPeers() < min {
+				return errTooFewPeers
+			}
+			// Retrieve the state trie in parallel to the blocks if fast syncing
+			if err := d.fetchState(); err != nil {
+				return err
+			}
+			// Don't issue any new requests while draining for a graceful cancel
+			if atomic.LoadInt32(&d.draining) == 1 {
+				d.signalDrained()
+				continue
+			}
 			// If there are unrequested hashes left start fetching
 			// from the available peers.
 			if d.queue.Pending() > 0 {
 				// Throttle the download if block cache is full and waiting processing
-				if d.queue.Throttle() {
+				if saturated() {
 					continue
 				}
 				// Send a download request to all idle peers, until throttled
-				idlePeers := d.peers.IdlePeers()
-				for _, peer := range idlePeers {
-					// Short circuit if throttling activated since above
-					if d.queue.Throttle() {
-						break
-					}
-					// Get a possible chunk. If nil is returned no chunk
-					// could be returned due to no hashes available.
-					request := d.queue.Reserve(peer, maxBlockFetch)
-					if request == nil {
-						continue
-					}
-					// Fetch the chunk and check for error. If the peer was somehow
-					// already fetching a chunk due to a bug, it will be returned to
-					// the queue
-					if err := peer.Fetch(request); err != nil {
-						glog.V(logger.Error).Infof("Peer %s received double work\n", peer.id)
-						d.queue.Cancel(request)
-					}
-				}
+				idle := d.requestBlocks(saturated)
+
 				// Make sure that we have peers available for fetching. If all peers have been tried
 				// and all failed throw an error
 				if d.queue.InFlight() == 0 {
-					d.queue.Reset()
-
-					return fmt.Errorf("%v peers available = %d. total peers = %d. hashes needed = %d", errPeersUnavailable, len(idlePeers), d.peers.Len(), d.queue.Pending())
+					return &PeersUnavailableError{Idle: idle, Total: d.peers.ActiveLen(), HashesNeeded: d.queue.Pending()}
 				}
 
-			} else if d.queue.InFlight() == 0 {
+			} else if d.queue.InFlight() == 0 && d.stateDone() {
 				// When there are no more queue and no more in flight, We can
 				// safely assume we're done. Another part of the process will  check
-				// for parent errors and will re-request anything that's missing
+				// for parent errors and will re-request anything that's missing,
+				// unless a callback cancelled the sync in the meantime
+				if d.interrupted() {
+					return errCancelBlockFetch
+				}
 				break out
 			}
 		}
 	}
-	glog.V(logger.Detail).Infoln("Downloaded block(s) in", time.Since(start))
+	glog.V(logger.Detail).Infoln("Downloaded block(s) in", d.clock.Now().Sub(start))
+
+	return nil
+}
+
+// prefetchBlocks converts a number of chunks to prefetch beyond the throttle
+// threshold into a number of blocks, capped at maxPrefetch chunks.
+func prefetchBlocks(chunks int) int {
+	if chunks > maxPrefetch {
+		chunks = maxPrefetch
+	}
+	if chunks < 0 {
+		chunks = 0
+	}
+	return chunks * maxBlockFetch
+}
+
+// healthyPeers counts the peers available for the block download, which are not
+// deemed unhealthy.
+func (d *Downloader) healthyPeers() int {
+	healthy := 0
+	for _, peer := range d.peers.AllPeers() {
+		if !d.unhealthyPeer(peer) {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// slowPeer checks whether a peer's block deliveries are consistently slow compared
+// to the rest of the peer set, if slow peer detection is enabled.
+func (d *Downloader) slowPeer(p *peer) bool {
+	if d.config.SlowPeerPercentile <= 0 {
+		return false
+	}
+	factor := d.config.SlowPeerFactor
+	if factor == 0 {
+		factor = slowPeerFactor
+	}
+	return d.peers.Slow(p, d.config.SlowPeerPercentile, factor)
+}
+
+// hashBackoff retrieves the time allowance for a hash request following the given
+// number of consecutive timeouts: the flat ttl if none happened, growing from the
+// configured base exponentially afterwards, capped and jittered downwards by up to
+// a quarter, so that the peers of a stalled network aren't cycled in lockstep.
+func (d *Downloader) hashBackoff(ttl time.Duration, timeouts int) time.Duration {
+	if timeouts == 0 {
+		return ttl
+	}
+	base, factor, limit := d.config.HashBackoffBase, d.config.HashBackoffFactor, d.config.HashBackoffCap
+	if base == 0 {
+		base = ttl
+	}
+	if factor == 0 {
+		factor = hashBackoffRate
+	}
+	if factor < 1 {
+		factor = 1
+	}
+	if limit == 0 {
+		limit = hashBackoffCap
+	}
+	backoff := float64(base) * math.Pow(factor, float64(timeouts-1))
+	if backoff > float64(limit) {
+		backoff = float64(limit)
+	}
+	allowance := time.Duration(backoff)
+	if jitter := int64(allowance / 4); jitter > 0 {
+		allowance -= time.Duration(rand.Int63n(jitter))
+	}
+	return allowance
+}
+
+// blockTimeout retrieves the time allowance for a block request to be answered,
+// falling back to blockTtl if not configured.
+func (d *Downloader) blockTimeout() time.Duration {
+	if d.config.BlockTimeout > 0 {
+		return d.config.BlockTimeout
+	}
+	return blockTtl
+}
+
+// blockChunkSize retrieves the maximum number of blocks to request at once from a
+// peer, falling back to maxBlockFetch if not configured, and clamped at the upper
+// bound of maxBlockChunk otherwise.
+func (d *Downloader) blockChunkSize() int {
+	size := d.config.BlockChunkSize
+	switch {
+	case size <= 0:
+		return maxBlockFetch
+	case size > maxBlockChunk:
+		return maxBlockChunk
+	}
+	return size
+}
+
+// requestBlocks sends a block download request to all the idle peers, until the
+// download gets throttled, putting the fastest busy peers to additional use if
+// nobody's idle. It returns the number of idle peers found.
+func (d *Downloader) requestBlocks(throttle func() bool) int {
+	idlePeers := d.peers.IdlePeers()
+	if d.config.PreferFastPeers {
+		idlePeers = d.peers.IdlePeersByRTT()
+	}
+	if d.config.HealthWeights != nil {
+		sortByHealth(idlePeers, *d.config.HealthWeights)
+	}
+	if d.config.PreferFullPeers {
+		idlePeers = d.preferFullPeers(idlePeers)
+	}
+	for _, peer := range idlePeers {
+		// Short circuit if throttling activated since above
+		if throttle() {
+			break
+		}
+		// Skip any peers on a different chain, they can't serve our blocks
+		if !d.compatible(peer) {
+			continue
+		}
+		// Get a possible chunk. If nil is returned no chunk
+		// could be returned due to no hashes available.
+		var request *fetchRequest
+		if d.mode == HeaderSync {
+			if peer.getHeaders == nil {
+				continue
+			}
+			request = d.queue.ReserveHeaders(peer, peer.BlockFetchLimit(d.blockChunkSize()))
+		} else {
+			request = d.queue.Reserve(peer, peer.BlockFetchLimit(d.blockChunkSize()))
+		}
+		if request == nil {
+			continue
+		}
+		// Fetch the chunk and check for error. If the peer was somehow
+		// already fetching a chunk due to a bug, it will be returned to
+		// the queue
+		if err := peer.Fetch(request); err != nil {
+			glog.V(logger.Error).Infof("Peer %s received double work\n", peer.id)
+			d.queue.Cancel(request)
+		}
+	}
+	// If nobody's idle, put the fastest busy peers to additional use
+	if len(idlePeers) == 0 {
+		d.fetchExtra(throttle)
+	}
+	return len(idlePeers)
+}
+
+// fetchExtra assigns additional concurrent block requests to the fastest busy
+// peers, up to the configured per-peer request limit, or until throttled.
+func (d *Downloader) fetchExtra(throttle func() bool) {
+	if d.config.MaxPeerRequests <= 1 || d.mode == HeaderSync {
+		return
+	}
+	for _, peer := range d.peers.BusyPeers() {
+		if !d.compatible(peer) {
+			continue
+		}
+		for !throttle() {
+			request := d.queue.ReserveExtra(peer, peer.BlockFetchLimit(d.blockChunkSize()), d.config.MaxPeerRequests)
+			if request == nil {
+				break
+			}
+			if err := peer.FetchExtra(request); err != nil {
+				d.queue.Cancel(request)
+				break
+			}
+		}
+	}
+}
+
+// compatible checks whether a peer is on the same chain as the local node, i.e.
+// has the same genesis block. Unless both genesis hashes are known, the peer is
+// assumed to be compatible.
+func (d *Downloader) compatible(p *peer) bool {
+	if (d.config.Genesis == common.Hash{} || p.genesis == common.Hash{}) {
+		return true
+	}
+	return p.genesis == d.config.Genesis
+}
+
+// validateBlocks runs the delivered blocks through the configured validation
+// callback, if any, returning errInvalidBlock on the first one failing it.
+func (d *Downloader) validateBlocks(blocks []*types.Block) error {
+	if d.config.ValidateBlock == nil {
+		return nil
+	}
+	for _, block := range blocks {
+		if err := d.config.ValidateBlock(block); err != nil {
+			glog.V(logger.Debug).Infof("Block #%d [%x] failed validation: %v", block.NumberU64(), block.Hash().Bytes()[:4], err)
+			return errInvalidBlock
+		}
+	}
+	return nil
+}
+
+// unhealthyPeer checks whether a peer's health score dropped below the configured
+// minimum, if any.
+func (d *Downloader) unhealthyPeer(p *peer) bool {
+	if d.config.MinPeerHealth <= 0 {
+		return false
+	}
+	weights := DefaultHealthWeights
+	if d.config.HealthWeights != nil {
+		weights = *d.config.HealthWeights
+	}
+	return p.Health(weights) < d.config.MinPeerHealth
+}
+
+// preferFullPeers reorders a list of peers to try the archival ones first, also
+// dropping the pruned peers declared unable to serve the oldest missing block, as
+// long as any archival peer is registered to fall back to.
+func (d *Downloader) preferFullPeers(peers []*peer) []*peer {
+	archival := false
+	for _, peer := range d.peers.AllPeers() {
+		if peer.Archival() {
+			archival = true
+			break
+		}
+	}
+	number, missing := d.queue.FirstMissing()
+
+	full, partial := make([]*peer, 0, len(peers)), make([]*peer, 0, len(peers))
+	for _, peer := range peers {
+		switch {
+		case peer.Archival():
+			full = append(full, peer)
+		case archival && missing && peer.oldest > number:
+			// Pruned peer which would decline the request anyway
+		default:
+			partial = append(partial, peer)
+		}
+	}
+	return append(full, partial...)
+}
+
+// startStateSync schedules the state root of the sync target for retrieval in
+// fast sync mode, once its block (and with it the root) becomes available.
+func (d *Downloader) startStateSync() {
+	if !d.config.FastSync || d.stateStarted {
+		return
+	}
+	block := d.queue.GetBlock(d.stateTarget)
+	if block != nil && block.Hash() != d.stateTarget {
+		block = nil
+	}
+	if block == nil && d.hasBlock(d.stateTarget) {
+		block = d.getBlock(d.stateTarget)
+	}
+	if block == nil {
+		return
+	}
+	d.stateStarted = true
+
+	if root := block.Root(); root != emptyRoot && (d.config.StateKnown == nil || !d.config.StateKnown(root)) {
+		glog.V(logger.Debug).Infof("Downloading state trie %x of block #%d", root[:4], block.NumberU64())
+		d.state.Schedule([]common.Hash{root})
+	}
+}
+
+// stateDone checks whether the state retrieval (if any) has been completed.
+func (d *Downloader) stateDone() bool {
+	if !d.config.FastSync {
+		return true
+	}
+	d.startStateSync()
+	return d.stateStarted && d.state.Pending() == 0 && d.state.InFlight() == 0
+}
+
+// fetchState expires the timed out state requests, and assigns new ones to all
+// the idle peers capable of serving state trie nodes.
+func (d *Downloader) fetchState() error {
+	if !d.config.FastSync {
+		return nil
+	}
+	for _, pid := range d.state.Expire(d.blockTimeout()) {
+		if peer := d.peers.Peer(pid); peer != nil {
+			d.demote(peer)
+		}
+	}
+	if d.state.Pending() == 0 {
+		return nil
+	}
+	idlePeers := d.peers.IdleStatePeers()
+	for _, peer := range idlePeers {
+		request := d.state.Reserve(peer, maxStateFetch)
+		if request == nil {
+			continue
+		}
+		if err := peer.FetchNodeData(request); err != nil {
+			glog.V(logger.Error).Infof("Peer %s received double state work\n", peer.id)
+			d.state.Cancel(request)
+		}
+	}
+	// Make sure that state peers are available if still work's left
+	if d.state.InFlight() == 0 {
+		err := &StatePeersUnavailableError{Idle: len(idlePeers), NodesNeeded: d.state.Pending()}
+		d.state.Reset()
+		return err
+	}
+	return nil
+}
+
+// processNodeData validates a batch of state trie nodes delivered by a peer,
+// storing the requested ones and scheduling their children for retrieval.
+func (d *Downloader) processNodeData(peer *peer, blobs [][]byte) error {
+	nodes, err := d.state.Deliver(peer.id, blobs)
+	if err != nil {
+		glog.V(logger.Debug).Infof("Failed state delivery for peer %s: %v\n", peer.id, err)
+		d.demote(peer)
+	} else {
+		peer.Promote()
+	}
+	peer.SetStateIdle()
 
+	children := d.config.StateChildren
+	if children == nil {
+		children = trieChildren
+	}
+	for hash, blob := range nodes {
+		if err := d.config.StateStore(hash, blob); err != nil {
+			return err
+		}
+		refs, err := children(hash, blob)
+		if err != nil {
+			glog.V(logger.Debug).Infof("Failed to decode state node %x: %v\n", hash[:4], err)
+			continue
+		}
+		if d.config.StateKnown != nil {
+			unknown := refs[:0]
+			for _, ref := range refs {
+				if !d.config.StateKnown(ref) {
+					unknown = append(unknown, ref)
+				}
+			}
+			refs = unknown
+		}
+		d.state.Schedule(refs)
+	}
 	return nil
 }
 
 // DeliverBlocks injects a new batch of blocks received from a remote node.
 // This is usually invoked through the BlocksMsg by the protocol handler.
 func (d *Downloader) DeliverBlocks(id string, blocks []*types.Block) error {
+	if session := d.session(id); session != nil {
+		return session.DeliverBlocks(id, blocks)
+	}
+	_, _, err := d.sendBlocks(blockPack{peerId: id, blocks: blocks})
+	return err
+}
+
+// sendBlocks hands a block delivery over to the running sync, returning the
+// cancel and termination channels of the run it was handed to. The delivery is
+// dropped with errNoSyncActive if no sync is active, or if it terminates before
+// picking the delivery up.
+func (d *Downloader) sendBlocks(pack blockPack) (chan struct{}, chan struct{}, error) {
 	// Make sure the downloader is active
 	if atomic.LoadInt32(&d.synchronising) == 0 {
-		return errNoSyncActive
+		return nil, nil, errNoSyncActive
 	}
-	d.blockCh <- blockPack{id, blocks}
+	d.mu.RLock()
+	cancel, done := d.cancelCh, d.doneCh
+	d.mu.RUnlock()
 
-	return nil
+	select {
+	case d.blockCh <- pack:
+		return cancel, done, nil
+	case <-done:
+		return nil, nil, errNoSyncActive
+	}
+}
+
+// DeliverBlocksN injects a new batch of blocks received from a remote node, and
+// waits for it to be processed, returning the number of delivered blocks which
+// matched an outstanding reservation. Blocks dropped because the sync wasn't
+// active, or terminated before processing them, are reported as none accepted.
+func (d *Downloader) DeliverBlocksN(id string, blocks []*types.Block) (int, error) {
+	if session := d.session(id); session != nil {
+		return session.DeliverBlocksN(id, blocks)
+	}
+	accepted := make(chan int, 1)
+	cancel, done, err := d.sendBlocks(blockPack{peerId: id, blocks: blocks, accepted: accepted})
+	if err != nil {
+		return 0, err
+	}
+	// Wait for the delivery to be processed, or the sync run to terminate
+	select {
+	case n := <-accepted:
+		return n, nil
+	case <-cancel:
+		return 0, errCancelBlockFetch
+	case <-done:
+		return 0, errNoSyncActive
+	}
+}
+
+// DeliverHeaders injects a new batch of block headers received from a remote node
+// answering a header retrieval of a HeaderSync mode sync. The headers are queued
+// as header-only blocks, their bodies to be retrieved later.
+func (d *Downloader) DeliverHeaders(id string, headers []*types.Header) error {
+	blocks := make([]*types.Block, len(headers))
+	for i, header := range headers {
+		blocks[i] = types.NewBlockWithHeader(header)
+	}
+	return d.DeliverBlocks(id, blocks)
+}
+
+// DeliverBlocksWithId injects a new batch of blocks received from a remote node,
+// explicitly answering the block request with the given correlation id. Blocks
+// answering an unknown or already expired request are dropped.
+func (d *Downloader) DeliverBlocksWithId(id string, request uint64, blocks []*types.Block) error {
+	if session := d.session(id); session != nil {
+		return session.DeliverBlocksWithId(id, request, blocks)
+	}
+	_, _, err := d.sendBlocks(blockPack{peerId: id, requestId: request, blocks: blocks})
+	return err
 }
 
 // DeliverHashes injects a new batch of hashes received from a remote node into
 // the download schedule. This is usually invoked through the BlockHashesMsg by
-// the protocol handler.
+// the protocol handler. It blocks while a previous delivery is still pending
+// processing, see TryDeliverHashes for a non-blocking variant.
 func (d *Downloader) DeliverHashes(id string, hashes []common.Hash) error {
+	if session := d.session(id); session != nil {
+		return session.DeliverHashes(id, hashes)
+	}
 	// Make sure the downloader is active
 	if atomic.LoadInt32(&d.synchronising) == 0 {
 		return errNoSyncActive
@@ -442,3 +2593,65 @@ func (d *Downloader) DeliverHashes(id string, hashes []common.Hash) error {
 
 	return nil
 }
+
+// TryDeliverHashes injects a new batch of hashes just like DeliverHashes, but
+// without blocking if the downloader is busy. At most one delivery is buffered
+// while the sync is processing a previous one, so if a delivery is already
+// waiting, ErrDeliveryBusy is returned right away, leaving it to the protocol
+// handler to retry or drop the hashes.
+func (d *Downloader) TryDeliverHashes(id string, hashes []common.Hash) error {
+	if session := d.session(id); session != nil {
+		return session.TryDeliverHashes(id, hashes)
+	}
+	// Make sure the downloader is active
+	if atomic.LoadInt32(&d.synchronising) == 0 {
+		return errNoSyncActive
+	}
+	select {
+	case d.hashCh <- hashPack{id, hashes}:
+		return nil
+	default:
+		return ErrDeliveryBusy
+	}
+}
+
+// TryDeliverBlocks injects a new batch of blocks without blocking, neither if a
+// previous delivery is still waiting to be processed (same as TryDeliverHashes),
+// nor waiting for the processing of this one.
+func (d *Downloader) TryDeliverBlocks(id string, blocks []*types.Block) error {
+	if session := d.session(id); session != nil {
+		return session.TryDeliverBlocks(id, blocks)
+	}
+	// Make sure the downloader is active
+	if atomic.LoadInt32(&d.synchronising) == 0 {
+		return errNoSyncActive
+	}
+	select {
+	case d.blockCh <- blockPack{peerId: id, blocks: blocks}:
+		return nil
+	default:
+		return ErrDeliveryBusy
+	}
+}
+
+// DeliverNodeData injects a new batch of state trie nodes received from a remote
+// node. This is usually invoked through the NodeDataMsg by the protocol handler.
+func (d *Downloader) DeliverNodeData(id string, nodes [][]byte) error {
+	if session := d.session(id); session != nil {
+		return session.DeliverNodeData(id, nodes)
+	}
+	// Make sure the downloader is active
+	if atomic.LoadInt32(&d.synchronising) == 0 {
+		return errNoSyncActive
+	}
+	d.mu.RLock()
+	done := d.doneCh
+	d.mu.RUnlock()
+
+	select {
+	case d.nodeCh <- nodePack{id, nodes}:
+		return nil
+	case <-done:
+		return errNoSyncActive
+	}
+}
@@ -1,13 +1,24 @@
 package downloader
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 var knownHash = common.Hash{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
@@ -49,6 +60,7 @@ type downloadTester struct {
 	pcount       int
 	done         chan bool
 	activePeerId string
+	hashChunk    int // Number of hashes to deliver per request (0 = all at once)
 }
 
 func newTester(t *testing.T, hashes []common.Hash, blocks map[common.Hash]*types.Block) *downloadTester {
@@ -76,7 +88,20 @@ func (dl *downloadTester) getBlock(hash common.Hash) *types.Block {
 }
 
 func (dl *downloadTester) getHashes(hash common.Hash) error {
-	dl.downloader.DeliverHashes(dl.activePeerId, dl.hashes)
+	hashes := dl.hashes
+	if dl.hashChunk > 0 {
+		// Deliver only a limited chunk of hashes following the requested one
+		for i, h := range dl.hashes {
+			if h == hash {
+				hashes = dl.hashes[i+1:]
+				break
+			}
+		}
+		if len(hashes) > dl.hashChunk {
+			hashes = hashes[:dl.hashChunk]
+		}
+	}
+	dl.downloader.DeliverHashes(dl.activePeerId, hashes)
 	return nil
 }
 
@@ -99,6 +124,26 @@ func (dl *downloadTester) newPeer(id string, td *big.Int, hash common.Hash) {
 	dl.downloader.RegisterPeer(id, hash, dl.getHashes, dl.getBlocks(id))
 }
 
+// newOrderedPeer registers a new peer delivering its hashes in the given order.
+func (dl *downloadTester) newOrderedPeer(id string, order HashOrder, hash common.Hash) {
+	dl.pcount++
+
+	getHashes := dl.getHashes
+	if order == OldestFirst {
+		getHashes = func(hash common.Hash) error {
+			dl.downloader.DeliverHashes(dl.activePeerId, reverseHashes(dl.hashes))
+			return nil
+		}
+	}
+	dl.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        id,
+		Head:      hash,
+		GetHashes: getHashes,
+		GetBlocks: dl.getBlocks(id),
+		HashOrder: order,
+	})
+}
+
 func (dl *downloadTester) badBlocksPeer(id string, td *big.Int, hash common.Hash) {
 	dl.pcount++
 
@@ -273,3 +318,3810 @@ func TestThrottling(t *testing.T) {
 		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
 	}
 }
+
+// Tests that the throttling transitions are reported alternately, and that a
+// download terminating while throttled reports the release too.
+func TestThrottleChange(t *testing.T) {
+	targetBlocks := 256
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, cancel := range []bool{false, true} {
+		tester := newTester(t, hashes, blocks)
+		tester.downloader.queue.maxQueued = 64
+		tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+		var (
+			lock        sync.Mutex
+			transitions []bool
+		)
+		engaged := make(chan struct{}, 1)
+		tester.downloader.config.OnThrottleChange = func(throttled bool) {
+			lock.Lock()
+			transitions = append(transitions, throttled)
+			lock.Unlock()
+
+			if throttled {
+				select {
+				case engaged <- struct{}{}:
+				default:
+				}
+			}
+		}
+		errc := make(chan error, 1)
+		go func() { errc <- tester.sync("peer", hashes[0]) }()
+
+		// Wait for the throttling, and either cancel, or take all blocks meanwhile
+		<-engaged
+		if cancel {
+			tester.downloader.Cancel()
+		} else {
+			go func() {
+				for took := 0; took < targetBlocks; time.Sleep(time.Millisecond) {
+					took += len(tester.downloader.TakeBlocks())
+				}
+			}()
+		}
+		if err := <-errc; (err != nil) != cancel {
+			t.Fatalf("cancel %v: sync error mismatch: %v", cancel, err)
+		}
+		lock.Lock()
+		for i, throttled := range transitions {
+			if throttled != (i%2 == 0) {
+				t.Fatalf("cancel %v: transition %d mismatch: have %v, want %v", cancel, i, throttled, i%2 == 0)
+			}
+		}
+		if len(transitions) == 0 || transitions[len(transitions)-1] {
+			t.Fatalf("cancel %v: throttling not released: %v", cancel, transitions)
+		}
+		lock.Unlock()
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	hashes := createHashes(0, 9)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.CoalesceBatch = len(hashes) - 1
+
+	queue := tester.downloader.queue
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Reserve the whole chain for two peers, and deliver the oldest chunk
+	peer1 := newPeer("peer1", common.Hash{}, nil, nil)
+	peer2 := newPeer("peer2", common.Hash{}, nil, nil)
+
+	chunk1, chunk2 := queue.Reserve(peer1, 4), queue.Reserve(peer2, 5)
+	deliver := func(request *fetchRequest) {
+		pack := []*types.Block{}
+		for hash, _ := range request.Hashes {
+			pack = append(pack, blocks[hash])
+		}
+		if _, err := queue.Deliver(request.Peer.id, pack); err != nil {
+			t.Fatalf("failed to deliver chunk: %v", err)
+		}
+	}
+	deliver(chunk1)
+	if !queue.Throttle() {
+		t.Fatalf("download not throttled")
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != 0 {
+		t.Fatalf("short run not held back: took %d blocks", len(took))
+	}
+	// Deliver the adjacent chunk too and ensure a single batch is yielded
+	deliver(chunk2)
+	if took := tester.downloader.TakeBlocks(); len(took) != len(hashes)-1 {
+		t.Fatalf("coalesced batch mismatch: have %d, want %d", len(took), len(hashes)-1)
+	}
+}
+
+func TestHashOrdering(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, order := range []HashOrder{NewestFirst, OldestFirst} {
+		tester := newTester(t, hashes, blocks)
+		tester.newOrderedPeer("peer", order, hashes[0])
+
+		if err := tester.sync("peer", hashes[0]); err != nil {
+			t.Fatalf("order %d: failed to synchronise blocks: %v", order, err)
+		}
+		if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+			t.Fatalf("order %d: downloaded block mismatch: have %v, want %v", order, len(took), targetBlocks)
+		}
+	}
+}
+
+func TestPreemption(t *testing.T) {
+	targetBlocks, extraBlocks := 100, 50
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Create a chain segment extending the original one
+	extension := make([]common.Hash, extraBlocks)
+	for i := range extension {
+		binary.BigEndian.PutUint64(extension[i][8:16], uint64(i+1))
+		blocks[extension[i]] = createBlock(targetBlocks+1+extraBlocks-i, knownHash, extension[i])
+	}
+	tester := newTester(t, hashes, blocks)
+
+	// Preempt the sync with the extended head once block downloading starts
+	preempted := false
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		if !preempted {
+			preempted = true
+			tester.hashes = append(extension, hashes[0])
+			if err := tester.downloader.Preempt(extension[0]); err != nil {
+				t.Errorf("failed to preempt sync: %v", err)
+			}
+		}
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if !preempted {
+		t.Fatalf("sync not preempted")
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks+extraBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks+extraBlocks)
+	}
+}
+
+func TestHashRequestRateLimit(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	tester := newTester(t, hashes, blocks)
+	tester.hashChunk = 100
+	tester.downloader.config.HashRequestInterval = 20 * time.Millisecond
+
+	// Synchronise with a single peer, which needs to be waited for between requests
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	start := time.Now()
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if elapsed, limit := time.Since(start), 9*tester.downloader.config.HashRequestInterval; elapsed < limit {
+		t.Fatalf("hash requests not rate limited: took %v, want at least %v", elapsed, limit)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+func TestResourceLeaks(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Run a successful sync and check that all resources are released
+	tester := newTester(t, hashes, blocks)
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if stats := tester.downloader.Resources(); stats != (ResourceStats{}) {
+		t.Fatalf("resources leaked after sync: %+v", stats)
+	}
+	// Run a stalling sync, cancel it and check that all resources are released
+	tester = newTester(t, hashes, blocks)
+	tester.badBlocksPeer("peer", big.NewInt(10000), hashes[0])
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tester.sync("peer", hashes[0])
+	}()
+	for tester.downloader.queue.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	tester.downloader.Cancel()
+	if err := <-errc; err != errCancelBlockFetch {
+		t.Fatalf("cancelled sync error mismatch: have %v, want %v", err, errCancelBlockFetch)
+	}
+	if stats := tester.downloader.Resources(); stats != (ResourceStats{}) {
+		t.Fatalf("resources leaked after cancel: %+v", stats)
+	}
+}
+
+func TestInsertPolicy(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Insert the blocks during the sync, in batches of a limited size
+	inserted := 0
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.InsertPolicy = &InsertPolicy{Blocks: 100}
+	tester.downloader.config.InsertChain = func(blocks types.Blocks) (int, error) {
+		inserted += len(blocks)
+		return len(blocks), nil
+	}
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if inserted != targetBlocks {
+		t.Fatalf("inserted block mismatch: have %v, want %v", inserted, targetBlocks)
+	}
+	if len(tester.downloader.TakeBlocks()) != 0 {
+		t.Fatalf("blocks left in the queue after the final flush")
+	}
+	// Ensure an insertion failure aborts the sync
+	failure := errors.New("insertion failure")
+
+	tester = newTester(t, hashes, blocks)
+	tester.downloader.config.InsertChain = func(blocks types.Blocks) (int, error) {
+		return 0, failure
+	}
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	if err := tester.sync("peer", hashes[0]); err != failure {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, failure)
+	}
+}
+
+func TestHashCycle(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Create a hash chain looping back onto itself, spanning multiple requests
+	cycle := append(append([]common.Hash{}, hashes[:10]...), hashes[3:]...)
+
+	tester := newTester(t, cycle, blocks)
+	tester.hashChunk = 5
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	if err := tester.sync("peer", hashes[0]); err != errHashCycle {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errHashCycle)
+	}
+}
+
+func TestHashDiscoveryTimeout(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Create a peer responding in time to every request, but slow overall
+	tester := newTester(t, hashes, blocks)
+	tester.hashChunk = 100
+	tester.downloader.config.HashRequestInterval = 20 * time.Millisecond
+	tester.downloader.config.HashDiscoveryTimeout = 50 * time.Millisecond
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	if err := tester.sync("peer", hashes[0]); err != errDiscoveryTimeout {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errDiscoveryTimeout)
+	}
+}
+
+func TestPeerBlockFetchLimit(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a peer with a small limit and track its largest request
+	limit, largest := 10, 0
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "peer",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocks: func(hashes []common.Hash) error {
+			if len(hashes) > largest {
+				largest = len(hashes)
+			}
+			return getBlocks(hashes)
+		},
+		MaxBlockFetch: limit,
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if largest != limit {
+		t.Fatalf("largest request mismatch: have %v, want %v", largest, limit)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a peer holding back its first block request until released
+	var held []common.Hash
+	release := make(chan struct{})
+
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(hashes []common.Hash) error {
+		select {
+		case <-release:
+			return getBlocks(hashes)
+		default:
+			held = hashes
+			return nil
+		}
+	})
+	// Start a sync and pause it once the block download stalls
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tester.sync("peer", hashes[0])
+	}()
+	for tester.downloader.queue.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !tester.downloader.CancelPreserve() {
+		t.Fatalf("failed to pause sync")
+	}
+	if err := <-errc; err != errCancelBlockFetch {
+		t.Fatalf("paused sync error mismatch: have %v, want %v", err, errCancelBlockFetch)
+	}
+	if pending, inflight := tester.downloader.queue.Pending(), tester.downloader.queue.InFlight(); pending+len(held) != targetBlocks || inflight != 1 {
+		t.Fatalf("download state not preserved: pending %d, in-flight %d", pending, inflight)
+	}
+	// Resume the sync and deliver the held back reservation
+	close(release)
+	go func() {
+		pack := make([]*types.Block, len(held))
+		for i, hash := range held {
+			pack[i] = blocks[hash]
+		}
+		for tester.downloader.DeliverBlocks("peer", pack) == errNoSyncActive {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err := tester.downloader.Resume("peer"); err != nil {
+		t.Fatalf("failed to resume sync: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+func TestCancelGraceful(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.BlockChunkSize = 10
+
+	// Register a peer holding back its first block request until released
+	var requests int32
+	release := make(chan struct{})
+
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(hashes []common.Hash) error {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			go func() {
+				<-release
+				getBlocks(hashes)
+			}()
+			return nil
+		}
+		return getBlocks(hashes)
+	})
+	// Start a sync and cancel it gracefully once the first request is in flight
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tester.sync("peer", hashes[0])
+	}()
+	for tester.downloader.queue.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancelled := make(chan bool, 1)
+	go func() {
+		cancelled <- tester.downloader.CancelGraceful(time.Second)
+	}()
+	for atomic.LoadInt32(&tester.downloader.draining) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	if !<-cancelled {
+		t.Fatalf("failed to cancel sync")
+	}
+	if err := <-errc; err != errCancelBlockFetch {
+		t.Fatalf("cancelled sync error mismatch: have %v, want %v", err, errCancelBlockFetch)
+	}
+	// Ensure no new requests were issued, and the in-flight blocks were kept
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("block request count mismatch: have %d, want %d", n, 1)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != 10 {
+		t.Fatalf("salvaged block count mismatch: have %d, want %d", len(took), 10)
+	}
+}
+
+// Tests that a graceful cancel waits for the in-flight requests exactly up to its
+// deadline on the sync clock, cancelling the sync afterwards.
+func TestCancelGracefulTimeout(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	tester := newTester(t, hashes, createBlocksFromHashes(hashes))
+	tester.downloader.config.BlockTimeout = time.Hour
+
+	clock := newFakeClock()
+	tester.downloader.setClock(clock)
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func([]common.Hash) error { return nil })
+
+	errc := make(chan error, 1)
+	go func() { errc <- tester.sync("peer", hashes[0]) }()
+	for tester.downloader.queue.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Cancel gracefully, and ensure the wait lasts until the deadline passes
+	active := clock.Active()
+	cancelled := make(chan bool, 1)
+	go func() { cancelled <- tester.downloader.CancelGraceful(time.Minute) }()
+
+	for clock.Active() == active {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Minute - time.Millisecond)
+	select {
+	case <-cancelled:
+		t.Fatalf("graceful cancel returned before the deadline")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	if !<-cancelled {
+		t.Fatalf("failed to cancel sync")
+	}
+	if err := <-errc; err != errCancelBlockFetch {
+		t.Fatalf("cancelled sync error mismatch: have %v, want %v", err, errCancelBlockFetch)
+	}
+}
+
+func TestAmbiguousBestPeer(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Register two peers with the same TD, but different heads
+	register := func(tester *downloadTester) {
+		for i, id := range []string{"peer1", "peer2"} {
+			tester.downloader.RegisterPeerConfig(PeerConfig{
+				Id:        id,
+				Head:      hashes[i],
+				GetHashes: tester.getHashes,
+				GetBlocks: tester.getBlocks(id),
+				Td:        big.NewInt(10000),
+			})
+		}
+	}
+	// Ensure the ambiguity is reported if no tie breaker is set
+	tester := newTester(t, hashes, blocks)
+	register(tester)
+
+	if err := tester.sync("", common.Hash{}); err != ErrAmbiguousHead {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, ErrAmbiguousHead)
+	}
+	// Ensure the tie breaker's choice is used if set
+	tester = newTester(t, hashes, blocks)
+	tester.downloader.config.TieBreak = func(candidates []string) string {
+		if len(candidates) != 2 {
+			t.Errorf("candidate count mismatch: have %d, want %d", len(candidates), 2)
+		}
+		return "peer1"
+	}
+	register(tester)
+
+	tester.activePeerId = "peer1"
+	if err := tester.downloader.Synchronise("", common.Hash{}); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+func TestLowTdBestPeer(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.LocalTd = func() *big.Int { return big.NewInt(10000) }
+
+	register := func(id string, td int64) {
+		tester.downloader.RegisterPeerConfig(PeerConfig{
+			Id:        id,
+			Head:      hashes[0],
+			GetHashes: tester.getHashes,
+			GetBlocks: tester.getBlocks(id),
+			Td:        big.NewInt(td),
+		})
+	}
+	// Ensure peers not ahead of the local chain are not synchronised with
+	register("behind", 5000)
+	register("equal", 10000)
+
+	if err := tester.sync("", common.Hash{}); err != errLowTd {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errLowTd)
+	}
+	// Ensure the peer with the highest TD above the local one is picked
+	register("ahead", 20000)
+	register("slightly", 15000)
+
+	tester.activePeerId = "ahead"
+	if err := tester.downloader.Synchronise("", common.Hash{}); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+	if peer := tester.downloader.LastSync().Peer; peer != "ahead" {
+		t.Fatalf("sync peer mismatch: have %s, want %s", peer, "ahead")
+	}
+}
+
+func TestSynchroniseBest(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.LocalTd = func() *big.Int { return big.NewInt(10000) }
+
+	// Ensure syncing without any peers fails
+	if err := tester.downloader.SynchroniseBest(); err != errNoPeers {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errNoPeers)
+	}
+	register := func(id string, td int64) {
+		tester.downloader.RegisterPeerConfig(PeerConfig{
+			Id:        id,
+			Head:      hashes[0],
+			GetHashes: tester.getHashes,
+			GetBlocks: tester.getBlocks(id),
+			Td:        big.NewInt(td),
+		})
+	}
+	// Ensure peers not ahead of the local chain are not synchronised with
+	register("behind", 5000)
+	if err := tester.downloader.SynchroniseBest(); err != errLowTd {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errLowTd)
+	}
+	// Ensure the best peer is picked and synchronised with up to its head
+	register("ahead", 20000)
+
+	tester.activePeerId = "ahead"
+	if err := tester.downloader.SynchroniseBest(); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+	if sync := tester.downloader.LastSync(); sync.Peer != "ahead" || sync.Head != hashes[0] {
+		t.Fatalf("sync mismatch: have %s/%x, want %s/%x", sync.Peer, sync.Head[:4], "ahead", hashes[0][:4])
+	}
+}
+
+func TestFastSyncState(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Assemble a state trie and attach it to the sync target
+	key := func(i int) []byte { return crypto.Sha3([]byte{byte(i), byte(i >> 8)}) }
+	value := func(i int) string { return fmt.Sprintf("a value long enough not to be embedded %d", i) }
+
+	source, _ := ethdb.NewMemDatabase()
+	state := trie.New(nil, source)
+	for i := 0; i < 1000; i++ {
+		state.Update(key(i), []byte(value(i)))
+	}
+	state.Commit()
+
+	root := common.BytesToHash(state.Root())
+	blocks[hashes[0]].Header().Root = root
+
+	tester := newTester(t, hashes, blocks)
+
+	// Enable fast sync, storing the retrieved nodes into a fresh database
+	target, _ := ethdb.NewMemDatabase()
+	tester.downloader.config.FastSync = true
+	tester.downloader.config.StateStore = func(hash common.Hash, blob []byte) error {
+		target.Put(hash[:], blob)
+		return nil
+	}
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "peer",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocks: tester.getBlocks("peer"),
+		GetNodeData: func(hashes []common.Hash) error {
+			nodes := make([][]byte, 0, len(hashes))
+			for _, hash := range hashes {
+				if blob, err := source.Get(hash[:]); err == nil {
+					nodes = append(nodes, blob)
+				}
+			}
+			go tester.downloader.DeliverNodeData("peer", nodes)
+			return nil
+		},
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	// Verify that the entire state is accessible from the retrieved nodes
+	synced := trie.New(root[:], target)
+	for i := 0; i < 1000; i++ {
+		if have := string(synced.Get(key(i))); have != value(i) {
+			t.Fatalf("account %d mismatch: have %q, want %q", i, have, value(i))
+		}
+	}
+}
+
+// Tests that state trie node requests expire after the configured block request
+// allowance too, instead of the default one.
+func TestFastSyncStateTimeout(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	blocks[hashes[0]].Header().Root = common.Hash{0x01}
+
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.FastSync = true
+	tester.downloader.config.BlockTimeout = time.Second
+	tester.downloader.config.StateStore = func(common.Hash, []byte) error { return nil }
+
+	clock := newFakeClock()
+	tester.downloader.setClock(clock)
+
+	// Register a peer never answering the state retrievals
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:          "peer",
+		Head:        hashes[0],
+		GetHashes:   tester.getHashes,
+		GetBlocks:   tester.getBlocks("peer"),
+		GetNodeData: func([]common.Hash) error { return nil },
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- tester.sync("peer", hashes[0]) }()
+
+	// Drive the download until the state retrieval starts, and ensure the node
+	// request expires exactly after the configured allowance
+	for tester.downloader.state.InFlight() == 0 {
+		clock.Advance(20 * time.Millisecond)
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	select {
+	case err := <-errc:
+		t.Fatalf("sync terminated before the state request expired: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(20 * time.Millisecond)
+
+	err := <-errc
+	if !errors.Is(err, errPeersUnavailable) {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errPeersUnavailable)
+	}
+	var unavailable *StatePeersUnavailableError
+	if !errors.As(err, &unavailable) || unavailable.NodesNeeded == 0 {
+		t.Fatalf("state failure not reported structured: %v", err)
+	}
+}
+
+func TestEmptyHashRetry(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	tester.downloader.config.EmptyHashRetries = 1
+	tester.downloader.config.EmptyHashRetryDelay = 10 * time.Millisecond
+
+	// Register a peer which responds with an empty hash set to its first request
+	requests := 0
+	tester.downloader.RegisterPeer("peer", hashes[0], func(hash common.Hash) error {
+		if requests++; requests == 1 {
+			tester.downloader.DeliverHashes("peer", []common.Hash{})
+			return nil
+		}
+		return tester.getHashes(hash)
+	}, tester.getBlocks("peer"))
+
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("hash request count mismatch: have %d, want %d", requests, 2)
+	}
+	tester.downloader.TakeBlocks()
+
+	// Without any retries allowed, the empty response should abort the sync
+	tester.downloader.config.EmptyHashRetries = 0
+	requests = 0
+
+	if err := tester.sync("peer", hashes[0]); err != errEmptyHashSet {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errEmptyHashSet)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	tester := newTester(t, nil, nil)
+
+	// Unset parameters should report their defaults
+	settings := tester.downloader.Config()
+	if settings.HashDiscoveryTimeout != hashDiscoveryTtl {
+		t.Errorf("discovery timeout mismatch: have %v, want %v", settings.HashDiscoveryTimeout, hashDiscoveryTtl)
+	}
+	if settings.InsertPolicy != DefaultInsertPolicy {
+		t.Errorf("insert policy mismatch: have %+v, want %+v", settings.InsertPolicy, DefaultInsertPolicy)
+	}
+	if settings.BlockCacheLimit != blockCacheLimit {
+		t.Errorf("cache limit mismatch: have %v, want %v", settings.BlockCacheLimit, blockCacheLimit)
+	}
+	// Configured parameters should be reported as is
+	tester.downloader.config.HashDiscoveryTimeout = time.Minute
+	tester.downloader.config.MemoryPool = NewMemoryPool(1024)
+
+	settings = tester.downloader.Config()
+	if settings.HashDiscoveryTimeout != time.Minute {
+		t.Errorf("discovery timeout mismatch: have %v, want %v", settings.HashDiscoveryTimeout, time.Minute)
+	}
+	if settings.MemoryLimit != 1024 {
+		t.Errorf("memory limit mismatch: have %v, want %v", settings.MemoryLimit, 1024)
+	}
+}
+
+func TestRetryBlocks(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Sync with a peer delivering the hashes, but none of the blocks
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func([]common.Hash) error {
+		go tester.downloader.DeliverBlocks("peer", []*types.Block{})
+		return nil
+	})
+	if err := tester.sync("peer", hashes[0]); err == nil {
+		t.Fatalf("sync succeeded without any blocks")
+	}
+	// Replace the peer with a functional one and retry the block download only
+	tester.downloader.UnregisterPeer("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], func(common.Hash) error {
+		t.Errorf("hashes requested during block retry")
+		return nil
+	}, tester.getBlocks("peer"))
+
+	if err := tester.downloader.RetryBlocks(); err != nil {
+		t.Fatalf("failed to retry block download: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+	// Nothing's left to retry after a successful attempt
+	if err := tester.downloader.RetryBlocks(); err != errNoPendingHashes {
+		t.Fatalf("retry error mismatch: have %v, want %v", err, errNoPendingHashes)
+	}
+}
+
+func TestSyncMilestones(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	// Verify that the milestones were recorded in their natural order
+	result := tester.downloader.LastSync()
+	if result.Peer != "peer" || result.Head != hashes[0] || result.Err != nil {
+		t.Fatalf("sync summary mismatch: %+v", result)
+	}
+	if result.CommonAncestor == 0 {
+		t.Fatalf("common ancestor milestone not recorded")
+	}
+	if result.FirstBlock < result.CommonAncestor {
+		t.Fatalf("first block before common ancestor: %v < %v", result.FirstBlock, result.CommonAncestor)
+	}
+	if result.Elapsed < result.FirstBlock {
+		t.Fatalf("sync finished before first block: %v < %v", result.Elapsed, result.FirstBlock)
+	}
+}
+
+func TestCommonAncestor(t *testing.T) {
+	defer func(ttl time.Duration) { hashTtl = ttl }(hashTtl)
+	hashTtl = 50 * time.Millisecond
+
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Ensure the common ancestor found by the discovery is reported
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if ancestor := tester.downloader.LastCommonAncestor(); ancestor != knownHash {
+		t.Fatalf("common ancestor mismatch: have %x, want %x", ancestor[:4], knownHash[:4])
+	}
+	tester.downloader.TakeBlocks()
+
+	// Ensure a successive sync not finding any resets it
+	tester.downloader.RegisterPeer("silent", hashes[0], func(common.Hash) error { return nil }, tester.getBlocks("silent"))
+	if err := tester.sync("silent", hashes[0]); err != ErrTimeout {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, ErrTimeout)
+	}
+	if ancestor := tester.downloader.LastCommonAncestor(); ancestor != (common.Hash{}) {
+		t.Fatalf("stale common ancestor reported: %x", ancestor[:4])
+	}
+}
+
+// Tests that a peer serving an endless hash chain, never reaching a known block,
+// gets the discovery aborted once the configured maximum chain length is exceeded.
+func TestMaxHashChain(t *testing.T) {
+	tester := newTester(t, nil, nil)
+	tester.downloader.config.MaxHashChain = 1000
+
+	// Register an adversarial peer generating fresh unknown hashes on every request
+	var generated uint64
+	tester.downloader.RegisterPeer("endless", common.Hash{0xff}, func(common.Hash) error {
+		hashes := make([]common.Hash, 100)
+		for i := range hashes {
+			generated++
+			hashes[i][0] = 0xff
+			binary.BigEndian.PutUint64(hashes[i][8:16], generated)
+		}
+		tester.downloader.DeliverHashes("endless", hashes)
+		return nil
+	}, tester.getBlocks("endless"))
+
+	peer := tester.downloader.peers.Peer("endless")
+	peer.rep = 8
+
+	if err := tester.sync("endless", common.Hash{0xff}); err != errTooManyHashes {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errTooManyHashes)
+	}
+	if generated > 1100 {
+		t.Fatalf("discovery continued past the limit: %d hashes generated", generated)
+	}
+	if pending := tester.downloader.queue.Pending(); pending != 0 {
+		t.Fatalf("queue not reset: %d hashes pending", pending)
+	}
+	if rep := atomic.LoadInt32(&peer.rep); rep >= 8 {
+		t.Fatalf("endless peer not demoted: reputation %d", rep)
+	}
+	if limit := tester.downloader.Config().MaxHashChain; limit != 1000 {
+		t.Fatalf("reported hash chain limit mismatch: have %d, want %d", limit, 1000)
+	}
+}
+
+func TestPeerSwitchLimit(t *testing.T) {
+	defer func(ttl time.Duration) { hashTtl = ttl }(hashTtl)
+	hashTtl = 50 * time.Millisecond
+
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.hashChunk = 100
+
+	tester.downloader.config.MaxPeerSwitches = 2
+
+	// Register a peer delivering a single batch of hashes, and a few silent ones
+	// advertising heads already known from the first batch
+	requests := 0
+	tester.downloader.RegisterPeer("peer", hashes[0], func(hash common.Hash) error {
+		if requests++; requests == 1 {
+			return tester.getHashes(hash)
+		}
+		return nil
+	}, tester.getBlocks("peer"))
+
+	asked := make(map[string]bool)
+	for i, id := range []string{"silent-1", "silent-2", "silent-3"} {
+		id := id
+		tester.downloader.RegisterPeer(id, hashes[i+1], func(common.Hash) error {
+			asked[id] = true
+			return nil
+		}, tester.getBlocks(id))
+	}
+	if err := tester.sync("peer", hashes[0]); err != ErrTimeout {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, ErrTimeout)
+	}
+	if len(asked) != 2 {
+		t.Fatalf("switched peer count mismatch: have %d, want %d", len(asked), 2)
+	}
+}
+
+func TestNextPeerCallback(t *testing.T) {
+	defer func(ttl time.Duration) { hashTtl = ttl }(hashTtl)
+	hashTtl = 50 * time.Millisecond
+
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.hashChunk = 100
+
+	// Register a peer going silent after the first batch of hashes, and a backup
+	// one, which the built in heuristic wouldn't find (unknown head)
+	requests := 0
+	tester.downloader.RegisterPeer("peer", hashes[0], func(hash common.Hash) error {
+		if requests++; requests == 1 {
+			return tester.getHashes(hash)
+		}
+		return nil
+	}, tester.getBlocks("peer"))
+
+	tester.downloader.RegisterPeer("backup", common.Hash{0xff}, func(hash common.Hash) error {
+		tester.activePeerId = "backup"
+		return tester.getHashes(hash)
+	}, tester.getBlocks("backup"))
+
+	var attempted map[string]bool
+	tester.downloader.config.NextPeer = func(tried map[string]bool) string {
+		attempted = tried
+		return "backup"
+	}
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if len(attempted) != 1 || !attempted["peer"] {
+		t.Fatalf("attempted peer set mismatch: have %v, want %v", attempted, map[string]bool{"peer": true})
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+func TestSyncRateLimit(t *testing.T) {
+	targetBlocks := 10
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.MinSyncInterval = time.Hour
+
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	tester.downloader.TakeBlocks()
+
+	// Any subsequent call within the interval should be rejected
+	for i := 0; i < 3; i++ {
+		if err := tester.sync("peer", hashes[0]); err != errTooFrequent {
+			t.Fatalf("attempt %d: sync error mismatch: have %v, want %v", i, err, errTooFrequent)
+		}
+	}
+}
+
+func TestBlacklistLifecycle(t *testing.T) {
+	tester := newTester(t, nil, nil)
+
+	var dropped, readmitted []string
+	tester.downloader.config.OnPeerDrop = func(id string) { dropped = append(dropped, id) }
+	tester.downloader.config.OnPeerReadmit = func(id string) { readmitted = append(readmitted, id) }
+
+	// Blacklist a registered peer and ensure it's dropped and can't rejoin
+	tester.newPeer("peer", big.NewInt(10000), common.Hash{})
+	tester.downloader.Blacklist("peer")
+
+	if tester.downloader.peers.Peer("peer") != nil {
+		t.Fatalf("blacklisted peer still registered")
+	}
+	if len(dropped) != 1 || dropped[0] != "peer" {
+		t.Fatalf("dropped peers mismatch: have %v, want %v", dropped, []string{"peer"})
+	}
+	if banned := tester.downloader.BlacklistedPeers(); len(banned) != 1 || banned[0] != "peer" {
+		t.Fatalf("blacklisted peers mismatch: have %v, want %v", banned, []string{"peer"})
+	}
+	if err := tester.downloader.RegisterPeer("peer", common.Hash{}, nil, nil); err != errBlacklistedPeer {
+		t.Fatalf("blacklisted registration error mismatch: have %v, want %v", err, errBlacklistedPeer)
+	}
+	// Whitelist the peer and ensure it can rejoin
+	if err := tester.downloader.Whitelist("peer"); err != nil {
+		t.Fatalf("failed to whitelist peer: %v", err)
+	}
+	if len(readmitted) != 1 || readmitted[0] != "peer" {
+		t.Fatalf("readmitted peers mismatch: have %v, want %v", readmitted, []string{"peer"})
+	}
+	if banned := tester.downloader.BlacklistedPeers(); len(banned) != 0 {
+		t.Fatalf("blacklisted peers mismatch: have %v, want none", banned)
+	}
+	if err := tester.downloader.RegisterPeer("peer", common.Hash{}, tester.getHashes, tester.getBlocks("peer")); err != nil {
+		t.Fatalf("failed to re-register whitelisted peer: %v", err)
+	}
+	if err := tester.downloader.Whitelist("peer"); err != errNotBlacklisted {
+		t.Fatalf("repeated whitelist error mismatch: have %v, want %v", err, errNotBlacklisted)
+	}
+}
+
+func TestPreferFullPeers(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Register an archival peer and a pruned one, tracking the pruned requests
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.PreferFullPeers = true
+
+	pruned := 0
+	getBlocks := tester.getBlocks("pruned")
+	tester.newPeer("full", big.NewInt(10000), hashes[0])
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "pruned",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocks: func(hashes []common.Hash) error {
+			pruned++
+			return getBlocks(hashes)
+		},
+		Light:  true,
+		Oldest: uint64(targetBlocks) * 2,
+	})
+	if err := tester.sync("full", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if pruned != 0 {
+		t.Fatalf("pruned peer requested %d times", pruned)
+	}
+	// Without any archival peers, the pruned ones should be used regardless
+	tester = newTester(t, hashes, blocks)
+	tester.downloader.config.PreferFullPeers = true
+
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "pruned",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocks: tester.getBlocks("pruned"),
+		Light:     true,
+		Oldest:    uint64(targetBlocks) * 2,
+	})
+	if err := tester.sync("pruned", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks from pruned peer: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+func TestAutoDrain(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	// Leave a full sync's worth of blocks in the queue
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if err := tester.sync("peer", hashes[0]); err != ErrPendingQueue {
+		t.Fatalf("leftover sync error mismatch: have %v, want %v", err, ErrPendingQueue)
+	}
+	// Enable draining with a failing inserter and ensure the error is surfaced
+	failure := errors.New("insert failure")
+	tester.downloader.config.AutoDrain = true
+	tester.downloader.config.InsertChain = func(types.Blocks) (int, error) { return 0, failure }
+
+	if err := tester.sync("peer", hashes[0]); err != failure {
+		t.Fatalf("drain error mismatch: have %v, want %v", err, failure)
+	}
+	// Leave another batch of blocks in the queue, and drain them with a working inserter
+	tester.downloader.config.InsertChain = nil
+	tester.downloader.Cancel()
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	inserted := 0
+	tester.downloader.config.InsertChain = func(blocks types.Blocks) (int, error) {
+		inserted += len(blocks)
+		return len(blocks), nil
+	}
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise after draining: %v", err)
+	}
+	if inserted != 2*targetBlocks {
+		t.Fatalf("inserted block count mismatch: have %d, want %d", inserted, 2*targetBlocks)
+	}
+}
+
+func TestTrafficBudget(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	// Run an unlimited sync to measure its traffic
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	tester.downloader.TakeBlocks()
+
+	traffic := tester.downloader.LastSync().Bytes
+	if traffic < uint64(targetBlocks*len(common.Hash{})) {
+		t.Fatalf("traffic too low: have %d, want at least %d", traffic, targetBlocks*len(common.Hash{}))
+	}
+	// Limit the traffic below the required and ensure the sync is aborted
+	tester.downloader.config.TrafficBudget = traffic / 2
+	if err := tester.sync("peer", hashes[0]); err != errBudgetExceeded {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errBudgetExceeded)
+	}
+	if result := tester.downloader.LastSync(); result.Err != errBudgetExceeded || result.Bytes <= traffic/2 {
+		t.Fatalf("sync summary mismatch: %+v", result)
+	}
+}
+
+func TestSlowPeerDemotion(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.SlowPeerPercentile = 0.5
+
+	// Register a few fast peers and a uniformly slow one, requesting small chunks
+	for _, id := range []string{"fast-1", "fast-2", "fast-3"} {
+		tester.downloader.RegisterPeerConfig(PeerConfig{
+			Id:            id,
+			Head:          hashes[0],
+			GetHashes:     tester.getHashes,
+			GetBlocks:     tester.getBlocks(id),
+			MaxBlockFetch: 16,
+		})
+	}
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "slow",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocks: func(hashes []common.Hash) error {
+			delivery := make([]*types.Block, len(hashes))
+			for i, hash := range hashes {
+				delivery[i] = blocks[hash]
+			}
+			go func() {
+				time.Sleep(25 * time.Millisecond)
+				tester.downloader.DeliverBlocks("slow", delivery)
+			}()
+			return nil
+		},
+		MaxBlockFetch: 16,
+	})
+	if err := tester.sync("fast-1", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	// Ensure the slow peer was measured and demoted, despite never timing out
+	slow := tester.downloader.peers.Peer("slow")
+	latency, samples := slow.Latency()
+	if samples <= slowPeerSamples {
+		t.Fatalf("slow peer measurements too few: have %d, want more than %d", samples, slowPeerSamples)
+	}
+	if latency < 25*time.Millisecond {
+		t.Errorf("slow peer latency mismatch: have %v, want at least %v", latency, 25*time.Millisecond)
+	}
+	if rep := atomic.LoadInt32(&slow.rep); rep > 1 {
+		t.Errorf("slow peer not demoted: reputation %d", rep)
+	}
+	for _, id := range []string{"fast-1", "fast-2", "fast-3"} {
+		if rep := atomic.LoadInt32(&tester.downloader.peers.Peer(id).rep); rep <= 1 {
+			t.Errorf("fast peer %s demoted: reputation %d", id, rep)
+		}
+	}
+}
+
+func TestCallbackCancel(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	// Cancel the sync (repeatedly) from within the first insertion
+	inserts := 0
+	tester.downloader.config.InsertPolicy = &InsertPolicy{Blocks: 1}
+	tester.downloader.config.InsertChain = func(blocks types.Blocks) (int, error) {
+		inserts++
+		tester.downloader.Cancel()
+		tester.downloader.Cancel()
+		return len(blocks), nil
+	}
+	if err := tester.sync("peer", hashes[0]); err != errCancelBlockFetch {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errCancelBlockFetch)
+	}
+	if inserts != 1 {
+		t.Fatalf("insertion count mismatch: have %d, want %d", inserts, 1)
+	}
+	if stats := tester.downloader.Resources(); stats != (ResourceStats{}) {
+		t.Fatalf("resources leaked after cancel: %+v", stats)
+	}
+	// Ensure the downloader is reusable after the cancellation
+	tester.downloader.config.InsertChain = nil
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+}
+
+func TestPeerScorePersistence(t *testing.T) {
+	// Build up some scoring for a peer and export it
+	source := newTester(t, nil, nil)
+	source.newPeer("peer", big.NewInt(10000), common.Hash{})
+
+	peer := source.downloader.peers.Peer("peer")
+	peer.rep, peer.latency, peer.samples = 7, 25*time.Millisecond, 10
+
+	blob, err := source.downloader.ExportPeerScores()
+	if err != nil {
+		t.Fatalf("failed to export peer scores: %v", err)
+	}
+	// Import the scores into a fresh downloader and ensure they're applied
+	target := newTester(t, nil, nil)
+	if err := target.downloader.ImportPeerScores(blob); err != nil {
+		t.Fatalf("failed to import peer scores: %v", err)
+	}
+	target.newPeer("peer", big.NewInt(10000), common.Hash{})
+
+	peer = target.downloader.peers.Peer("peer")
+	if latency, samples := peer.Latency(); peer.rep != 7 || latency != 25*time.Millisecond || samples != 10 {
+		t.Fatalf("imported score mismatch: rep %d, latency %v, samples %d", peer.rep, latency, samples)
+	}
+	// Ensure that stale scores are discarded on import
+	stale, _ := rlp.EncodeToBytes([]peerScore{{Id: "stale", Rep: 7, Updated: uint64(time.Now().Add(-2 * peerScoreTtl).Unix())}})
+
+	target = newTester(t, nil, nil)
+	if err := target.downloader.ImportPeerScores(stale); err != nil {
+		t.Fatalf("failed to import peer scores: %v", err)
+	}
+	target.newPeer("stale", big.NewInt(10000), common.Hash{})
+	if rep := target.downloader.peers.Peer("stale").rep; rep != 0 {
+		t.Fatalf("stale score applied: rep %d", rep)
+	}
+}
+
+func TestCorrelatedDelivery(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a peer answering each request with an empty stale one first
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "peer",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocksWithId: func(request uint64, hashes []common.Hash) error {
+			delivery := make([]*types.Block, len(hashes))
+			for i, hash := range hashes {
+				delivery[i] = blocks[hash]
+			}
+			go func() {
+				tester.downloader.DeliverBlocksWithId("peer", request+1, nil)
+				tester.downloader.DeliverBlocksWithId("peer", request, delivery)
+			}()
+			return nil
+		},
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+func TestBusyPeerConcurrency(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.MaxPeerRequests = 3
+
+	// Register a single slow peer, tracking its concurrent requests
+	var inflight, peak int32
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "peer",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocksWithId: func(request uint64, hashes []common.Hash) error {
+			delivery := make([]*types.Block, len(hashes))
+			for i, hash := range hashes {
+				delivery[i] = blocks[hash]
+			}
+			if active := atomic.AddInt32(&inflight, 1); active > atomic.LoadInt32(&peak) {
+				atomic.StoreInt32(&peak, active)
+			}
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				atomic.AddInt32(&inflight, -1)
+				tester.downloader.DeliverBlocksWithId("peer", request, delivery)
+			}()
+			return nil
+		},
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+	if peak := atomic.LoadInt32(&peak); peak < 2 || peak > 3 {
+		t.Fatalf("concurrent request mismatch: have %d, want 2-3", peak)
+	}
+}
+
+func TestCacheAllocLimit(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.MaxCacheAlloc = targetBlocks / 2
+	tester.downloader.queue.allocLimit = targetBlocks / 2
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	if err := tester.sync("peer", hashes[0]); err != errAllocLimit {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errAllocLimit)
+	}
+	if alloc := tester.downloader.CacheAllocation(); alloc != 0 {
+		t.Fatalf("refused allocation performed: %v blocks", alloc)
+	}
+	if limit := tester.downloader.Config().BlockCacheLimit; limit != targetBlocks/2 {
+		t.Fatalf("cache limit mismatch: have %v, want %v", limit, targetBlocks/2)
+	}
+}
+
+func TestSalvagePartial(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, salvage := range []bool{false, true} {
+		tester := newTester(t, hashes, blocks)
+		tester.downloader.config.SalvagePartial = salvage
+
+		// Register a peer serving only the older half of the chain
+		getBlocks := tester.getBlocks("peer")
+		tester.downloader.RegisterPeerConfig(PeerConfig{
+			Id:        "peer",
+			Head:      hashes[0],
+			GetHashes: tester.getHashes,
+			GetBlocks: func(request []common.Hash) error {
+				served := make([]common.Hash, 0, len(request))
+				for _, hash := range request {
+					if blocks[hash].NumberU64() <= uint64(targetBlocks/2+1) {
+						served = append(served, hash)
+					}
+				}
+				return getBlocks(served)
+			},
+		})
+		if err := tester.sync("peer", hashes[0]); err == nil {
+			t.Fatalf("salvage %v: synchronisation succeeded with missing blocks", salvage)
+		}
+		// Start a new sync, which discards anything not salvaged
+		tester.newPeer("other", big.NewInt(10000), hashes[0])
+		err := tester.sync("other", hashes[0])
+
+		if !salvage {
+			if err != nil {
+				t.Fatalf("salvage %v: failed to restart synchronisation: %v", salvage, err)
+			}
+			continue
+		}
+		if err != ErrPendingQueue {
+			t.Fatalf("salvage %v: restart error mismatch: have %v, want %v", salvage, err, ErrPendingQueue)
+		}
+		if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks/2 {
+			t.Fatalf("salvage %v: salvaged block mismatch: have %v, want %v", salvage, len(took), targetBlocks/2)
+		}
+		if result := tester.downloader.LastSync(); result.Salvaged != targetBlocks/2 {
+			t.Fatalf("salvage %v: salvage report mismatch: have %v, want %v", salvage, result.Salvaged, targetBlocks/2)
+		}
+	}
+}
+
+func TestPeerHealthRanking(t *testing.T) {
+	// Create a fast but unreliable peer, a slow but reliable one, and a fresh one
+	fast := newPeer("fast", common.Hash{}, nil, nil)
+	fast.latency, fast.throughput, fast.samples, fast.failures = 50*time.Millisecond, 1000, 4, 12
+
+	slow := newPeer("slow", common.Hash{}, nil, nil)
+	slow.latency, slow.throughput, slow.samples = 2*time.Second, 50, 8
+
+	fresh := newPeer("fresh", common.Hash{}, nil, nil)
+
+	// Rank the peers with various weights, and check the orderings
+	tests := []struct {
+		weights HealthWeights
+		order   []string
+	}{
+		{HealthWeights{Latency: 1}, []string{"fast", "fresh", "slow"}},
+		{HealthWeights{Throughput: 1}, []string{"fast", "fresh", "slow"}},
+		{HealthWeights{Failures: 1}, []string{"slow", "fresh", "fast"}},
+		{DefaultHealthWeights, []string{"fresh", "slow", "fast"}},
+	}
+	for i, tt := range tests {
+		peers := []*peer{slow, fresh, fast}
+		sortByHealth(peers, tt.weights)
+		for j, peer := range peers {
+			if peer.id != tt.order[j] {
+				t.Errorf("test %d: rank %d mismatch: have %s, want %s", i, j, peer.id, tt.order[j])
+			}
+		}
+		for _, peer := range peers {
+			if health := peer.Health(tt.weights); health < 0 || health > 1 {
+				t.Errorf("test %d: peer %s health out of bounds: %v", i, peer.id, health)
+			}
+		}
+	}
+	// Timeouts should degrade the health too
+	before := slow.Health(DefaultHealthWeights)
+	slow.MarkTimeout()
+	if after := slow.Health(DefaultHealthWeights); after >= before {
+		t.Errorf("timeout didn't degrade health: before %v, after %v", before, after)
+	}
+}
+
+func TestDiscoveryExtension(t *testing.T) {
+	targetBlocks, extraBlocks := 100, 50
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Create a chain segment extending the original one
+	extension := make([]common.Hash, extraBlocks)
+	for i := range extension {
+		binary.BigEndian.PutUint64(extension[i][8:16], uint64(i+1))
+		blocks[extension[i]] = createBlock(targetBlocks+1+extraBlocks-i, knownHash, extension[i])
+	}
+	tester := newTester(t, hashes, blocks)
+	tester.hashChunk = 10
+	tester.downloader.config.ExtendDiscovery = true
+	tester.downloader.config.MaxHeadAdvances = 1
+
+	// Advance the head after the first hash request, counting the stale head requests
+	stale := 0
+	tester.downloader.RegisterPeer("peer", hashes[0], func(from common.Hash) error {
+		if from == hashes[0] {
+			stale++
+		}
+		if stale == 1 && len(tester.hashes) == len(hashes) {
+			tester.hashes = append(extension, hashes...)
+			if err := tester.downloader.Preempt(extension[0]); err != nil {
+				t.Errorf("failed to advance head: %v", err)
+			}
+			if err := tester.downloader.Preempt(extension[0]); err != errHeadAdvanceLimit {
+				t.Errorf("head advance error mismatch: have %v, want %v", err, errHeadAdvanceLimit)
+			}
+		}
+		return tester.getHashes(from)
+	}, tester.getBlocks("peer"))
+
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if stale != 1 {
+		t.Fatalf("stale head discovery restarted: %d requests", stale)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks+extraBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks+extraBlocks)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, fail := range []bool{false, true} {
+		tester := newTester(t, hashes, blocks)
+		tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+		if _, err := tester.downloader.Flush(); err != errNoInserter {
+			t.Fatalf("fail %v: flush error mismatch: have %v, want %v", fail, err, errNoInserter)
+		}
+		// Download the blocks without inserting them, and flush them afterwards
+		if err := tester.sync("peer", hashes[0]); err != nil {
+			t.Fatalf("fail %v: failed to synchronise blocks: %v", fail, err)
+		}
+		tester.downloader.config.InsertChain = func(blocks types.Blocks) (int, error) {
+			if fail {
+				return 10, errors.New("invalid block")
+			}
+			return 0, nil
+		}
+		rep := atomic.LoadInt32(&tester.downloader.peers.Peer("peer").rep)
+
+		flushed, err := tester.downloader.Flush()
+		if fail {
+			if err == nil || flushed != 10 {
+				t.Fatalf("fail %v: flush result mismatch: have %d/%v, want %d/failure", fail, flushed, err, 10)
+			}
+			if have := atomic.LoadInt32(&tester.downloader.peers.Peer("peer").rep); have >= rep {
+				t.Fatalf("fail %v: delivering peer not demoted: rep %d -> %d", fail, rep, have)
+			}
+			continue
+		}
+		if err != nil || flushed != targetBlocks {
+			t.Fatalf("fail %v: flush result mismatch: have %d/%v, want %d/nil", fail, flushed, err, targetBlocks)
+		}
+		if took := tester.downloader.TakeBlocks(); len(took) != 0 {
+			t.Fatalf("fail %v: blocks left after flush: %d", fail, len(took))
+		}
+	}
+}
+
+// Tests that a flush excludes new syncs while inserting the blocks, without
+// pretending a sync to be running and accepting deliveries nothing consumes.
+func TestFlushExcludesSync(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	var active bool
+	var hashErr, blockErr, syncErr error
+	tester.downloader.config.InsertChain = func(types.Blocks) (int, error) {
+		active = tester.downloader.Synchronising()
+		hashErr = tester.downloader.DeliverHashes("peer", hashes[:1])
+		blockErr = tester.downloader.DeliverBlocks("peer", nil)
+		syncErr = tester.downloader.Synchronise("peer", hashes[0])
+		return 0, nil
+	}
+	if _, err := tester.downloader.Flush(); err != nil {
+		t.Fatalf("failed to flush blocks: %v", err)
+	}
+	if active {
+		t.Fatalf("sync reported active during flush")
+	}
+	if hashErr != errNoSyncActive || blockErr != errNoSyncActive {
+		t.Fatalf("delivery error mismatch: have %v/%v, want %v", hashErr, blockErr, errNoSyncActive)
+	}
+	if syncErr != ErrBusy {
+		t.Fatalf("sync error mismatch: have %v, want %v", syncErr, ErrBusy)
+	}
+	// Ensure syncs are admitted again once the flush is done
+	tester.downloader.config.InsertChain = nil
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks after flush: %v", err)
+	}
+}
+
+func TestRepeatedDelivery(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	reps := make(map[int]int32)
+	for _, echoes := range []int{0, 5} {
+		tester := newTester(t, hashes, blocks)
+
+		// Register a peer echoing every delivered chunk a number of times
+		tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+			delivery := make([]*types.Block, len(request))
+			for i, hash := range request {
+				delivery[i] = blocks[hash]
+			}
+			go func() {
+				for i := 0; i <= echoes; i++ {
+					tester.downloader.DeliverBlocks("peer", delivery)
+				}
+			}()
+			return nil
+		})
+		if err := tester.sync("peer", hashes[0]); err != nil {
+			t.Fatalf("echoes %d: failed to synchronise blocks: %v", echoes, err)
+		}
+		if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+			t.Fatalf("echoes %d: downloaded block mismatch: have %v, want %v", echoes, len(took), targetBlocks)
+		}
+		reps[echoes] = atomic.LoadInt32(&tester.downloader.peers.Peer("peer").rep)
+	}
+	if reps[5] >= reps[0]/2 {
+		t.Fatalf("echoing peer not demoted: rep %d, well behaving %d", reps[5], reps[0])
+	}
+}
+
+func TestReplacePeers(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a peer never delivering blocks, swapping it out once requested
+	replaced := make(chan error, 1)
+	tester.downloader.RegisterPeer("stuck", hashes[0], tester.getHashes, func([]common.Hash) error {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			replaced <- tester.downloader.ReplacePeers([]PeerConfig{{
+				Id:        "fresh",
+				Head:      hashes[0],
+				GetHashes: tester.getHashes,
+				GetBlocks: tester.getBlocks("fresh"),
+			}})
+		}()
+		return nil
+	})
+	start := time.Now()
+	if err := tester.sync("stuck", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if err := <-replaced; err != nil {
+		t.Fatalf("failed to replace peers: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > blockTtl/2 {
+		t.Fatalf("revoked reservation waited for expiry: %v", elapsed)
+	}
+	if tester.downloader.peers.Len() != 1 || tester.downloader.peers.Peer("fresh") == nil {
+		t.Fatalf("peer set not replaced")
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+	// Invalid replacements should leave the set untouched
+	duplicate := PeerConfig{Id: "a", GetHashes: tester.getHashes, GetBlocks: tester.getBlocks("a")}
+	if err := tester.downloader.ReplacePeers([]PeerConfig{duplicate, duplicate}); err != errAlreadyRegistered {
+		t.Fatalf("duplicate replacement error mismatch: have %v, want %v", err, errAlreadyRegistered)
+	}
+	if tester.downloader.peers.Peer("fresh") == nil {
+		t.Fatalf("peer set modified by failed replacement")
+	}
+}
+
+func TestInitialBlockBurst(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Measure the delay between the end of the hash discovery and the first block request
+	var discovered, requested time.Time
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], func(from common.Hash) error {
+		discovered = time.Now()
+		return tester.getHashes(from)
+	}, func(request []common.Hash) error {
+		if requested.IsZero() {
+			requested = time.Now()
+		}
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if delay := requested.Sub(discovered); delay >= 10*time.Millisecond {
+		t.Fatalf("initial block requests delayed by %v", delay)
+	}
+}
+
+// progressWriter is a thread safe writer collecting streamed progress reports,
+// optionally stalling on every write.
+type progressWriter struct {
+	data   bytes.Buffer
+	stall  chan struct{}
+	closed chan struct{}
+	lock   sync.Mutex
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	if w.stall != nil {
+		<-w.stall
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.data.Write(p)
+}
+
+func (w *progressWriter) Close() error {
+	close(w.closed)
+	return nil
+}
+
+func TestStreamProgress(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, stall := range []bool{false, true} {
+		tester := newTester(t, hashes, blocks)
+
+		// Start streaming the progress once the sync is running
+		writer := &progressWriter{closed: make(chan struct{})}
+		if stall {
+			writer.stall = make(chan struct{})
+		}
+		streaming := false
+		tester.downloader.RegisterPeer("peer", hashes[0], func(from common.Hash) error {
+			if !streaming {
+				streaming = true
+				if err := tester.downloader.StreamProgress(writer, time.Millisecond); err != nil {
+					t.Errorf("stall %v: failed to stream progress: %v", stall, err)
+				}
+			}
+			return tester.getHashes(from)
+		}, tester.getBlocks("peer"))
+
+		// Synchronise, making sure a stalled writer doesn't block the sync
+		if err := tester.sync("peer", hashes[0]); err != nil {
+			t.Fatalf("stall %v: failed to synchronise blocks: %v", stall, err)
+		}
+		if stall {
+			close(writer.stall)
+		}
+		select {
+		case <-writer.closed:
+		case <-time.After(time.Second):
+			t.Fatalf("stall %v: progress stream not closed", stall)
+		}
+		// Make sure the streaming goroutines and ticker are all released
+		for start := time.Now(); tester.downloader.Resources() != (ResourceStats{}); time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("stall %v: resources leaked after stream: %+v", stall, tester.downloader.Resources())
+			}
+		}
+		// Check that the final report reflects the terminated sync
+		var last Progress
+		for dec := json.NewDecoder(&writer.data); dec.More(); {
+			if err := dec.Decode(&last); err != nil {
+				t.Fatalf("stall %v: failed to decode progress: %v", stall, err)
+			}
+		}
+		if last.Active || last.Peer != "peer" || last.Pending != 0 || last.Cached != targetBlocks {
+			t.Fatalf("stall %v: final progress mismatch: %+v", stall, last)
+		}
+	}
+}
+
+func TestUnknownPeerDeliveries(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, strict := range []bool{false, true} {
+		tester := newTester(t, hashes, blocks)
+		if strict {
+			tester.downloader.config.MaxUnknownDeliveries = 5
+		}
+		var unknown int32
+		tester.downloader.config.OnUnknownDelivery = func(id string) {
+			if id == "ghost" {
+				atomic.AddInt32(&unknown, 1)
+			}
+		}
+		// Register a peer accompanying its first delivery with a burst of spoofed ones
+		spoofed := false
+		getBlocks := tester.getBlocks("peer")
+		tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+			if !spoofed {
+				spoofed = true
+				go func() {
+					for i := 0; i < 10; i++ {
+						tester.downloader.DeliverBlocks("ghost", nil)
+					}
+				}()
+			}
+			return getBlocks(request)
+		})
+		err := tester.sync("peer", hashes[0])
+		if strict {
+			if err != errUnknownDeliveries {
+				t.Fatalf("strict %v: synchronisation error mismatch: have %v, want %v", strict, err, errUnknownDeliveries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("strict %v: failed to synchronise blocks: %v", strict, err)
+		}
+		if n := atomic.LoadInt32(&unknown); n != 10 {
+			t.Fatalf("strict %v: unknown delivery reports mismatch: have %d, want %d", strict, n, 10)
+		}
+	}
+}
+
+func TestPhaseChanges(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	tester := newTester(t, hashes, blocks)
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	var (
+		phases  []SyncPhase
+		pending []int
+	)
+	tester.downloader.config.OnPhaseChange = func(phase SyncPhase, count int) {
+		phases = append(phases, phase)
+		pending = append(pending, count)
+	}
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	want := []SyncPhase{PhaseHashes, PhaseBlocks, PhaseComplete}
+	if len(phases) != len(want) {
+		t.Fatalf("phase count mismatch: have %v, want %v", phases, want)
+	}
+	for i, phase := range want {
+		if phases[i] != phase {
+			t.Errorf("phase %d mismatch: have %v, want %v", i, phases[i], phase)
+		}
+	}
+	if pending[1] != targetBlocks {
+		t.Errorf("pending hashes mismatch at block phase: have %d, want %d", pending[1], targetBlocks)
+	}
+	if pending[2] != 0 {
+		t.Errorf("pending hashes mismatch at completion: have %d, want %d", pending[2], 0)
+	}
+}
+
+func TestDescendingBlockFetch(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.DescendingFetch = true
+	tester.downloader.queue.descending = true
+
+	// Register a peer tracking the first requested blocks
+	var first []common.Hash
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		if first == nil {
+			first = request
+		}
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	// Ensure the newest blocks were requested first
+	requested := make(map[common.Hash]bool)
+	for _, hash := range first {
+		requested[hash] = true
+	}
+	if !requested[hashes[0]] || len(first) != maxBlockFetch || !requested[hashes[maxBlockFetch-1]] {
+		t.Fatalf("newest blocks not requested first")
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("taken block count mismatch: have %d, want %d", len(took), targetBlocks)
+	}
+}
+
+func TestInvalidPeerFetcher(t *testing.T) {
+	tester := newTester(t, nil, nil)
+
+	if err := tester.downloader.RegisterPeer("peer", common.Hash{}, nil, tester.getBlocks("peer")); err != errInvalidPeerFetcher {
+		t.Fatalf("nil hash fetcher error mismatch: have %v, want %v", err, errInvalidPeerFetcher)
+	}
+	if err := tester.downloader.RegisterPeer("peer", common.Hash{}, tester.getHashes, nil); err != errInvalidPeerFetcher {
+		t.Fatalf("nil block fetcher error mismatch: have %v, want %v", err, errInvalidPeerFetcher)
+	}
+	if peer := tester.downloader.peers.Peer("peer"); peer != nil {
+		t.Fatalf("invalid peer registered")
+	}
+	// A correlating block fetcher in itself is enough
+	config := PeerConfig{
+		Id:        "peer",
+		GetHashes: tester.getHashes,
+		GetBlocksWithId: func(uint64, []common.Hash) error {
+			return nil
+		},
+	}
+	if err := tester.downloader.RegisterPeerConfig(config); err != nil {
+		t.Fatalf("failed to register correlating peer: %v", err)
+	}
+}
+
+func TestPeerCap(t *testing.T) {
+	for _, evict := range []bool{false, true} {
+		tester := newTester(t, nil, nil)
+		tester.downloader.config.MaxPeers = 3
+		tester.downloader.config.EvictPeers = evict
+
+		var dropped []string
+		tester.downloader.config.OnPeerDrop = func(id string) { dropped = append(dropped, id) }
+
+		// Fill up the peer set, and rank the peers by reputation
+		for i := 0; i < 3; i++ {
+			id := fmt.Sprintf("peer%d", i)
+			if err := tester.downloader.RegisterPeer(id, common.Hash{}, tester.getHashes, tester.getBlocks(id)); err != nil {
+				t.Fatalf("evict %v: failed to register peer %s: %v", evict, id, err)
+			}
+		}
+		tester.downloader.peers.Peer("peer0").Promote()
+		tester.downloader.peers.Peer("peer2").Promote()
+
+		// Register one more and check that it's either rejected or evicts the worst
+		err := tester.downloader.RegisterPeer("extra", common.Hash{}, tester.getHashes, tester.getBlocks("extra"))
+		if !evict {
+			if err != errTooManyPeers {
+				t.Fatalf("evict %v: registration error mismatch: have %v, want %v", evict, err, errTooManyPeers)
+			}
+			if tester.downloader.peers.Peer("extra") != nil || len(dropped) != 0 {
+				t.Fatalf("evict %v: rejected peer registered", evict)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("evict %v: failed to register peer: %v", evict, err)
+		}
+		if tester.downloader.peers.Len() != 3 || tester.downloader.peers.Peer("extra") == nil {
+			t.Fatalf("evict %v: peer set mismatch", evict)
+		}
+		if tester.downloader.peers.Peer("peer1") != nil || len(dropped) != 1 || dropped[0] != "peer1" {
+			t.Fatalf("evict %v: evicted peers mismatch: have %v, want %v", evict, dropped, []string{"peer1"})
+		}
+	}
+}
+
+func TestDuplicateDeliveryCount(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, echo := range []bool{false, true} {
+		tester := newTester(t, hashes, blocks)
+
+		// Register a peer optionally echoing every delivered chunk once
+		tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+			delivery := make([]*types.Block, len(request))
+			for i, hash := range request {
+				delivery[i] = blocks[hash]
+			}
+			go func() {
+				tester.downloader.DeliverBlocks("peer", delivery)
+				if echo {
+					tester.downloader.DeliverBlocks("peer", delivery)
+				}
+			}()
+			return nil
+		})
+		if err := tester.sync("peer", hashes[0]); err != nil {
+			t.Fatalf("echo %v: failed to synchronise blocks: %v", echo, err)
+		}
+		// The echo of the last chunk may arrive after the sync finished
+		duplicates := tester.downloader.LastSync().Duplicates
+		if !echo && duplicates != 0 {
+			t.Fatalf("echo %v: duplicate count mismatch: have %d, want %d", echo, duplicates, 0)
+		}
+		if echo && (duplicates < targetBlocks-maxBlockFetch || duplicates > targetBlocks) {
+			t.Fatalf("echo %v: duplicate count mismatch: have %d, want [%d, %d]", echo, duplicates, targetBlocks-maxBlockFetch, targetBlocks)
+		}
+	}
+}
+
+func TestSynchroniseWithSubset(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a few peers, tracking which ones are requested blocks from
+	var lock sync.Mutex
+	requested := make(map[string]int)
+	for _, id := range []string{"a", "b", "c"} {
+		id, getBlocks := id, tester.getBlocks(id)
+		tester.downloader.RegisterPeer(id, hashes[0], tester.getHashes, func(request []common.Hash) error {
+			lock.Lock()
+			requested[id] += len(request)
+			lock.Unlock()
+			return getBlocks(request)
+		})
+	}
+	// Ensure a subset without registered peers is rejected
+	if err := tester.downloader.SynchroniseWith([]string{"x", "y"}, hashes[0]); err != errNoSubsetPeers {
+		t.Fatalf("unknown subset error mismatch: have %v, want %v", err, errNoSubsetPeers)
+	}
+	// Synchronise with a subset and ensure no other peer is used
+	tester.activePeerId = "b"
+	if err := tester.downloader.SynchroniseWith([]string{"x", "b"}, hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if len(requested) != 1 || requested["b"] != targetBlocks {
+		t.Fatalf("block requests mismatch: have %v, want %v", requested, map[string]int{"b": targetBlocks})
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+	// Ensure the restriction is lifted after the sync
+	if peers := tester.downloader.peers.AllPeers(); len(peers) != 3 {
+		t.Fatalf("peer restriction not lifted: %d peers listed", len(peers))
+	}
+}
+
+// Tests that the peer availability checks of a subset sync only consider the
+// peers of the subset, not all the registered ones.
+func TestSynchroniseWithSubsetPeers(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Ensure the subset sync fails once all of its peers are gone, even if others remain
+	tester := newTester(t, hashes, blocks)
+	tester.newPeer("outsider", big.NewInt(10000), hashes[0])
+	tester.downloader.RegisterPeer("member", hashes[0], tester.getHashes, func([]common.Hash) error {
+		go tester.downloader.UnregisterPeer("member")
+		return nil
+	})
+	tester.activePeerId = "member"
+	if err := tester.downloader.SynchroniseWith([]string{"member"}, hashes[0]); err != errNoPeers {
+		t.Fatalf("dropped subset error mismatch: have %v, want %v", err, errNoPeers)
+	}
+	// Ensure the unavailability report only counts the peers of the subset
+	tester = newTester(t, hashes, blocks)
+	tester.newPeer("outsider", big.NewInt(10000), hashes[0])
+	tester.downloader.RegisterPeer("member", hashes[0], tester.getHashes, func([]common.Hash) error {
+		go tester.downloader.DeliverBlocks("member", []*types.Block{})
+		return nil
+	})
+	tester.activePeerId = "member"
+
+	var unavailable *PeersUnavailableError
+	if err := tester.downloader.SynchroniseWith([]string{"member"}, hashes[0]); !errors.As(err, &unavailable) {
+		t.Fatalf("unavailable subset error mismatch: have %v, want %v", err, errPeersUnavailable)
+	}
+	if unavailable.Total != 1 {
+		t.Fatalf("reported peer count mismatch: have %d, want %d", unavailable.Total, 1)
+	}
+}
+
+func TestConcurrentCancel(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a peer cancelling the sync concurrently upon the first block request
+	var (
+		pend      sync.WaitGroup
+		cancelled int32
+		once      sync.Once
+	)
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		once.Do(func() {
+			for i := 0; i < 8; i++ {
+				pend.Add(1)
+				go func() {
+					defer pend.Done()
+					if tester.downloader.Cancel() {
+						atomic.AddInt32(&cancelled, 1)
+					}
+				}()
+			}
+			pend.Wait()
+		})
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != errCancelBlockFetch {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, errCancelBlockFetch)
+	}
+	if cancelled != 1 {
+		t.Fatalf("successful cancel count mismatch: have %d, want %d", cancelled, 1)
+	}
+	if tester.downloader.Cancel() {
+		t.Fatalf("repeated cancel succeeded")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Without peers the downloader is unhealthy
+	if healthy, reason := tester.downloader.Healthy(); healthy || reason == "" {
+		t.Fatalf("peerless downloader healthy: %v, %q", healthy, reason)
+	}
+	// A successful sync is healthy
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	tester.downloader.TakeBlocks()
+	if healthy, reason := tester.downloader.Healthy(); !healthy {
+		t.Fatalf("synced downloader unhealthy: %s", reason)
+	}
+	// A failed sync is unhealthy
+	tester.downloader.config.TrafficBudget = 1
+	if err := tester.sync("peer", hashes[0]); err != errBudgetExceeded {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errBudgetExceeded)
+	}
+	if healthy, reason := tester.downloader.Healthy(); healthy || reason == "" {
+		t.Fatalf("failed downloader healthy: %v, %q", healthy, reason)
+	}
+	tester.downloader.config.TrafficBudget = 0
+
+	// A stuck sync is unhealthy, but a progressing one healthy
+	tester.downloader.config.StallTimeout = 100 * time.Millisecond
+	tester.downloader.RegisterPeer("stuck", hashes[0], tester.getHashes, func([]common.Hash) error { return nil })
+	tester.downloader.UnregisterPeer("peer")
+
+	errc := make(chan error, 1)
+	go func() { errc <- tester.sync("stuck", hashes[0]) }()
+
+	time.Sleep(50 * time.Millisecond)
+	if healthy, reason := tester.downloader.Healthy(); !healthy {
+		t.Fatalf("progressing downloader unhealthy: %s", reason)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if healthy, reason := tester.downloader.Healthy(); healthy || reason == "" {
+		t.Fatalf("stuck downloader healthy: %v, %q", healthy, reason)
+	}
+	tester.downloader.Cancel()
+	<-errc
+}
+
+func TestBlockSource(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Insert the blocks during the sync, checking their attribution upon insertion
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	unattributed := 0
+	tester.downloader.config.InsertChain = func(blocks types.Blocks) (int, error) {
+		for _, block := range blocks {
+			if id, ok := tester.downloader.BlockSource(block.Hash()); !ok || id != "peer" {
+				unattributed++
+			}
+		}
+		return len(blocks), nil
+	}
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if unattributed != 0 {
+		t.Fatalf("unattributed blocks upon insertion: %d", unattributed)
+	}
+	// Ensure the attribution survives the insertion, but not the next sync
+	if id, ok := tester.downloader.BlockSource(hashes[0]); !ok || id != "peer" {
+		t.Fatalf("inserted block source mismatch: have %q/%v, want %q/%v", id, ok, "peer", true)
+	}
+	if id, ok := tester.downloader.BlockSource(common.Hash{}); ok || id != "" {
+		t.Fatalf("unknown block source mismatch: have %q/%v, want %q/%v", id, ok, "", false)
+	}
+	if err := tester.sync("unknown", hashes[0]); err != errUnknownPeer {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errUnknownPeer)
+	}
+	if id, ok := tester.downloader.BlockSource(hashes[0]); ok || id != "" {
+		t.Fatalf("stale block source mismatch: have %q/%v, want %q/%v", id, ok, "", false)
+	}
+}
+
+func TestMinFetchPeers(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, min := range []int{0, 2} {
+		tester := newTester(t, hashes, blocks)
+		tester.downloader.config.MinFetchPeers = min
+
+		// Register two peers, one of them dropping after its first block delivery
+		tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+		getBlocks := tester.getBlocks("leaving")
+		tester.downloader.RegisterPeer("leaving", hashes[0], tester.getHashes, func(request []common.Hash) error {
+			go tester.downloader.UnregisterPeer("leaving")
+			return getBlocks(request)
+		})
+		err := tester.sync("peer", hashes[0])
+		if min == 0 && err != nil {
+			t.Fatalf("min %d: failed to synchronise blocks: %v", min, err)
+		}
+		if min > 0 && err != errTooFewPeers {
+			t.Fatalf("min %d: synchronisation error mismatch: have %v, want %v", min, err, errTooFewPeers)
+		}
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Dump the downloader state concurrently while blocks are being fetched
+	dumps := make(chan []byte, 1)
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		blob, err := tester.downloader.DebugDump()
+		if err != nil {
+			t.Errorf("failed to dump running downloader: %v", err)
+		}
+		select {
+		case dumps <- blob:
+		default:
+		}
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	var running DebugState
+	if err := json.Unmarshal(<-dumps, &running); err != nil {
+		t.Fatalf("failed to decode running dump: %v", err)
+	}
+	if !running.Progress.Active || len(running.Reservations) != running.Progress.InFlight || len(running.Gaps) == 0 {
+		t.Fatalf("running dump mismatch: %+v", running)
+	}
+	// Dump the terminated sync and check that it reflects the final state
+	blob, err := tester.downloader.DebugDump()
+	if err != nil {
+		t.Fatalf("failed to dump downloader: %v", err)
+	}
+	var final DebugState
+	if err := json.Unmarshal(blob, &final); err != nil {
+		t.Fatalf("failed to decode final dump: %v", err)
+	}
+	if final.Progress.Active || final.Progress.Cached != targetBlocks || len(final.Gaps) != 0 || len(final.Reservations) != 0 {
+		t.Fatalf("final dump mismatch: %+v", final)
+	}
+	if len(final.Peers) != 1 || final.Peers[0].Id != "peer" || final.Peers[0].Samples == 0 {
+		t.Fatalf("peer report mismatch: %+v", final.Peers)
+	}
+	if final.Config.MaxBlockFetch != maxBlockFetch || final.Metrics.Allocated == 0 || final.LastError != "" {
+		t.Fatalf("config or metrics mismatch: %+v, %+v", final.Config, final.Metrics)
+	}
+	// A failed sync reports its error
+	tester.downloader.TakeBlocks()
+	tester.downloader.config.TrafficBudget = 1
+	if err := tester.sync("peer", hashes[0]); err != errBudgetExceeded {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errBudgetExceeded)
+	}
+	if blob, err = tester.downloader.DebugDump(); err != nil {
+		t.Fatalf("failed to dump failed downloader: %v", err)
+	}
+	if err := json.Unmarshal(blob, &final); err != nil {
+		t.Fatalf("failed to decode failed dump: %v", err)
+	}
+	if final.LastError != errBudgetExceeded.Error() {
+		t.Fatalf("last error mismatch: have %q, want %q", final.LastError, errBudgetExceeded)
+	}
+}
+
+func TestHashTimeout(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, timeout := range []time.Duration{100 * time.Millisecond, 300 * time.Millisecond} {
+		tester := newTester(t, hashes, blocks)
+		tester.hashChunk = 100
+		tester.downloader.config.HashTimeout = timeout
+
+		if ttl := tester.downloader.Config().HashTtl; ttl != timeout {
+			t.Fatalf("timeout %v: reported hash ttl mismatch: have %v", timeout, ttl)
+		}
+		// Register a peer going silent after the first batch of hashes, and a backup
+		// one, timing when the discovery switches over
+		var silenced, switched time.Time
+		requests := 0
+		tester.downloader.RegisterPeer("peer", hashes[0], func(hash common.Hash) error {
+			if requests++; requests == 1 {
+				return tester.getHashes(hash)
+			}
+			silenced = time.Now()
+			return nil
+		}, tester.getBlocks("peer"))
+
+		tester.downloader.RegisterPeer("backup", common.Hash{0xff}, func(hash common.Hash) error {
+			if switched.IsZero() {
+				switched = time.Now()
+			}
+			tester.activePeerId = "backup"
+			return tester.getHashes(hash)
+		}, tester.getBlocks("backup"))
+		tester.downloader.config.NextPeer = func(map[string]bool) string { return "backup" }
+
+		if err := tester.sync("peer", hashes[0]); err != nil {
+			t.Fatalf("timeout %v: failed to synchronise blocks: %v", timeout, err)
+		}
+		if elapsed := switched.Sub(silenced); elapsed < timeout || elapsed > timeout+time.Second {
+			t.Fatalf("timeout %v: peer switch time mismatch: have %v", timeout, elapsed)
+		}
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register two peers, reading the stats concurrently while delivering blocks
+	for _, id := range []string{"peer-1", "peer-2"} {
+		getBlocks := tester.getBlocks(id)
+		tester.downloader.RegisterPeer(id, hashes[0], tester.getHashes, func(request []common.Hash) error {
+			tester.downloader.PeerStats()
+			return getBlocks(request)
+		})
+	}
+	if err := tester.sync("peer-1", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	// Check that all delivered blocks were accounted to the peers
+	stats := tester.downloader.PeerStats()
+	if len(stats) != 2 {
+		t.Fatalf("peer stat count mismatch: have %d, want %d", len(stats), 2)
+	}
+	total := 0
+	for id, stat := range stats {
+		if stat.Blocks > 0 && (stat.Deliveries == 0 || stat.InFlight <= 0 || stat.Throughput <= 0) {
+			t.Fatalf("peer %s: inconsistent stats: %+v", id, stat)
+		}
+		total += stat.Blocks
+	}
+	if total != targetBlocks {
+		t.Fatalf("delivered block count mismatch: have %d, want %d", total, targetBlocks)
+	}
+	// Check that unregistered peers are not reported any more
+	tester.downloader.UnregisterPeer("peer-2")
+	if stats := tester.downloader.PeerStats(); len(stats) != 1 {
+		t.Fatalf("peer stats mismatch after drop: %v", stats)
+	}
+}
+
+func TestSynchroniseContext(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Cancel the context once the block download is running
+	ctx, cancel := context.WithCancel(context.Background())
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		cancel()
+		return getBlocks(request)
+	})
+	tester.activePeerId = "peer"
+	if err := tester.downloader.SynchroniseContext(ctx, "peer", hashes[0]); err != context.Canceled {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, context.Canceled)
+	}
+	if pending, cached := tester.downloader.queue.Size(); pending != 0 || cached != 0 {
+		t.Fatalf("queue not reset: %d pending, %d cached", pending, cached)
+	}
+	if stats := tester.downloader.Resources(); stats != (ResourceStats{}) {
+		t.Fatalf("resources leaked: %+v", stats)
+	}
+	// Time out the context while the hash discovery waits for a silent peer
+	tester.downloader.RegisterPeer("silent", hashes[0], func(common.Hash) error { return nil }, tester.getBlocks("silent"))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tester.downloader.SynchroniseContext(ctx, "silent", hashes[0]); err != context.DeadlineExceeded {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+	}
+	// A sync with a live context completes normally
+	if err := tester.downloader.SynchroniseContext(context.Background(), "peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+func TestProgressCallback(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.hashChunk = 100
+
+	// Slow down the block deliveries, forcing multiple progress reports
+	type report struct {
+		pulled, pending, cached int
+		time                    time.Time
+	}
+	var reports []report
+	tester.downloader.config.OnProgress = func(pulled, pending, cached int) {
+		reports = append(reports, report{pulled, pending, cached, time.Now()})
+	}
+	tester.downloader.config.InsertChain = func(blocks types.Blocks) (int, error) { return len(blocks), nil }
+
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		time.Sleep(20 * time.Millisecond)
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if len(reports) < 2 {
+		t.Fatalf("too few progress reports: %d", len(reports))
+	}
+	for i, report := range reports {
+		if report.pulled+report.pending+report.cached > targetBlocks {
+			t.Fatalf("report %d: block counts exceed total: %+v", i, report)
+		}
+		if i > 0 {
+			if gap := report.time.Sub(reports[i-1].time); gap < progressInterval {
+				t.Fatalf("report %d: reported too frequently: %v", i, gap)
+			}
+			if report.pulled < reports[i-1].pulled {
+				t.Fatalf("report %d: pulled count decreased: %d < %d", i, report.pulled, reports[i-1].pulled)
+			}
+		}
+	}
+	if last := reports[len(reports)-1]; last.pulled == 0 {
+		t.Fatalf("taken blocks not reported: %+v", last)
+	}
+}
+
+func TestPeersUnavailableError(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a peer not having any of the blocks it advertises
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func([]common.Hash) error {
+		go tester.downloader.DeliverBlocks("peer", nil)
+		return nil
+	})
+	err := tester.sync("peer", hashes[0])
+	if !errors.Is(err, errPeersUnavailable) {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errPeersUnavailable)
+	}
+	var failure *PeersUnavailableError
+	if !errors.As(err, &failure) {
+		t.Fatalf("synchronisation error type mismatch: have %T, want %T", err, failure)
+	}
+	if failure.Total != 1 || failure.HashesNeeded != targetBlocks {
+		t.Fatalf("failure details mismatch: have %+v, want %d total peers, %d hashes", failure, 1, targetBlocks)
+	}
+}
+
+func TestParallelHashFetch(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, parallel := range []bool{false, true} {
+		tester := newTester(t, hashes, blocks)
+		tester.downloader.config.ParallelHashFetch = parallel
+
+		// Create a hash fetcher delivering chunks asynchronously, counting the requests
+		var lock sync.Mutex
+		requests := make(map[string]int)
+		getHashes := func(id string) func(common.Hash) error {
+			return func(from common.Hash) error {
+				lock.Lock()
+				requests[id]++
+				lock.Unlock()
+
+				delivery := []common.Hash{}
+				for i, hash := range hashes {
+					if hash == from {
+						delivery = hashes[i+1:]
+						break
+					}
+				}
+				if len(delivery) > 100 {
+					delivery = delivery[:100]
+				}
+				go tester.downloader.DeliverHashes(id, delivery)
+				return nil
+			}
+		}
+		// Register the origin peer, a couple advertising older heads, and one on a fork
+		tester.downloader.RegisterPeer("peer", hashes[0], getHashes("peer"), tester.getBlocks("peer"))
+		tester.downloader.RegisterPeer("mid-1", hashes[300], getHashes("mid-1"), tester.getBlocks("mid-1"))
+		tester.downloader.RegisterPeer("mid-2", hashes[600], getHashes("mid-2"), tester.getBlocks("mid-2"))
+		tester.downloader.RegisterPeer("fork", common.Hash{0xff}, getHashes("fork"), tester.getBlocks("fork"))
+
+		if err := tester.sync("peer", hashes[0]); err != nil {
+			t.Fatalf("parallel %v: failed to synchronise blocks: %v", parallel, err)
+		}
+		if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+			t.Fatalf("parallel %v: downloaded block mismatch: have %v, want %v", parallel, len(took), targetBlocks)
+		}
+		// Check that the origin peer only served its own section in parallel mode
+		lock.Lock()
+		origin, segment := requests["peer"], requests["mid-1"]
+		lock.Unlock()
+
+		if !parallel && (origin != 10 || segment != 0) {
+			t.Fatalf("serial discovery request mismatch: origin %d, segment %d", origin, segment)
+		}
+		if parallel && (origin != 3 || segment == 0) {
+			t.Fatalf("parallel discovery request mismatch: origin %d, segment %d", origin, segment)
+		}
+	}
+}
+
+func TestProgressBlockNumbers(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Check the block numbers reported while the blocks are being retrieved
+	var running Progress
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		if !running.Active {
+			running = tester.downloader.Progress()
+		}
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if running.StartingBlock != 1 || running.CurrentBlock != 1 || running.HighestBlock != uint64(targetBlocks+1) {
+		t.Fatalf("running progress mismatch: have %d/%d/%d, want %d/%d/%d", running.StartingBlock, running.CurrentBlock, running.HighestBlock, 1, 1, targetBlocks+1)
+	}
+	// Check that taking the blocks advances the current block
+	tester.downloader.TakeBlocks()
+
+	progress := tester.downloader.Progress()
+	if progress.StartingBlock != 1 || progress.CurrentBlock != uint64(targetBlocks+1) || progress.HighestBlock != uint64(targetBlocks+1) {
+		t.Fatalf("final progress mismatch: have %d/%d/%d, want %d/%d/%d", progress.StartingBlock, progress.CurrentBlock, progress.HighestBlock, 1, targetBlocks+1, targetBlocks+1)
+	}
+	blob, err := json.Marshal(progress)
+	if err != nil {
+		t.Fatalf("failed to encode progress: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		t.Fatalf("failed to decode progress: %v", err)
+	}
+	for _, field := range []string{"startingBlock", "currentBlock", "highestBlock"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("progress field %q missing from %s", field, blob)
+		}
+	}
+}
+
+func TestWaitForPeers(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.MinDesiredPeers = 2
+
+	if min := tester.downloader.Config().MinDesiredPeers; min != 2 {
+		t.Fatalf("reported desired peer count mismatch: have %d, want %d", min, 2)
+	}
+	// Waiting for more peers than registered times out
+	tester.newPeer("peer-1", big.NewInt(10000), hashes[0])
+	if err := tester.downloader.WaitForPeers(0, 50*time.Millisecond); err != errPeerWaitTimeout {
+		t.Fatalf("wait error mismatch: have %v, want %v", err, errPeerWaitTimeout)
+	}
+	// A peer registering while waiting releases the wait
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tester.newPeer("peer-2", big.NewInt(10000), hashes[0])
+	}()
+	if err := tester.downloader.WaitForPeers(0, time.Second); err != nil {
+		t.Fatalf("failed to wait for registering peer: %v", err)
+	}
+	// An explicit peer count overrides the configured one, returning right away if met
+	start := time.Now()
+	if err := tester.downloader.WaitForPeers(1, time.Second); err != nil {
+		t.Fatalf("failed to wait for registered peer: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("satisfied wait blocked for %v", elapsed)
+	}
+	if err := tester.downloader.WaitForPeers(3, 50*time.Millisecond); err != errPeerWaitTimeout {
+		t.Fatalf("wait error mismatch: have %v, want %v", err, errPeerWaitTimeout)
+	}
+}
+
+func TestIncompatibleChain(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.hashChunk = 100
+
+	genesis, fork := common.Hash{0x01}, common.Hash{0x02}
+	tester.downloader.config.Genesis = genesis
+	tester.downloader.config.HashTimeout = 50 * time.Millisecond
+
+	// Register a peer on our chain, one on a different chain, and a legacy one
+	register := func(id string, head, genesis common.Hash, getHashes hashFetcherFn, getBlocks blockFetcherFn) {
+		if err := tester.downloader.RegisterPeerConfig(PeerConfig{Id: id, Head: head, Genesis: genesis, GetHashes: getHashes, GetBlocks: getBlocks}); err != nil {
+			t.Fatalf("failed to register peer %s: %v", id, err)
+		}
+	}
+	register("peer", hashes[0], genesis, tester.getHashes, tester.getBlocks("peer"))
+	register("legacy", hashes[0], common.Hash{}, tester.getHashes, tester.getBlocks("legacy"))
+
+	var forkRequests int32
+	register("fork", hashes[50], fork, func(common.Hash) error {
+		atomic.AddInt32(&forkRequests, 1)
+		return nil
+	}, func([]common.Hash) error {
+		atomic.AddInt32(&forkRequests, 1)
+		return nil
+	})
+	// Syncing with the foreign peer is rejected outright
+	if err := tester.sync("fork", hashes[0]); err != errIncompatibleChain {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errIncompatibleChain)
+	}
+	// Syncing with a compatible peer never requests anything from the foreign one
+	for _, id := range []string{"peer", "legacy"} {
+		if err := tester.sync(id, hashes[0]); err != nil {
+			t.Fatalf("failed to synchronise blocks with %s: %v", id, err)
+		}
+		if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+			t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+		}
+	}
+	// A stalling hash discovery doesn't fail over to the foreign peer either
+	tester.downloader.UnregisterPeer("legacy")
+	requests := 0
+	tester.downloader.UnregisterPeer("peer")
+	register("peer", hashes[0], genesis, func(hash common.Hash) error {
+		if requests++; requests == 1 {
+			return tester.getHashes(hash)
+		}
+		return nil
+	}, tester.getBlocks("peer"))
+
+	if err := tester.sync("peer", hashes[0]); err != ErrTimeout {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, ErrTimeout)
+	}
+	if n := atomic.LoadInt32(&forkRequests); n != 0 {
+		t.Fatalf("foreign peer requested %d times", n)
+	}
+}
+
+func TestEmptyHashSwitches(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	tests := []struct {
+		switches int   // Configured peer switches after empty hash sets
+		result   error // Expected synchronisation result
+		asked    int   // Number of peers expected to be asked for hashes
+	}{
+		{0, nil, 3},              // Default allowance reaches the good peer
+		{1, errEmptyHashSet, 2},  // Single switch only reaches the second empty peer
+		{-1, errEmptyHashSet, 1}, // Disabled switching aborts right away
+	}
+	for i, tt := range tests {
+		tester := newTester(t, hashes, blocks)
+		tester.downloader.config.EmptyHashSwitches = tt.switches
+
+		// Register two peers responding with empty hash sets, and a good one
+		asked := make(map[string]bool)
+		for _, id := range []string{"peer", "empty"} {
+			id := id
+			tester.downloader.RegisterPeer(id, hashes[0], func(common.Hash) error {
+				asked[id] = true
+				go tester.downloader.DeliverHashes(id, []common.Hash{})
+				return nil
+			}, tester.getBlocks(id))
+		}
+		tester.downloader.RegisterPeer("good", hashes[0], func(hash common.Hash) error {
+			asked["good"] = true
+			tester.activePeerId = "good"
+			return tester.getHashes(hash)
+		}, tester.getBlocks("good"))
+
+		tester.downloader.config.NextPeer = func(attempted map[string]bool) string {
+			for _, id := range []string{"empty", "good"} {
+				if !attempted[id] {
+					return id
+				}
+			}
+			return ""
+		}
+		if err := tester.sync("peer", hashes[0]); err != tt.result {
+			t.Fatalf("test %d: synchronisation error mismatch: have %v, want %v", i, err, tt.result)
+		}
+		if len(asked) != tt.asked {
+			t.Fatalf("test %d: asked peer count mismatch: have %d, want %d", i, len(asked), tt.asked)
+		}
+	}
+}
+
+func TestSyncEvents(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Cancel the second sync from within its first block request
+	syncs := 0
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		if syncs == 2 {
+			syncs++
+			tester.downloader.Cancel()
+		}
+		return getBlocks(request)
+	})
+	// Run a successful, a cancelled and a failed sync
+	syncs++
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	tester.downloader.TakeBlocks()
+
+	syncs++
+	if err := tester.sync("peer", hashes[0]); err != errCancelBlockFetch {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errCancelBlockFetch)
+	}
+	tester.downloader.config.TrafficBudget = 1
+	if err := tester.sync("peer", hashes[0]); err != errBudgetExceeded {
+		t.Fatalf("synchronisation error mismatch: have %v, want %v", err, errBudgetExceeded)
+	}
+	// Check the published lifecycle events
+	want := []SyncEvent{
+		{Kind: SyncStarted, Peer: "peer"}, {Kind: SyncDone, Peer: "peer"},
+		{Kind: SyncStarted, Peer: "peer"}, {Kind: SyncCancelled, Peer: "peer"},
+		{Kind: SyncStarted, Peer: "peer"}, {Kind: SyncFailed, Peer: "peer", Err: errBudgetExceeded},
+	}
+	for i, event := range want {
+		select {
+		case have := <-tester.downloader.Events():
+			if have != event {
+				t.Fatalf("event %d mismatch: have %+v, want %+v", i, have, event)
+			}
+		default:
+			t.Fatalf("event %d missing: want %+v", i, event)
+		}
+	}
+	// Check that events are dropped instead of blocking if nobody's listening
+	for i := 0; i < 2*syncEventBuffer; i++ {
+		tester.downloader.publish(SyncStarted, "peer", nil)
+	}
+	if n := len(tester.downloader.Events()); n != syncEventBuffer {
+		t.Fatalf("buffered event count mismatch: have %d, want %d", n, syncEventBuffer)
+	}
+}
+
+func TestMaxQueuedBlocks(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	limit := 200
+	tester.downloader.config.MaxQueuedBlocks = limit
+	tester.downloader.queue.maxQueued = limit
+
+	// Track the number of blocks requested, and the queued blocks at each request
+	var requested, overflow int32
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		queue := tester.downloader.queue
+		queue.lock.RLock()
+		if len(queue.blockPool)+queue.inFlightBlocks() > limit {
+			atomic.StoreInt32(&overflow, 1)
+		}
+		queue.lock.RUnlock()
+		atomic.AddInt32(&requested, int32(len(request)))
+		return getBlocks(request)
+	})
+	errc := make(chan error)
+	go func() { errc <- tester.sync("peer", hashes[0]) }()
+
+	// Wait until the queue fills up, and check that reservations stall
+	time.Sleep(500 * time.Millisecond)
+	if _, cached := tester.downloader.queue.Size(); cached != limit {
+		t.Fatalf("queued block count mismatch: have %d, want %d", cached, limit)
+	}
+	stalled := atomic.LoadInt32(&requested)
+	time.Sleep(300 * time.Millisecond)
+	if have := atomic.LoadInt32(&requested); have != stalled {
+		t.Fatalf("blocks requested while queue full: %d -> %d", stalled, have)
+	}
+	// Drain the queue until the sync completes
+	took := 0
+	for done := false; !done; {
+		select {
+		case err := <-errc:
+			if err != nil {
+				t.Fatalf("failed to synchronise blocks: %v", err)
+			}
+			done = true
+		case <-time.After(50 * time.Millisecond):
+		}
+		took += len(tester.downloader.TakeBlocks())
+	}
+	if took != targetBlocks {
+		t.Fatalf("taken block count mismatch: have %d, want %d", took, targetBlocks)
+	}
+	if atomic.LoadInt32(&overflow) != 0 {
+		t.Fatalf("queued blocks exceeded the limit of %d", limit)
+	}
+}
+
+// Tests that the count reporting block delivery returns the number of blocks
+// matching outstanding reservations, and none for ignored deliveries.
+func TestDeliverBlocksN(t *testing.T) {
+	targetBlocks := 256
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Ensure deliveries without an active sync are rejected
+	if n, err := tester.downloader.DeliverBlocksN("peer", nil); n != 0 || err != errNoSyncActive {
+		t.Fatalf("inactive delivery mismatch: have %d/%v, want 0/%v", n, err, errNoSyncActive)
+	}
+	// Deliver each requested batch, and then echo it once more
+	var accepted, echoed int32
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		delivery := make([]*types.Block, len(request))
+		for i, hash := range request {
+			delivery[i] = blocks[hash]
+		}
+		go func() {
+			n, err := tester.downloader.DeliverBlocksN("peer", delivery)
+			if err != nil {
+				t.Errorf("failed to deliver blocks: %v", err)
+			}
+			if n != len(delivery) {
+				t.Errorf("accepted block count mismatch: have %d, want %d", n, len(delivery))
+			}
+			atomic.AddInt32(&accepted, int32(n))
+
+			n, _ = tester.downloader.DeliverBlocksN("peer", delivery)
+			atomic.AddInt32(&echoed, int32(n))
+		}()
+		return nil
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if n := atomic.LoadInt32(&accepted); int(n) != targetBlocks {
+		t.Fatalf("total accepted block count mismatch: have %d, want %d", n, targetBlocks)
+	}
+	if n := atomic.LoadInt32(&echoed); n != 0 {
+		t.Fatalf("echoed deliveries accepted: have %d blocks, want 0", n)
+	}
+}
+
+// Tests that plain block deliveries don't wait for their processing, and that
+// waiting ones are released as soon as the sync run they were delivered to ends,
+// even if a new sync starts right away.
+func TestDeliverBlocksNSyncEnd(t *testing.T) {
+	tester := newTester(t, nil, nil)
+	tester.downloader.config.HashTimeout = 100 * time.Millisecond
+
+	// Start a sync stuck in the hash discovery, never reading block deliveries
+	delivered := make(chan error, 1)
+	requests := 0
+	tester.downloader.RegisterPeer("peer", common.Hash{0xff}, func(common.Hash) error {
+		if requests++; requests == 1 {
+			go func() {
+				if err := tester.downloader.DeliverBlocks("peer", nil); err != nil {
+					t.Errorf("failed to deliver blocks: %v", err)
+				}
+				_, err := tester.downloader.DeliverBlocksN("peer", nil)
+				delivered <- err
+			}()
+		}
+		return nil
+	}, func([]common.Hash) error { return nil })
+
+	if err := tester.sync("peer", common.Hash{0xff}); err != ErrTimeout {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, ErrTimeout)
+	}
+	// Immediately start a new sync, and ensure the pending delivery is released
+	errc := make(chan error, 1)
+	go func() { errc <- tester.sync("peer", common.Hash{0xff}) }()
+
+	select {
+	case err := <-delivered:
+		if err != errNoSyncActive {
+			t.Fatalf("delivery error mismatch: have %v, want %v", err, errNoSyncActive)
+		}
+	case <-errc:
+		t.Fatalf("pending delivery held up until the next sync terminated")
+	}
+	<-errc
+}
+
+// Tests that block and state deliveries blocked on a sync which never reads them
+// are released when the sync terminates.
+func TestDeliverSyncEnd(t *testing.T) {
+	tester := newTester(t, nil, nil)
+	tester.downloader.config.HashTimeout = 100 * time.Millisecond
+
+	// Start a sync stuck in the hash discovery, never reading any deliveries
+	delivered := make(chan error, 3)
+	requests := 0
+	tester.downloader.RegisterPeer("peer", common.Hash{0xff}, func(common.Hash) error {
+		if requests++; requests == 1 {
+			go func() {
+				if err := tester.downloader.DeliverBlocksWithId("peer", 1, nil); err != nil {
+					t.Errorf("failed to deliver blocks: %v", err)
+				}
+				go func() { delivered <- tester.downloader.DeliverBlocks("peer", nil) }()
+				delivered <- tester.downloader.DeliverBlocksWithId("peer", 2, nil)
+			}()
+			go func() {
+				if err := tester.downloader.DeliverNodeData("peer", nil); err != nil {
+					t.Errorf("failed to deliver state: %v", err)
+				}
+				delivered <- tester.downloader.DeliverNodeData("peer", nil)
+			}()
+		}
+		return nil
+	}, func([]common.Hash) error { return nil })
+
+	if err := tester.sync("peer", common.Hash{0xff}); err != ErrTimeout {
+		t.Fatalf("sync error mismatch: have %v, want %v", err, ErrTimeout)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-delivered:
+			if err != errNoSyncActive {
+				t.Fatalf("delivery error mismatch: have %v, want %v", err, errNoSyncActive)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("pending delivery not released by the sync termination")
+		}
+	}
+}
+
+// Tests that deliveries containing blocks failing the validation hook are
+// rejected as a whole, the delivering peer being demoted.
+func TestValidateBlock(t *testing.T) {
+	targetBlocks := 256
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Reject any blocks with a timestamp, which only the forger sets
+	var rejected int32
+	tester.downloader.config.ValidateBlock = func(block *types.Block) error {
+		if block.Time() != 0 {
+			atomic.AddInt32(&rejected, 1)
+			return errors.New("forged timestamp")
+		}
+		return nil
+	}
+	tester.newPeer("honest", big.NewInt(10000), hashes[0])
+	tester.downloader.RegisterPeer("forger", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		delivery := make([]*types.Block, len(request))
+		for i, hash := range request {
+			delivery[i] = blocks[hash]
+		}
+		// Forge the first block of the delivery, poisoning the whole pack
+		forged := createBlock(int(blocks[request[0]].NumberU64()), knownHash, request[0])
+		forged.Header().Time = 1
+		delivery[0] = forged
+
+		go tester.downloader.DeliverBlocks("forger", delivery)
+		return nil
+	})
+	if err := tester.sync("honest", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if atomic.LoadInt32(&rejected) == 0 {
+		t.Fatalf("no forged deliveries rejected")
+	}
+	// Ensure none of the forged blocks made it into the queue
+	taken := tester.downloader.TakeBlocks()
+	if len(taken) != targetBlocks {
+		t.Fatalf("downloaded block count mismatch: have %d, want %d", len(taken), targetBlocks)
+	}
+	for _, block := range taken {
+		if block.Time() != 0 {
+			t.Fatalf("forged block #%d accepted", block.NumberU64())
+		}
+	}
+	if rep := atomic.LoadInt32(&tester.downloader.peers.Peer("forger").rep); rep > 1 {
+		t.Errorf("forger not demoted: reputation %d", rep)
+	}
+}
+
+// Tests that peers demoted too many times within the ban window are banned for
+// the cooldown, after which they may register again.
+func TestPeerBanning(t *testing.T) {
+	hashes := createHashes(0, 1)
+	tester := newTester(t, hashes, createBlocksFromHashes(hashes))
+
+	dropped := []string{}
+	tester.downloader.config.BanDemotions = 3
+	tester.downloader.config.BanWindow = 100 * time.Millisecond
+	tester.downloader.config.BanCooldown = 200 * time.Millisecond
+	tester.downloader.config.OnPeerDrop = func(id string) { dropped = append(dropped, id) }
+
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	peer := tester.downloader.peers.Peer("peer")
+
+	// Ensure demotions spread beyond the window don't ban
+	tester.downloader.demote(peer)
+	tester.downloader.demote(peer)
+	time.Sleep(150 * time.Millisecond)
+	tester.downloader.demote(peer)
+	if banned := tester.downloader.BannedPeers(); len(banned) != 0 {
+		t.Fatalf("peer banned for spread out demotions: %v", banned)
+	}
+	// Ensure enough demotions within the window ban the peer
+	tester.downloader.demote(peer)
+	tester.downloader.demote(peer)
+	if banned := tester.downloader.BannedPeers(); len(banned) != 1 || banned[0] != "peer" {
+		t.Fatalf("banned peers mismatch: have %v, want [peer]", banned)
+	}
+	if tester.downloader.peers.Peer("peer") != nil {
+		t.Fatalf("banned peer still registered")
+	}
+	if len(dropped) != 1 || dropped[0] != "peer" {
+		t.Fatalf("dropped peers mismatch: have %v, want [peer]", dropped)
+	}
+	if err := tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, tester.getBlocks("peer")); err != errBannedPeer {
+		t.Fatalf("banned registration error mismatch: have %v, want %v", err, errBannedPeer)
+	}
+	if err := tester.downloader.ReplacePeers([]PeerConfig{{Id: "peer", GetHashes: tester.getHashes, GetBlocks: tester.getBlocks("peer")}}); err != errBannedPeer {
+		t.Fatalf("banned replacement error mismatch: have %v, want %v", err, errBannedPeer)
+	}
+	// Ensure the peer's eligible again after the cooldown
+	time.Sleep(250 * time.Millisecond)
+	if banned := tester.downloader.BannedPeers(); len(banned) != 0 {
+		t.Fatalf("peer still banned after cooldown: %v", banned)
+	}
+	if err := tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, tester.getBlocks("peer")); err != nil {
+		t.Fatalf("failed to register peer after cooldown: %v", err)
+	}
+	if peers := tester.downloader.peers.IdlePeers(); len(peers) != 1 {
+		t.Fatalf("idle peer count mismatch: have %d, want 1", len(peers))
+	}
+}
+
+// Tests that the sync status accessor reports a sync only while it's running.
+func TestSynchronising(t *testing.T) {
+	hashes := createHashes(0, 16)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	if tester.downloader.Synchronising() {
+		t.Fatalf("idle downloader reports sync")
+	}
+	var active int32
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		if tester.downloader.Synchronising() {
+			atomic.StoreInt32(&active, 1)
+		}
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if atomic.LoadInt32(&active) == 0 {
+		t.Fatalf("running sync not reported")
+	}
+	if tester.downloader.Synchronising() {
+		t.Fatalf("finished sync still reported")
+	}
+}
+
+// Tests that a sync interrupted after its hash discovery can be resumed from the
+// cached queue state, without retrieving the hashes again.
+func TestResumeCachedQueue(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Nothing to resume without an interrupted sync
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	if err := tester.downloader.Resume("peer"); err != errNoPausedSync {
+		t.Fatalf("idle resume error mismatch: have %v, want %v", err, errNoPausedSync)
+	}
+	if err := tester.downloader.Resume("unknown"); err != errUnknownPeer {
+		t.Fatalf("unknown peer resume error mismatch: have %v, want %v", err, errUnknownPeer)
+	}
+	tester.downloader.UnregisterPeer("peer")
+
+	// Sync with a peer delivering only its first block request
+	var served int32
+	getBlocks := tester.getBlocks("flaky")
+	tester.downloader.RegisterPeer("flaky", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		if atomic.AddInt32(&served, 1) == 1 {
+			return getBlocks(request)
+		}
+		go tester.downloader.DeliverBlocks("flaky", []*types.Block{})
+		return nil
+	})
+	if err := tester.sync("flaky", hashes[0]); err == nil {
+		t.Fatalf("sync succeeded without all the blocks")
+	}
+	if _, cached := tester.downloader.queue.Size(); cached == 0 {
+		t.Fatalf("no blocks cached by the interrupted sync")
+	}
+	// Ensure a queue not linking to the local chain is refused
+	tester.downloader.hasBlock = func(common.Hash) bool { return false }
+	if err := tester.downloader.Resume("flaky"); err != errUnknownParent {
+		t.Fatalf("stale queue resume error mismatch: have %v, want %v", err, errUnknownParent)
+	}
+	tester.downloader.hasBlock = tester.hasBlock
+
+	// Replace the peer with a functional one and resume from the cached state
+	tester.downloader.UnregisterPeer("flaky")
+	tester.downloader.RegisterPeer("peer", hashes[0], func(common.Hash) error {
+		t.Errorf("hashes requested during resumption")
+		return nil
+	}, tester.getBlocks("peer"))
+
+	if err := tester.downloader.Resume("peer"); err != nil {
+		t.Fatalf("failed to resume sync: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+	if peer := tester.downloader.LastSync().Peer; peer != "peer" {
+		t.Fatalf("resumed sync origin mismatch: have %s, want peer", peer)
+	}
+}
+
+// Tests that with fast peers preferred, block retrievals are handed out in the
+// order of the peers' round trip times.
+func TestPreferFastPeers(t *testing.T) {
+	targetBlocks := 64
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.PreferFastPeers = true
+
+	// Register a few peers with preset round trip times, tracking their requests
+	requests := make(map[string]int)
+	lock := new(sync.Mutex)
+	for _, id := range []string{"fresh", "slow", "fast"} {
+		id, getBlocks := id, tester.getBlocks(id)
+		tester.downloader.RegisterPeer(id, hashes[0], tester.getHashes, func(request []common.Hash) error {
+			lock.Lock()
+			requests[id]++
+			lock.Unlock()
+			return getBlocks(request)
+		})
+	}
+	for id, rtt := range map[string]time.Duration{"slow": time.Second, "fast": time.Millisecond} {
+		peer := tester.downloader.peers.Peer(id)
+		peer.latency, peer.samples = rtt, 1
+	}
+	// Ensure the idle peers are ordered fastest first
+	order := []string{}
+	for _, peer := range tester.downloader.peers.IdlePeersByRTT() {
+		order = append(order, peer.id)
+	}
+	if len(order) != 3 || order[0] != "fast" || order[1] != "slow" || order[2] != "fresh" {
+		t.Fatalf("idle peer order mismatch: have %v, want [fast slow fresh]", order)
+	}
+	// Ensure the single chunk of blocks is retrieved from the fastest peer
+	if err := tester.sync("slow", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if requests["fast"] != 1 || requests["slow"] != 0 || requests["fresh"] != 0 {
+		t.Fatalf("block requests mismatch: have %v, want only fast", requests)
+	}
+}
+
+// Tests that the block requests are chunked by the configured size, clamped into
+// its valid range.
+func TestBlockChunkSize(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Ensure the chunk size falls back to the default, and is clamped
+	for _, tt := range []struct{ size, want int }{{0, maxBlockFetch}, {-1, maxBlockFetch}, {32, 32}, {1 << 20, maxBlockChunk}} {
+		tester.downloader.config.BlockChunkSize = tt.size
+		if have := tester.downloader.Config().MaxBlockFetch; have != tt.want {
+			t.Errorf("chunk size %d: effective size mismatch: have %d, want %d", tt.size, have, tt.want)
+		}
+	}
+	// Ensure the reservations request the configured number of blocks
+	tester.downloader.config.BlockChunkSize = 32
+
+	var first int32
+	getBlocks := tester.getBlocks("peer")
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		atomic.CompareAndSwapInt32(&first, 0, int32(len(request)))
+		if len(request) > 32 {
+			t.Errorf("oversized block request: have %d, want at most 32", len(request))
+		}
+		return getBlocks(request)
+	})
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if n := atomic.LoadInt32(&first); n != 32 {
+		t.Fatalf("requested block count mismatch: have %d, want 32", n)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("downloaded block mismatch: have %v, want %v", len(took), targetBlocks)
+	}
+}
+
+// Tests that a sync caching blocks whose head never links to the local chain is
+// aborted once the stall timeout expires.
+func TestHeadStallTimeout(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Detach the first block to download from the local chain
+	orphan := createBlock(2, knownHash, hashes[targetBlocks-1])
+	orphan.ParentHeaderHash = common.Hash{0xff}
+	blocks[orphan.Hash()] = orphan
+
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.HeadStallTimeout = 200 * time.Millisecond
+	tester.downloader.config.MaxQueuedBlocks = 100
+	tester.downloader.queue.maxQueued = 100
+
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+
+	start := time.Now()
+	if err := tester.sync("peer", hashes[0]); err != errStalledSync {
+		t.Fatalf("stalled sync error mismatch: have %v, want %v", err, errStalledSync)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("sync aborted before the stall timeout: %v", elapsed)
+	}
+}
+
+// fakeClock is a manually advanced clock, firing its timers and tickers only when
+// the time is moved past their deadlines.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	lock   sync.Mutex
+}
+
+// fakeTimer is a timer (or with a period, a ticker) of a fake clock.
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	at     time.Time     // Time the timer fires at next
+	period time.Duration // Period of a ticker (0 = single shot timer)
+	active bool          // Whether the timer is still to fire
+}
+
+// fakeTicker adapts a periodic fake timer to the ticker interface.
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	return c.schedule(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	return fakeTicker{c.schedule(d, d)}
+}
+
+func (c *fakeClock) schedule(d time.Duration, period time.Duration) *fakeTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d), period: period, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Active retrieves the number of timers and tickers still to fire.
+func (c *fakeClock) Active() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	active := 0
+	for _, t := range c.timers {
+		if t.active {
+			active++
+		}
+	}
+	return active
+}
+
+// Advance moves the clock forward, firing all the timers and tickers passed.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if !t.active || t.at.After(c.now) {
+			continue
+		}
+		select {
+		case t.c <- c.now:
+		default:
+		}
+		if t.period > 0 {
+			t.at = c.now.Add(t.period)
+		} else {
+			t.active = false
+		}
+	}
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.active
+	t.at, t.active = t.clock.now.Add(d), true
+	return active
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// Tests that hash requests time out exactly once the fake clock passes the hash
+// request allowance, without any real waiting.
+func TestFakeClockHashTimeout(t *testing.T) {
+	hashes := createHashes(0, 16)
+	tester := newTester(t, hashes, createBlocksFromHashes(hashes))
+
+	clock := newFakeClock()
+	tester.downloader.setClock(clock)
+	tester.downloader.RegisterPeer("peer", hashes[0], func(common.Hash) error { return nil }, tester.getBlocks("peer"))
+
+	errc := make(chan error, 1)
+	go func() { errc <- tester.sync("peer", hashes[0]) }()
+
+	// Wait for the hash request and discovery timers to be armed
+	for clock.Active() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(hashTtl - time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("sync terminated before the hash timeout: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	if err := <-errc; err != ErrTimeout {
+		t.Fatalf("hash timeout error mismatch: have %v, want %v", err, ErrTimeout)
+	}
+}
+
+// Tests that block requests expire exactly once the fake clock passes the block
+// request allowance, without any real waiting.
+func TestBlockTimeout(t *testing.T) {
+	hashes := createHashes(0, 16)
+	tester := newTester(t, hashes, createBlocksFromHashes(hashes))
+	tester.downloader.config.BlockTimeout = time.Second
+
+	clock := newFakeClock()
+	tester.downloader.setClock(clock)
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func([]common.Hash) error { return nil })
+
+	errc := make(chan error, 1)
+	go func() { errc <- tester.sync("peer", hashes[0]) }()
+
+	// Wait for the block request, and make sure it expires after the configured
+	// allowance instead of the default one
+	for tester.downloader.queue.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if tester.downloader.queue.InFlight() == 0 {
+		t.Fatalf("block request expired before the timeout")
+	}
+	clock.Advance(20 * time.Millisecond)
+	if err := <-errc; !errors.Is(err, errPeersUnavailable) {
+		t.Fatalf("expired sync error mismatch: have %v, want %v", err, errPeersUnavailable)
+	}
+	if settings := tester.downloader.Config(); settings.BlockTtl != time.Second {
+		t.Fatalf("reported block timeout mismatch: have %v, want %v", settings.BlockTtl, time.Second)
+	}
+}
+
+// Tests that the hash request allowance backs off exponentially on consecutive
+// timeouts, jittered within a quarter of the nominal value and capped.
+func TestHashBackoff(t *testing.T) {
+	tester := newTester(t, nil, nil)
+	tester.downloader.config.HashBackoffBase = time.Second
+	tester.downloader.config.HashBackoffFactor = 3
+	tester.downloader.config.HashBackoffCap = 20 * time.Second
+
+	ttl := 500 * time.Millisecond
+	for timeouts, nominal := range []time.Duration{ttl, time.Second, 3 * time.Second, 9 * time.Second, 20 * time.Second, 20 * time.Second} {
+		for i := 0; i < 16; i++ {
+			allowance := tester.downloader.hashBackoff(ttl, timeouts)
+			if timeouts == 0 && allowance != ttl {
+				t.Fatalf("initial allowance mismatch: have %v, want %v", allowance, ttl)
+			}
+			if allowance > nominal || allowance <= nominal*3/4 {
+				t.Fatalf("timeouts %d: allowance %v outside of (%v, %v]", timeouts, allowance, nominal*3/4, nominal)
+			}
+		}
+	}
+	// Unset parameters fall back to the defaults
+	tester.downloader.config.HashBackoffBase = 0
+	tester.downloader.config.HashBackoffFactor = 0
+	tester.downloader.config.HashBackoffCap = 0
+
+	if settings := tester.downloader.Config(); settings.HashBackoffBase != hashTtl || settings.HashBackoffFactor != hashBackoffRate || settings.HashBackoffCap != hashBackoffCap {
+		t.Fatalf("default backoff mismatch: have %v/%v/%v", settings.HashBackoffBase, settings.HashBackoffFactor, settings.HashBackoffCap)
+	}
+	if allowance := tester.downloader.hashBackoff(hashTtl, 16); allowance > hashBackoffCap {
+		t.Fatalf("allowance exceeds the default cap: %v > %v", allowance, hashBackoffCap)
+	}
+}
+
+func TestFakeClockBlockExpiry(t *testing.T) {
+	hashes := createHashes(0, 16)
+	tester := newTester(t, hashes, createBlocksFromHashes(hashes))
+
+	clock := newFakeClock()
+	tester.downloader.setClock(clock)
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func([]common.Hash) error { return nil })
+
+	errc := make(chan error, 1)
+	go func() { errc <- tester.sync("peer", hashes[0]) }()
+
+	// Wait for the block request, and make sure it doesn't expire early
+	for tester.downloader.queue.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(blockTtl)
+	time.Sleep(50 * time.Millisecond)
+	if tester.downloader.queue.InFlight() == 0 {
+		t.Fatalf("block request expired before the timeout")
+	}
+	// Pass the allowance by a ticker period, and ensure the request expires
+	clock.Advance(20 * time.Millisecond)
+	if err := <-errc; !errors.Is(err, errPeersUnavailable) {
+		t.Fatalf("expired sync error mismatch: have %v, want %v", err, errPeersUnavailable)
+	}
+	peer := tester.downloader.peers.Peer("peer")
+	peer.mu.RLock()
+	defer peer.mu.RUnlock()
+
+	if peer.timeouts != 1 {
+		t.Fatalf("peer timeout count mismatch: have %d, want 1", peer.timeouts)
+	}
+}
+
+// Tests that resetting the downloader wipes the state left behind by a failed
+// sync, along with the peer statistics, and that it's refused mid-sync.
+func TestReset(t *testing.T) {
+	targetBlocks := 1000
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+	tester.downloader.config.BanDemotions = 1
+
+	// Sync with a peer delivering the hashes but none of the blocks, trying a reset midway
+	var busy error
+	tester.downloader.RegisterPeer("peer", hashes[0], tester.getHashes, func([]common.Hash) error {
+		busy = tester.downloader.Reset()
+		go tester.downloader.DeliverBlocks("peer", []*types.Block{})
+		return nil
+	})
+	tester.newPeer("banned", big.NewInt(10000), hashes[0])
+	tester.downloader.demote(tester.downloader.peers.Peer("banned"))
+
+	if err := tester.sync("peer", hashes[0]); err == nil {
+		t.Fatalf("sync succeeded without any blocks")
+	}
+	if busy != ErrBusy {
+		t.Fatalf("mid-sync reset error mismatch: have %v, want %v", busy, ErrBusy)
+	}
+	peer := tester.downloader.peers.Peer("peer")
+	peer.Promote()
+	peer.MarkDelivered(1)
+
+	if tester.downloader.queue.Pending() == 0 {
+		t.Fatalf("no pending hashes left by the failed sync")
+	}
+	// Reset the downloader and ensure everything's wiped
+	if err := tester.downloader.Reset(); err != nil {
+		t.Fatalf("failed to reset idle downloader: %v", err)
+	}
+	if tester.downloader.Synchronising() {
+		t.Fatalf("sync reported active after reset")
+	}
+	if err := tester.downloader.DeliverBlocks("peer", nil); err != errNoSyncActive {
+		t.Fatalf("post-reset delivery error mismatch: have %v, want %v", err, errNoSyncActive)
+	}
+	if hashes, blocks := len(tester.downloader.hashCh), len(tester.downloader.blockCh); hashes+blocks != 0 {
+		t.Fatalf("stale deliveries survived the reset: %d hash, %d block packs", hashes, blocks)
+	}
+	if pending, inflight := tester.downloader.queue.Pending(), tester.downloader.queue.InFlight(); pending+inflight != 0 {
+		t.Fatalf("queue not wiped: pending %d, in-flight %d", pending, inflight)
+	}
+	if err := tester.downloader.RetryBlocks(); err != errNoPendingHashes {
+		t.Fatalf("retry error mismatch: have %v, want %v", err, errNoPendingHashes)
+	}
+	if rep := atomic.LoadInt32(&peer.rep); rep != 0 {
+		t.Fatalf("peer reputation not wiped: %d", rep)
+	}
+	if _, samples := peer.Latency(); samples != 0 {
+		t.Fatalf("peer latency measurements not wiped: %d", samples)
+	}
+	if banned := tester.downloader.BannedPeers(); len(banned) != 0 {
+		t.Fatalf("peer bans not wiped: %v", banned)
+	}
+	if tester.downloader.peers.Peer("peer") == nil {
+		t.Fatalf("peer unregistered by reset")
+	}
+}
+
+// Tests that a header only sync retrieves the headers via the dedicated fetcher,
+// and yields header-only blocks, without ever requesting full blocks.
+func TestHeaderSync(t *testing.T) {
+	// Assemble a real header chain on top of the known block, so the delivered
+	// headers hash to the announced hash chain
+	headers := make(map[common.Hash]*types.Header)
+	hashes := []common.Hash{knownHash}
+	for i, parent := 0, knownHash; i < 100; i++ {
+		header := &types.Header{Number: big.NewInt(int64(i + 2)), ParentHash: parent}
+		parent = header.Hash()
+		headers[parent] = header
+		hashes = append([]common.Hash{parent}, hashes...)
+	}
+	tester := newTester(t, hashes, createBlocksFromHashes(hashes[len(hashes)-1:]))
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:        "peer",
+		Head:      hashes[0],
+		GetHashes: tester.getHashes,
+		GetBlocks: func([]common.Hash) error {
+			t.Errorf("full blocks requested in header sync")
+			return nil
+		},
+		GetHeaders: func(hashes []common.Hash) error {
+			delivery := make([]*types.Header, len(hashes))
+			for i, hash := range hashes {
+				delivery[i] = headers[hash]
+			}
+			go tester.downloader.DeliverHeaders("peer", delivery)
+			return nil
+		},
+	})
+	tester.activePeerId = "peer"
+	if err := tester.downloader.SynchroniseMode("peer", hashes[0], HeaderSync); err != nil {
+		t.Fatalf("failed to synchronise headers: %v", err)
+	}
+	blocks := tester.downloader.TakeBlocks()
+	if len(blocks) != len(headers) {
+		t.Fatalf("taken block count mismatch: have %d, want %d", len(blocks), len(headers))
+	}
+	for _, block := range blocks {
+		if header := headers[block.Hash()]; header == nil || block.Header() != header {
+			t.Fatalf("block #%d [%x] is not a delivered header", block.NumberU64(), block.Hash().Bytes()[:4])
+		}
+		if len(block.Transactions()) != 0 || len(block.Uncles()) != 0 {
+			t.Fatalf("block #%d has a body", block.NumberU64())
+		}
+	}
+}
+
+// Tests that a peer delivering a requested block numbered beyond the sync target
+// is demoted, and the block is re-requested from someone else.
+func TestBlockNumberOverflow(t *testing.T) {
+	targetBlocks := 256
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	var overflown int32
+	tester.newPeer("honest", big.NewInt(10000), hashes[0])
+	tester.downloader.RegisterPeer("overflow", hashes[0], tester.getHashes, func(request []common.Hash) error {
+		delivery := make([]*types.Block, len(request))
+		for i, hash := range request {
+			delivery[i] = blocks[hash]
+		}
+		// Renumber the first block of the delivery way beyond the sync target
+		delivery[0] = createBlock(10*targetBlocks, knownHash, request[0])
+		atomic.AddInt32(&overflown, 1)
+
+		go tester.downloader.DeliverBlocks("overflow", delivery)
+		return nil
+	})
+	if err := tester.sync("honest", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if atomic.LoadInt32(&overflown) == 0 {
+		t.Fatalf("no overflowing deliveries made")
+	}
+	taken := tester.downloader.TakeBlocks()
+	if len(taken) != targetBlocks {
+		t.Fatalf("downloaded block count mismatch: have %d, want %d", len(taken), targetBlocks)
+	}
+	for _, block := range taken {
+		if block.NumberU64() > uint64(targetBlocks+1) {
+			t.Fatalf("overflowing block #%d accepted", block.NumberU64())
+		}
+	}
+	if rep := atomic.LoadInt32(&tester.downloader.peers.Peer("overflow").rep); rep > 1 {
+		t.Errorf("overflowing peer not demoted: reputation %d", rep)
+	}
+}
+
+// Tests that limited block takes yield consecutive batches starting at the head,
+// leaving the remaining blocks intact for the successive takes.
+func TestTakeBlocksN(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	if err := tester.sync("peer", hashes[0]); err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	next := uint64(2)
+	for _, want := range []int{30, 30, 30, 10, 0} {
+		took := tester.downloader.TakeBlocksN(30)
+		if len(took) != want {
+			t.Fatalf("taken block count mismatch: have %d, want %d", len(took), want)
+		}
+		for _, block := range took {
+			if block.NumberU64() != next {
+				t.Fatalf("block number mismatch: have %d, want %d", block.NumberU64(), next)
+			}
+			next++
+		}
+	}
+}
+
+// Tests that the non-blocking deliveries report a busy downloader instead of
+// blocking the caller while a previous delivery is still pending.
+func TestTryDeliver(t *testing.T) {
+	tester := newTester(t, nil, nil)
+	if err := tester.downloader.TryDeliverHashes("peer", nil); err != errNoSyncActive {
+		t.Fatalf("inactive delivery error mismatch: have %v, want %v", err, errNoSyncActive)
+	}
+	// Simulate a sync stuck processing, never consuming the deliveries
+	atomic.StoreInt32(&tester.downloader.synchronising, 1)
+	defer atomic.StoreInt32(&tester.downloader.synchronising, 0)
+
+	if err := tester.downloader.TryDeliverHashes("peer", nil); err != nil {
+		t.Fatalf("failed to deliver hashes: %v", err)
+	}
+	if err := tester.downloader.TryDeliverHashes("peer", nil); err != ErrDeliveryBusy {
+		t.Fatalf("pending hash delivery error mismatch: have %v, want %v", err, ErrDeliveryBusy)
+	}
+	if err := tester.downloader.TryDeliverBlocks("peer", nil); err != nil {
+		t.Fatalf("failed to deliver blocks: %v", err)
+	}
+	if err := tester.downloader.TryDeliverBlocks("peer", nil); err != ErrDeliveryBusy {
+		t.Fatalf("pending block delivery error mismatch: have %v, want %v", err, ErrDeliveryBusy)
+	}
+}
+
+// Tests that a range sync runs isolated alongside the primary sync, with its own
+// queue and the lent peer, with the deliveries routed from the primary downloader.
+func TestSynchroniseRange(t *testing.T) {
+	targetBlocks := 100
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+	tester := newTester(t, hashes, blocks)
+
+	// Register a primary peer holding back its block deliveries until released
+	release := make(chan struct{})
+	getBlocks := tester.getBlocks("primary")
+	tester.downloader.RegisterPeer("primary", hashes[0], tester.getHashes, func(hashes []common.Hash) error {
+		go func() {
+			<-release
+			getBlocks(hashes)
+		}()
+		return nil
+	})
+	errc := make(chan error, 1)
+	go func() {
+		tester.activePeerId = "primary"
+		errc <- tester.downloader.SynchroniseWith([]string{"primary"}, hashes[0])
+	}()
+	for tester.downloader.queue.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Register a back-filling peer, and ensure it's excluded from the primary peers
+	// while lent to the range sync
+	var shared int32
+	backfill := tester.getBlocks("backfill")
+	tester.downloader.RegisterPeerConfig(PeerConfig{
+		Id:   "backfill",
+		Head: hashes[0],
+		GetHashes: func(common.Hash) error {
+			go tester.downloader.DeliverHashes("backfill", hashes)
+			return nil
+		},
+		GetBlocks: func(hashes []common.Hash) error {
+			for _, p := range tester.downloader.peers.AllPeers() {
+				if p.id == "backfill" {
+					atomic.AddInt32(&shared, 1)
+				}
+			}
+			return backfill(hashes)
+		},
+	})
+	session, err := tester.downloader.SynchroniseRange("backfill", hashes[0], knownHash)
+	if err != nil {
+		t.Fatalf("failed to synchronise range: %v", err)
+	}
+	if took := session.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("range block count mismatch: have %d, want %d", len(took), targetBlocks)
+	}
+	if n := atomic.LoadInt32(&shared); n != 0 {
+		t.Fatalf("lent peer shared with the primary sync %d times", n)
+	}
+	// Release the primary sync and ensure it was undisturbed
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to synchronise blocks: %v", err)
+	}
+	if took := tester.downloader.TakeBlocks(); len(took) != targetBlocks {
+		t.Fatalf("primary block count mismatch: have %d, want %d", len(took), targetBlocks)
+	}
+	if _, err := tester.downloader.SynchroniseRange("backfill", hashes[0], hashes[1]); err != errUnknownRangeEnd {
+		t.Fatalf("unknown range end error mismatch: have %v, want %v", err, errUnknownRangeEnd)
+	}
+}
+
+// Tests that the hash discovery of a range sync stops at the end of the range, and
+// fails if the chain links up with the local one anywhere else.
+func TestSynchroniseRangeEnd(t *testing.T) {
+	targetBlocks := 256
+	hashes := createHashes(0, targetBlocks)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Know a block halfway down the chain, and another one not on the chain at all
+	middle, stray := hashes[targetBlocks/2], common.Hash{0xee}
+
+	tester := newTester(t, hashes, blocks)
+	tester.downloader = New(func(hash common.Hash) bool {
+		return hash == middle || hash == stray || tester.hasBlock(hash)
+	}, func(hash common.Hash) *types.Block {
+		return blocks[hash]
+	})
+	tester.newPeer("peer", big.NewInt(10000), hashes[0])
+	tester.activePeerId = "peer"
+
+	session, err := tester.downloader.SynchroniseRange("peer", hashes[0], middle)
+	if err != nil {
+		t.Fatalf("failed to synchronise range: %v", err)
+	}
+	if took := session.TakeBlocks(); len(took) != targetBlocks/2 {
+		t.Fatalf("range block count mismatch: have %d, want %d", len(took), targetBlocks/2)
+	}
+	if _, err := tester.downloader.SynchroniseRange("peer", hashes[0], stray); err != errRangeEndSkipped {
+		t.Fatalf("skipped range end error mismatch: have %v, want %v", err, errRangeEndSkipped)
+	}
+}
@@ -0,0 +1,62 @@
+// Contains the lifecycle events of the synchronisations, published on a channel
+// for embedders to react on the transitions without polling.
+
+package downloader
+
+import (
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+)
+
+const (
+	syncEventBuffer = 16 // Number of lifecycle events buffered before dropping new ones
+)
+
+// SyncEventKind is the type of a sync lifecycle transition.
+type SyncEventKind int
+
+const (
+	SyncStarted   SyncEventKind = iota // Synchronisation started with a peer
+	SyncDone                           // Synchronisation completed successfully
+	SyncFailed                         // Synchronisation terminated with an error
+	SyncCancelled                      // Synchronisation cancelled by the embedder
+)
+
+// String implements fmt.Stringer.
+func (k SyncEventKind) String() string {
+	switch k {
+	case SyncStarted:
+		return "started"
+	case SyncDone:
+		return "done"
+	case SyncFailed:
+		return "failed"
+	case SyncCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// SyncEvent is a lifecycle transition of a synchronisation.
+type SyncEvent struct {
+	Kind SyncEventKind // Type of the transition
+	Peer string        // Identifier of the peer the sync was started with
+	Err  error         // Error the sync failed with (only set for SyncFailed)
+}
+
+// Events retrieves the channel the sync lifecycle events are published on. The
+// channel is buffered, and events are dropped if it's full, so a caller not
+// listening never blocks the synchronisation.
+func (d *Downloader) Events() <-chan SyncEvent {
+	return d.events
+}
+
+// publish posts a lifecycle event, dropping it if the channel is full.
+func (d *Downloader) publish(kind SyncEventKind, peer string, err error) {
+	select {
+	case d.events <- SyncEvent{Kind: kind, Peer: peer, Err: err}:
+	default:
+		glog.V(logger.Debug).Infof("Dropped %v sync event of %s, event channel full", kind, peer)
+	}
+}
@@ -0,0 +1,73 @@
+// Contains the peer health score, blending the measured delivery latency and
+// throughput with the reliability of a peer into a single quality metric.
+
+package downloader
+
+import "time"
+
+const (
+	healthLatencyRef    = time.Second // Delivery latency at which the latency component halves
+	healthThroughputRef = 100.0       // Delivery throughput (blocks/s) at which the throughput component halves
+)
+
+// HealthWeights are the relative weights of the inputs of the peer health score.
+// Each input is normalised into the [0, 1] range (1 = best) before weighting:
+//   - Latency:    1 / (1 + latency / 1s), the moving average of the delivery latency
+//   - Throughput: rate / (rate + 100), the moving average of the blocks delivered per second
+//   - Timeouts:   1 - timeouts / requests, the ratio of requests answered in time
+//   - Failures:   1 - failures / requests, the ratio of requests answered validly
+//
+// Peers without any delivery measurements score a neutral 0.5 on latency and
+// throughput, and peers without any finished requests a perfect 1 on reliability.
+type HealthWeights struct {
+	Latency    float64 // Weight of the block delivery latency
+	Throughput float64 // Weight of the block delivery throughput
+	Timeouts   float64 // Weight of the ratio of timed out requests
+	Failures   float64 // Weight of the ratio of invalid deliveries
+}
+
+// DefaultHealthWeights are the health score weights used if none were configured.
+var DefaultHealthWeights = HealthWeights{
+	Latency:    1,
+	Throughput: 1,
+	Timeouts:   2,
+	Failures:   2,
+}
+
+// Health calculates the peer's health score in the [0, 1] range (1 = best) as
+// the weighted average of its normalised quality metrics.
+func (p *peer) Health(weights HealthWeights) float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	latency, throughput := 0.5, 0.5
+	if p.samples > 0 {
+		latency = 1 / (1 + float64(p.latency)/float64(healthLatencyRef))
+		throughput = p.throughput / (p.throughput + healthThroughputRef)
+	}
+	timeouts, failures := 1.0, 1.0
+	if requests := p.samples + p.timeouts + p.failures; requests > 0 {
+		timeouts = 1 - float64(p.timeouts)/float64(requests)
+		failures = 1 - float64(p.failures)/float64(requests)
+	}
+	total := weights.Latency + weights.Throughput + weights.Timeouts + weights.Failures
+	if total <= 0 {
+		return 1
+	}
+	return (weights.Latency*latency + weights.Throughput*throughput + weights.Timeouts*timeouts + weights.Failures*failures) / total
+}
+
+// sortByHealth orders a list of peers by their health score, healthiest first.
+func sortByHealth(list []*peer, weights HealthWeights) {
+	health := make(map[*peer]float64, len(list))
+	for _, p := range list {
+		health[p] = p.Health(weights)
+	}
+	for i := 0; i < len(list); i++ {
+		for j := i + 1; j < len(list); j++ {
+			if health[list[i]] < health[list[j]] {
+				list[i], list[j] = list[j], list[i]
+			}
+		}
+	}
+}
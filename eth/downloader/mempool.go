@@ -0,0 +1,55 @@
+// Contains a memory budget which can be shared between multiple subsystems of
+// a node, allowing a global governor to cap their combined memory usage.
+
+package downloader
+
+import "sync/atomic"
+
+// MemoryPool is a byte budget shared by any number of consumers. It does not
+// allocate anything by itself, rather each consumer accounts the memory it
+// holds, and backs off once the pool is exhausted.
+type MemoryPool struct {
+	limit uint64 // Maximum number of bytes the consumers are allowed to hold
+	used  uint64 // Number of bytes currently held by all consumers (atomic)
+}
+
+// NewMemoryPool creates a shared memory budget of limit bytes.
+func NewMemoryPool(limit uint64) *MemoryPool {
+	return &MemoryPool{limit: limit}
+}
+
+// Limit retrieves the total size of the memory budget.
+func (p *MemoryPool) Limit() uint64 {
+	return p.limit
+}
+
+// Used retrieves the number of bytes currently held by all the consumers.
+func (p *MemoryPool) Used() uint64 {
+	return atomic.LoadUint64(&p.used)
+}
+
+// Acquire accounts size bytes as being held by a consumer. The operation never
+// fails, it's up to the consumer to check Exhausted before allocating.
+func (p *MemoryPool) Acquire(size uint64) {
+	atomic.AddUint64(&p.used, size)
+}
+
+// Release returns size bytes to the pool, previously taken via Acquire.
+func (p *MemoryPool) Release(size uint64) {
+	for {
+		prev := atomic.LoadUint64(&p.used)
+		next := uint64(0)
+		if prev > size {
+			next = prev - size
+		}
+		if atomic.CompareAndSwapUint64(&p.used, prev, next) {
+			return
+		}
+	}
+}
+
+// Exhausted checks whether the pool could not accommodate an additional size
+// bytes without exceeding its limit.
+func (p *MemoryPool) Exhausted(size uint64) bool {
+	return p.Used()+size >= p.limit
+}
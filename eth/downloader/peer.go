@@ -5,36 +5,133 @@ package downloader
 
 import (
 	"errors"
+	"math/big"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"gopkg.in/fatih/set.v0"
 )
 
+const repeatedDeliveryLimit = 3 // Number of identical block deliveries tolerated before demoting a peer
+
 type hashFetcherFn func(common.Hash) error
 type blockFetcherFn func([]common.Hash) error
+type headerFetcherFn func([]common.Hash) error
+type nodeDataFetcherFn func([]common.Hash) error
+type blockRequestFn func(uint64, []common.Hash) error
+
+// HashOrder is the ordering in which a peer delivers a segment of the hash chain.
+type HashOrder int
+
+const (
+	NewestFirst HashOrder = iota // Starting from the requested hash's parent, walking towards the genesis
+	OldestFirst                  // Same segment as NewestFirst, but delivered in reverse order
+)
+
+// PeerConfig contains the parameters of a download peer to register.
+type PeerConfig struct {
+	Id        string         // Unique identifier of the peer
+	Head      common.Hash    // Hash of the peers latest known block
+	GetHashes hashFetcherFn  // Method to request a batch of hashes from the peer
+	GetBlocks blockFetcherFn // Method to request a batch of blocks from the peer
+	HashOrder HashOrder      // Ordering in which the peer delivers the hashes
+	Td        *big.Int       // Total difficulty advertised by the peer (nil = unknown)
+	Genesis   common.Hash    // Hash of the genesis block of the peer's chain (zero = unknown)
+
+	GetNodeData nodeDataFetcherFn // Method to request a batch of state trie nodes (nil = unsupported)
+	GetHeaders  headerFetcherFn   // Method to request a batch of block headers (nil = unsupported)
+
+	// GetBlocksWithId is an alternative to GetBlocks, also passing the correlation
+	// id of the request, which the peer echoes back via DeliverBlocksWithId.
+	GetBlocksWithId blockRequestFn
+
+	MaxBlockFetch int // Maximum number of blocks the peer serves per request (0 = global limit)
+
+	Light  bool   // Whether the peer's a light node, not guaranteed to serve historical blocks
+	Oldest uint64 // Number of the oldest block the peer can serve, if pruned (0 = all)
+}
+
+// validate checks that the configuration specifies the functions to fetch the
+// hashes and blocks from the peer with, which would otherwise be invoked nil.
+func (c *PeerConfig) validate() error {
+	if c.GetHashes == nil || (c.GetBlocks == nil && c.GetBlocksWithId == nil) {
+		return errInvalidPeerFetcher
+	}
+	return nil
+}
 
 var (
 	errAlreadyFetching   = errors.New("already fetching blocks from peer")
 	errAlreadyRegistered = errors.New("peer is already registered")
 	errNotRegistered     = errors.New("peer is not registered")
+	errUncorrelated      = errors.New("peer doesn't correlate block requests")
+	errTooManyPeers      = errors.New("peer set is full")
+	errBannedPeer        = errors.New("peer is banned")
 )
 
+// PeerStat is a snapshot of the block delivery statistics of a single peer.
+type PeerStat struct {
+	Blocks     int           // Total number of blocks delivered by the peer
+	Deliveries int           // Number of block deliveries made by the peer
+	InFlight   time.Duration // Total time the peer's block requests were in flight
+	Throughput float64       // Average delivery throughput in blocks/s over the in-flight time
+}
+
+// deliveryRange identifies a chunk of delivered blocks.
+type deliveryRange struct {
+	first, last common.Hash
+	count       int
+}
+
 // peer represents an active peer from which hashes and blocks are retrieved.
 type peer struct {
 	id   string      // Unique identifier of the peer
 	head common.Hash // Hash of the peers latest known block
+	td   *big.Int    // Total difficulty advertised by the peer
 
-	idle int32 // Current activity state of the peer (idle = 0, active = 1)
-	rep  int32 // Simple peer reputation (not used currently)
+	genesis common.Hash // Hash of the genesis block of the peer's chain (zero = unknown)
+
+	idle      int32 // Current activity state of the peer (idle = 0, active = 1)
+	stateIdle int32 // Current state retrieval activity of the peer (idle = 0, active = 1)
+	rep       int32 // Simple peer reputation (not used currently)
 
 	mu sync.RWMutex
 
+	fetched time.Time     // Time of the last block retrieval request (guarded by mu)
+	latency time.Duration // Moving average of the block delivery round trip time (guarded by mu)
+	samples int           // Number of block deliveries measured (guarded by mu)
+
+	throughput float64 // Moving average of the block delivery throughput in blocks/s (guarded by mu)
+	timeouts   int     // Number of block requests timed out (guarded by mu)
+	failures   int     // Number of invalid block deliveries (guarded by mu)
+
+	blocks     int           // Total number of blocks delivered by the peer (guarded by mu)
+	deliveries int           // Total number of block deliveries of the peer (guarded by mu)
+	busy       time.Duration // Total time the peer's block requests were in flight (guarded by mu)
+
+	delivered deliveryRange // Range of the last block delivery since the last request (guarded by mu)
+	repeats   int           // Number of times the last delivery was repeated (guarded by mu)
+
 	ignored *set.Set
 
-	getHashes hashFetcherFn
-	getBlocks blockFetcherFn
+	hashOrder       HashOrder // Ordering in which the peer delivers the hashes
+	lastHashRequest time.Time // Time of the last hash request, to rate limit them
+	maxBlockFetch   int       // Maximum number of blocks to request at once (0 = global limit)
+	light           bool      // Whether the peer's a light node
+	oldest          uint64    // Number of the oldest block the peer can serve (0 = all)
+
+	getHashes   hashFetcherFn
+	getBlocks   blockFetcherFn
+	getNodeData nodeDataFetcherFn
+	getHeaders  headerFetcherFn
+
+	getBlocksWithId blockRequestFn
+
+	clock clock // Source of the request times, measuring the delivery round trips
 }
 
 // newPeer create a new downloader peer, with specific hash and block retrieval
@@ -45,32 +142,220 @@ func newPeer(id string, head common.Hash, getHashes hashFetcherFn, getBlocks blo
 		head:      head,
 		getHashes: getHashes,
 		getBlocks: getBlocks,
+		td:        new(big.Int),
 		ignored:   set.New(),
+		clock:     realClock{},
+	}
+}
+
+// Archival checks whether the peer is a full node able to serve any historical
+// block of the chain.
+func (p *peer) Archival() bool {
+	return !p.light && p.oldest == 0
+}
+
+// BlockFetchLimit retrieves the maximum number of blocks to request from the peer
+// at once, capping the global limit by the peer's own advertised one.
+func (p *peer) BlockFetchLimit(global int) int {
+	if p.maxBlockFetch > 0 && p.maxBlockFetch < global {
+		return p.maxBlockFetch
 	}
+	return global
 }
 
 // Reset clears the internal state of a peer entity.
 func (p *peer) Reset() {
 	atomic.StoreInt32(&p.idle, 0)
+	atomic.StoreInt32(&p.stateIdle, 0)
 	p.ignored.Clear()
 }
 
+// Forget resets the peer and clears all its statistics and reputation, restoring
+// it to its freshly registered state.
+func (p *peer) Forget() {
+	p.Reset()
+	atomic.StoreInt32(&p.rep, 0)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.fetched, p.latency, p.samples = time.Time{}, 0, 0
+	p.throughput, p.timeouts, p.failures = 0, 0, 0
+	p.blocks, p.deliveries, p.busy = 0, 0, 0
+	p.delivered, p.repeats = deliveryRange{}, 0
+	p.lastHashRequest = time.Time{}
+}
+
+// config reassembles the registration parameters of the peer, e.g. to register
+// it with another downloader too.
+func (p *peer) config() PeerConfig {
+	return PeerConfig{
+		Id:              p.id,
+		Head:            p.head,
+		GetHashes:       p.getHashes,
+		GetBlocks:       p.getBlocks,
+		HashOrder:       p.hashOrder,
+		Td:              p.td,
+		Genesis:         p.genesis,
+		GetNodeData:     p.getNodeData,
+		GetHeaders:      p.getHeaders,
+		GetBlocksWithId: p.getBlocksWithId,
+		MaxBlockFetch:   p.maxBlockFetch,
+		Light:           p.light,
+		Oldest:          p.oldest,
+	}
+}
+
 // Fetch sends a block retrieval request to the remote peer.
 func (p *peer) Fetch(request *fetchRequest) error {
 	// Short circuit if the peer is already fetching
 	if !atomic.CompareAndSwapInt32(&p.idle, 0, 1) {
 		return errAlreadyFetching
 	}
+	p.mu.Lock()
+	p.fetched = p.clock.Now()
+	p.delivered, p.repeats = deliveryRange{}, 0
+	p.mu.Unlock()
+
+	// Convert the hash set to a retrievable slice
+	hashes := make([]common.Hash, 0, len(request.Hashes))
+	for hash, _ := range request.Hashes {
+		hashes = append(hashes, hash)
+	}
+	switch {
+	case request.Headers:
+		p.getHeaders(hashes)
+	case p.getBlocksWithId != nil:
+		p.getBlocksWithId(request.Id, hashes)
+	default:
+		p.getBlocks(hashes)
+	}
+
+	return nil
+}
+
+// FetchExtra sends an additional block retrieval request to a remote peer already
+// busy fetching. Only peers correlating their deliveries with the requests may
+// serve multiple of them concurrently.
+func (p *peer) FetchExtra(request *fetchRequest) error {
+	if p.getBlocksWithId == nil {
+		return errUncorrelated
+	}
+	hashes := make([]common.Hash, 0, len(request.Hashes))
+	for hash, _ := range request.Hashes {
+		hashes = append(hashes, hash)
+	}
+	p.getBlocksWithId(request.Id, hashes)
+
+	return nil
+}
+
+// FetchNodeData sends a state trie node retrieval request to the remote peer.
+func (p *peer) FetchNodeData(request *fetchRequest) error {
+	// Short circuit if the peer is already fetching
+	if !atomic.CompareAndSwapInt32(&p.stateIdle, 0, 1) {
+		return errAlreadyFetching
+	}
 	// Convert the hash set to a retrievable slice
 	hashes := make([]common.Hash, 0, len(request.Hashes))
 	for hash, _ := range request.Hashes {
 		hashes = append(hashes, hash)
 	}
-	p.getBlocks(hashes)
+	p.getNodeData(hashes)
 
 	return nil
 }
 
+// MarkDelivered updates the peer's block delivery latency and throughput statistics
+// with the time elapsed since its last block retrieval request, accumulating the
+// delivered blocks and the time spent in flight.
+func (p *peer) MarkDelivered(blocks int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := p.clock.Now().Sub(p.fetched)
+	throughput := float64(blocks)
+	if elapsed > 0 {
+		throughput /= elapsed.Seconds()
+	}
+	if p.samples == 0 {
+		p.latency, p.throughput = elapsed, throughput
+	} else {
+		p.latency = (3*p.latency + elapsed) / 4
+		p.throughput = (3*p.throughput + throughput) / 4
+	}
+	p.samples++
+	p.blocks += blocks
+	p.deliveries++
+	p.busy += elapsed
+}
+
+// Repeated checks whether a block delivery is identical to the previous one since
+// the last request, returning the number of times it was repeated so far.
+func (p *peer) Repeated(blocks []*types.Block) int {
+	if len(blocks) == 0 {
+		return 0
+	}
+	delivery := deliveryRange{blocks[0].Hash(), blocks[len(blocks)-1].Hash(), len(blocks)}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if delivery != p.delivered {
+		p.delivered, p.repeats = delivery, 0
+		return 0
+	}
+	p.repeats++
+	return p.repeats
+}
+
+// MarkTimeout records a block request of the peer that timed out.
+func (p *peer) MarkTimeout() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.timeouts++
+}
+
+// MarkFailure records an invalid block delivery of the peer.
+func (p *peer) MarkFailure() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failures++
+}
+
+// Latency retrieves the moving average of the peer's block delivery latency, and
+// the number of deliveries it was measured over.
+func (p *peer) Latency() (time.Duration, int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.latency, p.samples
+}
+
+// Stats retrieves a snapshot of the peer's block delivery statistics.
+func (p *peer) Stats() PeerStat {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	stat := PeerStat{
+		Blocks:     p.blocks,
+		Deliveries: p.deliveries,
+		InFlight:   p.busy,
+	}
+	if p.busy > 0 {
+		stat.Throughput = float64(p.blocks) / p.busy.Seconds()
+	}
+	return stat
+}
+
+// SetStateIdle sets the peer to idle, allowing it to execute new state retrieval
+// requests (independent of its block retrieval activity).
+func (p *peer) SetStateIdle() {
+	atomic.StoreInt32(&p.stateIdle, 0)
+}
+
 // SetIdle sets the peer to idle, allowing it to execute new retrieval requests.
 func (p *peer) SetIdle() {
 	atomic.StoreInt32(&p.idle, 0)
@@ -98,14 +383,23 @@ func (p *peer) Demote() {
 // peerSet represents the collection of active peer participating in the block
 // download procedure.
 type peerSet struct {
-	peers map[string]*peer
-	lock  sync.RWMutex
+	peers  map[string]*peer
+	subset map[string]bool // Peers the retrievals are restricted to (nil = all)
+	lent   map[string]bool // Peers lent to secondary range syncs, excluded from the retrievals
+
+	bans      map[string]time.Time   // Expiry times of the peer bans, keyed by peer id
+	demotions map[string][]time.Time // Times of the recent demotions, keyed by peer id
+
+	lock sync.RWMutex
 }
 
 // newPeerSet creates a new peer set top track the active download sources.
 func newPeerSet() *peerSet {
 	return &peerSet{
-		peers: make(map[string]*peer),
+		peers:     make(map[string]*peer),
+		lent:      make(map[string]bool),
+		bans:      make(map[string]time.Time),
+		demotions: make(map[string][]time.Time),
 	}
 }
 
@@ -120,17 +414,187 @@ func (ps *peerSet) Reset() {
 	}
 }
 
+// Forget clears the statistics and reputation of all the known peers, along with
+// any bans and recorded demotions.
+func (ps *peerSet) Forget() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for _, peer := range ps.peers {
+		peer.Forget()
+	}
+	ps.bans = make(map[string]time.Time)
+	ps.demotions = make(map[string][]time.Time)
+}
+
+// Restrict limits the peer listings (and hence all retrievals) to the peers with
+// the given ids, even though any other peers stay registered. A nil list lifts
+// the restriction.
+func (ps *peerSet) Restrict(ids []string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ids == nil {
+		ps.subset = nil
+		return
+	}
+	ps.subset = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		ps.subset[id] = true
+	}
+}
+
+// allowed checks whether a peer is within the restricted subset, if any, and not
+// banned nor lent out. The caller must hold the lock.
+func (ps *peerSet) allowed(p *peer) bool {
+	return (ps.subset == nil || ps.subset[p.id]) && !ps.banned(p.id) && !ps.lent[p.id]
+}
+
+// Lend marks a peer as lent to (or returned from) a secondary range sync, during
+// which it's excluded from the retrievals of the set.
+func (ps *peerSet) Lend(id string, lent bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if lent {
+		ps.lent[id] = true
+	} else {
+		delete(ps.lent, id)
+	}
+}
+
+// banned checks whether a peer is serving a ban cooldown. The caller must hold
+// the lock.
+func (ps *peerSet) banned(id string) bool {
+	expiry, ok := ps.bans[id]
+	return ok && time.Now().Before(expiry)
+}
+
+// Banned checks whether a peer is serving a ban cooldown.
+func (ps *peerSet) Banned(id string) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.banned(id)
+}
+
+// Demote decreases the reputation of a peer, and bans it for the cooldown if it
+// was demoted at least limit times within the window (0 = never ban), dropping
+// it from the set. It returns whether the peer was banned.
+func (ps *peerSet) Demote(p *peer, limit int, window, cooldown time.Duration) bool {
+	p.Demote()
+	if limit <= 0 {
+		return false
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	// Drop the demotions outside the window, and ban the peer if still too many
+	now := time.Now()
+	recent := make([]time.Time, 0, len(ps.demotions[p.id])+1)
+	for _, demoted := range ps.demotions[p.id] {
+		if now.Sub(demoted) < window {
+			recent = append(recent, demoted)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < limit {
+		ps.demotions[p.id] = recent
+		return false
+	}
+	delete(ps.demotions, p.id)
+	ps.bans[p.id] = now.Add(cooldown)
+	if ps.peers[p.id] == p {
+		delete(ps.peers, p.id)
+	}
+	return true
+}
+
+// BannedPeers retrieves the sorted list of the peer ids serving a ban cooldown,
+// forgetting the expired bans.
+func (ps *peerSet) BannedPeers() []string {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ids := make([]string, 0, len(ps.bans))
+	for id, _ := range ps.bans {
+		if ps.banned(id) {
+			ids = append(ids, id)
+		} else {
+			delete(ps.bans, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 // Register injects a new peer into the working set, or returns an error if the
 // peer is already known.
 func (ps *peerSet) Register(p *peer) error {
+	_, err := ps.RegisterCapped(p, 0, false)
+	return err
+}
+
+// RegisterCapped injects a new peer into the working set, unless the set already
+// holds max peers (0 = unlimited). If evict is set, the lowest reputation peer is
+// dropped in favor of the new one instead, returning its id.
+func (ps *peerSet) RegisterCapped(p *peer, max int, evict bool) (string, error) {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
 
+	if ps.banned(p.id) {
+		return "", errBannedPeer
+	}
 	if _, ok := ps.peers[p.id]; ok {
-		return errAlreadyRegistered
+		return "", errAlreadyRegistered
+	}
+	evicted := ""
+	if max > 0 && len(ps.peers) >= max {
+		if !evict {
+			return "", errTooManyPeers
+		}
+		// Find the lowest reputation peer, breaking ties by id for determinism
+		var worst *peer
+		for _, peer := range ps.peers {
+			if worst == nil {
+				worst = peer
+				continue
+			}
+			rep, worstRep := atomic.LoadInt32(&peer.rep), atomic.LoadInt32(&worst.rep)
+			if rep < worstRep || (rep == worstRep && peer.id < worst.id) {
+				worst = peer
+			}
+		}
+		evicted = worst.id
+		delete(ps.peers, evicted)
 	}
 	ps.peers[p.id] = p
-	return nil
+	return evicted, nil
+}
+
+// Replace swaps the entire peer set for the given peers, retaining the already
+// registered entities of the ones present in both. It returns the ids of the
+// dropped peers.
+func (ps *peerSet) Replace(peers []*peer) []string {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	replaced := make(map[string]*peer, len(peers))
+	for _, p := range peers {
+		if old, ok := ps.peers[p.id]; ok {
+			p = old
+		}
+		replaced[p.id] = p
+	}
+	dropped := []string{}
+	for id, _ := range ps.peers {
+		if _, ok := replaced[id]; !ok {
+			dropped = append(dropped, id)
+		}
+	}
+	ps.peers = replaced
+
+	return dropped
 }
 
 // Unregister removes a remote peer from the active set, disabling any further
@@ -162,6 +626,21 @@ func (ps *peerSet) Len() int {
 	return len(ps.peers)
 }
 
+// ActiveLen returns the number of peers taking part in the retrievals, i.e. those
+// within the restricted subset (if any), neither banned nor lent.
+func (ps *peerSet) ActiveLen() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	count := 0
+	for _, p := range ps.peers {
+		if ps.allowed(p) {
+			count++
+		}
+	}
+	return count
+}
+
 // AllPeers retrieves a flat list of all the peers within the set.
 func (ps *peerSet) AllPeers() []*peer {
 	ps.lock.RLock()
@@ -169,11 +648,67 @@ func (ps *peerSet) AllPeers() []*peer {
 
 	list := make([]*peer, 0, len(ps.peers))
 	for _, p := range ps.peers {
-		list = append(list, p)
+		if ps.allowed(p) {
+			list = append(list, p)
+		}
 	}
 	return list
 }
 
+// BestPeers retrieves the list of peers advertising the highest total difficulty
+// within the active peer set.
+func (ps *peerSet) BestPeers() []*peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var best []*peer
+	for _, p := range ps.peers {
+		switch {
+		case !ps.allowed(p):
+		case len(best) == 0 || p.td.Cmp(best[0].td) > 0:
+			best = []*peer{p}
+		case p.td.Cmp(best[0].td) == 0:
+			best = append(best, p)
+		}
+	}
+	return best
+}
+
+// Slow checks whether a peer's average block delivery latency is consistently in
+// the top percentile of the peer set, while also exceeding the median latency by
+// at least the given factor. Only peers with enough measurements are considered.
+func (ps *peerSet) Slow(p *peer, percentile float64, factor float64) bool {
+	latency, samples := p.Latency()
+	if samples < slowPeerSamples {
+		return false
+	}
+	ps.lock.RLock()
+	latencies := make([]time.Duration, 0, len(ps.peers))
+	for _, peer := range ps.peers {
+		if latency, samples := peer.Latency(); samples >= slowPeerSamples {
+			latencies = append(latencies, latency)
+		}
+	}
+	ps.lock.RUnlock()
+
+	if len(latencies) < 2 {
+		return false
+	}
+	sort.Sort(durations(latencies))
+
+	cutoff := latencies[int(percentile*float64(len(latencies)-1))]
+	median := latencies[(len(latencies)-1)/2]
+
+	return latency > cutoff && float64(latency) >= factor*float64(median)
+}
+
+// durations implements sort.Interface to order a list of latencies.
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
 // IdlePeers retrieves a flat list of all the currently idle peers within the
 // active peer set, ordered by their reputation.
 func (ps *peerSet) IdlePeers() []*peer {
@@ -182,10 +717,76 @@ func (ps *peerSet) IdlePeers() []*peer {
 
 	list := make([]*peer, 0, len(ps.peers))
 	for _, p := range ps.peers {
-		if atomic.LoadInt32(&p.idle) == 0 {
+		if atomic.LoadInt32(&p.idle) == 0 && ps.allowed(p) {
 			list = append(list, p)
 		}
 	}
+	sortByReputation(list)
+	return list
+}
+
+// IdlePeersByRTT retrieves a flat list of all the currently idle peers within the
+// active peer set, ordered by their average block delivery round trip time,
+// fastest first (unmeasured peers last).
+func (ps *peerSet) IdlePeersByRTT() []*peer {
+	list := ps.IdlePeers()
+	sortByLatency(list)
+	return list
+}
+
+// BusyPeers retrieves a flat list of all the peers currently fetching blocks,
+// which are able to serve concurrent requests, ordered by their delivery latency,
+// fastest first (unmeasured peers last).
+func (ps *peerSet) BusyPeers() []*peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	list := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		if p.getBlocksWithId != nil && atomic.LoadInt32(&p.idle) == 1 && ps.allowed(p) {
+			list = append(list, p)
+		}
+	}
+	sortByLatency(list)
+	return list
+}
+
+// IdleStatePeers retrieves a flat list of all the peers capable of serving state
+// trie nodes, which are currently idle from that perspective, ordered by their
+// reputation.
+func (ps *peerSet) IdleStatePeers() []*peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	list := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		if p.getNodeData != nil && atomic.LoadInt32(&p.stateIdle) == 0 && ps.allowed(p) {
+			list = append(list, p)
+		}
+	}
+	sortByReputation(list)
+	return list
+}
+
+// sortByLatency orders a list of peers by their block delivery latency, fastest
+// first, moving the peers without any measurements to the end.
+func sortByLatency(list []*peer) {
+	faster := func(a, b *peer) bool {
+		la, sa := a.Latency()
+		lb, sb := b.Latency()
+		return sa > 0 && (sb == 0 || la < lb)
+	}
+	for i := 0; i < len(list); i++ {
+		for j := i + 1; j < len(list); j++ {
+			if faster(list[j], list[i]) {
+				list[i], list[j] = list[j], list[i]
+			}
+		}
+	}
+}
+
+// sortByReputation orders a list of peers by their reputation, best first.
+func sortByReputation(list []*peer) {
 	for i := 0; i < len(list); i++ {
 		for j := i + 1; j < len(list); j++ {
 			if atomic.LoadInt32(&list[i].rep) < atomic.LoadInt32(&list[j].rep) {
@@ -193,5 +794,4 @@ func (ps *peerSet) IdlePeers() []*peer {
 			}
 		}
 	}
-	return list
 }
@@ -0,0 +1,119 @@
+// Contains the live progress reporting of a running synchronisation, either as
+// on-demand snapshots, or streamed periodically into a writer.
+
+package downloader
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+)
+
+// Progress is a snapshot of the state of the current (or last) synchronisation.
+type Progress struct {
+	Peer      string        `json:"peer"`      // Identifier of the peer the sync was started with
+	Head      common.Hash   `json:"head"`      // Hash of the head block the sync targets
+	Active    bool          `json:"active"`    // Whether the sync is still running
+	Pending   int           `json:"pending"`   // Number of blocks pending retrieval
+	InFlight  int           `json:"inflight"`  // Number of block requests currently in flight
+	Throttled bool          `json:"throttled"` // Whether new requests wait for the cached blocks to be processed
+	Cached    int           `json:"cached"`    // Number of downloaded blocks not yet taken
+	Bytes     uint64        `json:"bytes"`     // Total number of bytes received from the peers
+	Elapsed   time.Duration `json:"elapsed"`   // Time elapsed since the sync started
+
+	// Block numbers of the download, mirroring the eth_syncing RPC
+	StartingBlock uint64 `json:"startingBlock"` // Block number the download started from
+	CurrentBlock  uint64 `json:"currentBlock"`  // Block number the download progressed up to (taken blocks)
+	HighestBlock  uint64 `json:"highestBlock"`  // Block number of the highest block to download
+}
+
+// Progress retrieves a snapshot of the state of the current synchronisation.
+func (d *Downloader) Progress() Progress {
+	d.mu.RLock()
+	progress := Progress{
+		Peer:    d.result.Peer,
+		Head:    d.result.Head,
+		Bytes:   d.result.Bytes,
+		Elapsed: time.Since(d.result.Start),
+	}
+	d.mu.RUnlock()
+
+	progress.Active = atomic.LoadInt32(&d.synchronising) == 1
+	progress.Pending, progress.Cached = d.queue.Size()
+	progress.InFlight, progress.Throttled = d.queue.Status()
+	progress.StartingBlock, progress.CurrentBlock, progress.HighestBlock = d.queue.Span()
+
+	return progress
+}
+
+// StreamProgress writes a JSON encoded progress snapshot of the running sync into
+// w every interval, and a final one once the sync terminates, after which w is
+// flushed and closed if it supports it. The writes happen on a goroutine of their
+// own, dropping any snapshots while the writer stalls, so a slow consumer never
+// blocks the sync. A writer stalling permanently however keeps that goroutine
+// alive until its pending write returns.
+func (d *Downloader) StreamProgress(w io.Writer, interval time.Duration) error {
+	// Make sure the downloader is active
+	if atomic.LoadInt32(&d.synchronising) == 0 {
+		return errNoSyncActive
+	}
+	d.mu.RLock()
+	start := d.result.Start
+	d.mu.RUnlock()
+
+	// Start a writer goroutine, consuming the snapshots as fast as w allows
+	snapshots := make(chan Progress, 1)
+	d.resources.spawn(func() {
+		enc := json.NewEncoder(w)
+		for progress := range snapshots {
+			if err := enc.Encode(progress); err != nil {
+				glog.V(logger.Debug).Infof("Failed to stream progress: %v", err)
+			}
+		}
+		if flusher, ok := w.(interface {
+			Flush()
+		}); ok {
+			flusher.Flush()
+		}
+		if closer, ok := w.(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	// Sample the progress periodically, until the sync (or a successive one) ends
+	d.resources.spawn(func() {
+		ticker := d.resources.newTicker(d.clock, interval)
+		defer d.resources.stopTicker(ticker)
+		defer close(snapshots)
+
+		for _ = range ticker.Chan() {
+			progress := d.Progress()
+
+			d.mu.RLock()
+			restarted := d.result.Start != start
+			d.mu.RUnlock()
+
+			if !progress.Active || restarted {
+				// Sync terminated, make sure the final snapshot is delivered
+				if !restarted {
+					select {
+					case <-snapshots:
+					default:
+					}
+					snapshots <- progress
+				}
+				return
+			}
+			select {
+			case snapshots <- progress:
+			default:
+				// Writer stalled, drop the snapshot
+			}
+		}
+	})
+	return nil
+}
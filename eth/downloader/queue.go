@@ -6,6 +6,8 @@ package downloader
 import (
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -18,13 +20,55 @@ import (
 
 const (
 	blockCacheLimit = 1024 // Maximum number of blocks to cache before throttling the download
+	maxGapReport    = 64   // Maximum number of missing block ranges to report
+	maxVerifiers    = 16   // Maximum number of goroutines verifying a delivery concurrently
+	maxPrefetch     = 8    // Maximum number of chunks prefetched beyond the throttle threshold
+	maxOverflow     = 256  // Maximum number of blocks beyond the sync target buffered
 )
 
+// Gap is a range of block numbers (inclusive) not yet downloaded into the cache.
+type Gap struct {
+	FromNumber uint64
+	ToNumber   uint64
+}
+
 // fetchRequest is a currently running block retrieval operation.
 type fetchRequest struct {
+	Id     uint64              // Unique correlation id of the request
 	Peer   *peer               // Peer to which the request was sent
 	Hashes map[common.Hash]int // Requested hashes with their insertion index (priority)
 	Time   time.Time           // Time when the request was made
+
+	Headers bool // Whether only the headers of the blocks were requested
+}
+
+// DeliverResult is the breakdown of a block delivery by the fate of its blocks.
+// Duplicates are benign (e.g. overlapping retries), whereas rejected blocks were
+// not requested or are invalid, indicating a misbehaving peer.
+type DeliverResult struct {
+	Accepted  int // Number of distinct blocks credited to the reservation
+	Duplicate int // Number of blocks already downloaded before
+	Rejected  int // Number of blocks not requested, invalid or not mapping to their slot
+}
+
+// indexedHash is a scheduled hash along with its insertion index (priority).
+type indexedHash struct {
+	hash  common.Hash
+	index int
+}
+
+// hashesByIndex orders scheduled hashes by their insertion index, descending.
+type hashesByIndex []indexedHash
+
+func (h hashesByIndex) Len() int           { return len(h) }
+func (h hashesByIndex) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hashesByIndex) Less(i, j int) bool { return h[i].index > h[j].index }
+
+// overflowBlock is a block delivered beyond the target of a sync, buffered along
+// with its origin peer for a follow-up sync.
+type overflowBlock struct {
+	block *types.Block
+	peer  string
 }
 
 // queue represents hashes that are either need fetching or are being fetched
@@ -32,12 +76,46 @@ type queue struct {
 	hashPool    map[common.Hash]int // Pending hashes, mapping to their insertion index (priority)
 	hashQueue   *prque.Prque        // Priority queue of the block hashes to fetch
 	hashCounter int                 // Counter indexing the added hashes to ensure retrieval order
+	headCounter int                 // Counter indexing the extending hashes, scheduled after all others
 
-	pendPool map[string]*fetchRequest // Currently pending block retrieval operations
+	pendPool   map[string]*fetchRequest // Currently pending block retrieval operations
+	extraPool  map[uint64]*fetchRequest // Additional concurrent retrievals of busy peers, keyed by request id
+	requestIds uint64                   // Counter assigning the correlation ids of the requests
 
 	blockPool   map[common.Hash]int // Hash-set of the downloaded data blocks, mapping to cache indexes
 	blockCache  []*types.Block      // Downloaded but not yet delivered blocks
 	blockOffset int                 // Offset of the first cached block in the block-chain
+	allocLimit  int                 // Maximum number of blocks the cache may be allocated for (0 = blockCacheLimit)
+	maxQueued   int                 // Hard ceiling on the cached and in-flight blocks (0 = unlimited)
+	prefetch    int                 // Number of blocks fetched beyond the throttle threshold
+
+	blockPeer map[common.Hash]string // Origin peers of the cached (and already taken) blocks of the sync
+	taken     int                    // Number of blocks taken from the cache since the last reset
+
+	overflow       map[common.Hash]overflowBlock // Blocks delivered beyond the sync target, kept across resets
+	bufferOverflow bool                          // Whether blocks beyond the sync target are buffered or dropped
+
+	descending bool // Whether the newest blocks are scheduled first, anchoring the cache at the chain top
+	blockBase  int  // Number of the oldest block to download in descending mode
+	blockStart int  // Number of the first block to download, as of the initial allocation
+
+	capacity    int // Current capacity of the adaptive block cache (0 = fixed at blockCacheLimit)
+	capacityMin int // Capacity the adaptive block cache starts each sync with
+	capacityMax int // Capacity the adaptive block cache may grow up to
+
+	pool   *MemoryPool // Optional shared memory budget to account the cached blocks against
+	memory uint64      // Number of bytes the cached blocks are accounted for in the pool
+
+	maxFuture time.Duration // Allowance of block timestamps ahead of the local clock (0 = unlimited)
+
+	verifyPoW     func(*types.Block) bool // Optional proof-of-work verifier of the delivered blocks
+	verifySample  int                     // Verify only one in every this many blocks (0, 1 = all)
+	verifyWorkers int                     // Number of goroutines verifying a delivery concurrently (0, 1 = inline)
+
+	persist func(*types.Block) error // Optional hook persisting the accepted blocks before caching them
+
+	scheduler Scheduler // Optional strategy selecting the hashes to reserve (nil = sequential)
+	clock     clock     // Source of the request times, expiring the reservations
 
 	lock sync.RWMutex
 }
@@ -48,7 +126,11 @@ func newQueue() *queue {
 		hashPool:  make(map[common.Hash]int),
 		hashQueue: prque.New(),
 		pendPool:  make(map[string]*fetchRequest),
+		extraPool: make(map[uint64]*fetchRequest),
 		blockPool: make(map[common.Hash]int),
+		blockPeer: make(map[common.Hash]string),
+		overflow:  make(map[common.Hash]overflowBlock),
+		clock:     realClock{},
 	}
 }
 
@@ -60,12 +142,24 @@ func (q *queue) Reset() {
 	q.hashPool = make(map[common.Hash]int)
 	q.hashQueue.Reset()
 	q.hashCounter = 0
+	q.headCounter = 0
 
 	q.pendPool = make(map[string]*fetchRequest)
+	q.extraPool = make(map[uint64]*fetchRequest)
 
 	q.blockPool = make(map[common.Hash]int)
+	q.blockPeer = make(map[common.Hash]string)
+	q.taken = 0
 	q.blockOffset = 0
+	q.blockBase = 0
+	q.blockStart = 0
 	q.blockCache = nil
+	q.capacity = q.capacityMin
+
+	if q.pool != nil {
+		q.pool.Release(q.memory)
+	}
+	q.memory = 0
 }
 
 // Size retrieves the number of hashes in the queue, returning separately for
@@ -85,12 +179,185 @@ func (q *queue) Pending() int {
 	return q.hashQueue.Size()
 }
 
+// PendingHashes retrieves a copy of the hashes queued for download, which are
+// neither in flight nor delivered yet, ordered by their block numbers ascending.
+func (q *queue) PendingHashes() []common.Hash {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	// Collect the hashes of all the requests currently in flight
+	inflight := make(map[common.Hash]bool)
+	for _, request := range q.pendPool {
+		for hash, _ := range request.Hashes {
+			inflight[hash] = true
+		}
+	}
+	for _, request := range q.extraPool {
+		for hash, _ := range request.Hashes {
+			inflight[hash] = true
+		}
+	}
+	// Gather the remaining scheduled hashes, ordering them by their priority
+	pending := make(hashesByIndex, 0, len(q.hashPool))
+	for hash, index := range q.hashPool {
+		if !inflight[hash] {
+			pending = append(pending, indexedHash{hash, index})
+		}
+	}
+	sort.Sort(pending)
+
+	// Higher priorities are scheduled first, being the older blocks, unless the
+	// newest blocks are fetched first
+	hashes := make([]common.Hash, len(pending))
+	for i, entry := range pending {
+		if q.descending {
+			hashes[len(pending)-1-i] = entry.hash
+		} else {
+			hashes[i] = entry.hash
+		}
+	}
+	return hashes
+}
+
 // InFlight retrieves the number of fetch requests currently in flight.
 func (q *queue) InFlight() int {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
 
-	return len(q.pendPool)
+	return len(q.pendPool) + len(q.extraPool)
+}
+
+// Span retrieves the number of the block the download started from (i.e. the
+// local head at the time), the number of the block the download progressed up
+// to by taking blocks from the cache, and the number of the highest block to
+// download. Without any allocation, all three are zero.
+func (q *queue) Span() (starting, current, highest uint64) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.span()
+}
+
+// span is the lock free version of Span. The caller must hold the queue lock.
+func (q *queue) span() (starting, current, highest uint64) {
+	if q.blockStart > 0 {
+		starting = uint64(q.blockStart - 1)
+	}
+	current, highest = starting+uint64(q.taken), starting
+	if total := len(q.hashPool) + len(q.blockPool) + q.taken; total > 0 {
+		highest = uint64(q.blockStart + total - 1)
+	}
+	return starting, current, highest
+}
+
+// Taken retrieves the number of blocks taken from the cache since the last reset.
+func (q *queue) Taken() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.taken
+}
+
+// Memory retrieves the number of bytes the cached blocks are accounted for in
+// the shared memory pool.
+func (q *queue) Memory() uint64 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.memory
+}
+
+// Capacity retrieves the number of blocks the cache may currently hold.
+func (q *queue) Capacity() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.cacheLimit()
+}
+
+// cacheLimit retrieves the current capacity of the block cache, either adaptive
+// or fixed. The caller must hold the queue lock.
+func (q *queue) cacheLimit() int {
+	if q.capacity > 0 {
+		return q.capacity
+	}
+	return blockCacheLimit
+}
+
+// cacheSize retrieves the number of blocks the cache may be allocated for, being
+// its capacity extended by the prefetch window. The caller must hold the lock.
+func (q *queue) cacheSize() int {
+	return q.cacheLimit() + q.prefetch
+}
+
+// setCapacity enables the adaptive block cache, starting out with min blocks and
+// growing up to max blocks. A zero max disables it.
+func (q *queue) setCapacity(min, max int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if max <= 0 {
+		min, max = 0, 0
+	} else if min <= 0 || min > max {
+		if min = maxBlockFetch; min > max {
+			min = max
+		}
+	}
+	q.capacityMin, q.capacityMax, q.capacity = min, max, min
+}
+
+// Grow doubles the capacity of an adaptive block cache (within its bounds), if
+// the cache space is exhausted mostly by in-flight requests, i.e. the network
+// delivers faster than the cache can buffer. If it's exhausted by downloaded
+// blocks not yet taken, the consumer is the bottleneck and growing wouldn't
+// help. Returns whether the capacity grew.
+func (q *queue) Grow() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	max := q.capacityMax
+	if q.allocLimit > 0 && q.allocLimit < max {
+		max = q.allocLimit
+	}
+	if q.capacity == 0 || q.capacity >= max {
+		return false
+	}
+	// Calculate the currently in-flight block requests
+	pending := q.inFlightBlocks()
+	// Only grow under throttle pressure dominated by the in-flight blocks
+	if pending < len(q.blockCache)-len(q.blockPool) || 2*pending < len(q.blockCache) {
+		return false
+	}
+	if q.capacity *= 2; q.capacity > max {
+		q.capacity = max
+	}
+	size := len(q.hashPool) + len(q.blockPool)
+	if limit := q.cacheSize(); size > limit {
+		size = limit
+	}
+	if q.allocLimit > 0 && size > q.allocLimit {
+		size = q.allocLimit
+	}
+	if len(q.blockCache) < size {
+		// In descending mode the cache is anchored at the top, grow it downwards
+		if q.descending {
+			q.blockOffset -= size - len(q.blockCache)
+			q.blockCache = append(make([]*types.Block, size-len(q.blockCache)), q.blockCache...)
+		} else {
+			q.blockCache = append(q.blockCache, make([]*types.Block, size-len(q.blockCache))...)
+		}
+	}
+	return true
+}
+
+// Status retrieves the number of fetch requests currently in flight, along with
+// whether the download is throttled, both taken under a single lock so they are
+// consistent with each other.
+func (q *queue) Status() (int, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return len(q.pendPool) + len(q.extraPool), q.throttle()
 }
 
 // Throttle checks if the download should be throttled (active block fetches
@@ -99,13 +366,74 @@ func (q *queue) Throttle() bool {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
 
+	return q.throttle()
+}
+
+// throttle checks if the download should be throttled. The caller must hold the
+// lock.
+func (q *queue) throttle() bool {
 	// Calculate the currently in-flight block requests
+	pending := q.inFlightBlocks()
+	// Throttle if more blocks are in-flight than free space in the cache, not
+	// counting the prefetch window beyond its capacity
+	window := len(q.blockCache)
+	if limit := q.cacheLimit(); window > limit {
+		window = limit
+	}
+	if pending >= window-len(q.blockPool) || q.queueFull(pending) {
+		return true
+	}
+	// Throttle if the in-flight blocks would exhaust the shared memory budget,
+	// estimating their sizes based on the average of the already cached ones
+	if q.pool != nil {
+		estimate := uint64(0)
+		if len(q.blockPool) > 0 {
+			estimate = q.memory / uint64(len(q.blockPool)) * uint64(pending)
+		}
+		return q.pool.Exhausted(estimate)
+	}
+	return false
+}
+
+// queueFull checks whether the cached and the given number of in-flight blocks
+// reached the hard ceiling of queued blocks. The caller must hold the lock.
+func (q *queue) queueFull(pending int) bool {
+	return q.maxQueued > 0 && len(q.blockPool)+pending >= q.maxQueued
+}
+
+// inFlightBlocks counts the blocks of all the requests currently in flight. The
+// caller must hold the lock.
+func (q *queue) inFlightBlocks() int {
 	pending := 0
 	for _, request := range q.pendPool {
 		pending += len(request.Hashes)
 	}
-	// Throttle if more blocks are in-flight than free space in the cache
-	return pending >= len(q.blockCache)-len(q.blockPool)
+	for _, request := range q.extraPool {
+		pending += len(request.Hashes)
+	}
+	return pending
+}
+
+// Saturated checks if the download must be stopped even within the prefetch
+// window, because the in-flight blocks would overflow the entire allocated cache
+// or exhaust the shared memory budget. Without a prefetch window, it's the same
+// as Throttle.
+func (q *queue) Saturated() bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	pending := q.inFlightBlocks()
+	if pending >= len(q.blockCache)-len(q.blockPool) || q.queueFull(pending) {
+		return true
+	}
+	if q.pool != nil {
+		estimate := uint64(0)
+		if len(q.blockPool) > 0 {
+			estimate = q.memory / uint64(len(q.blockPool)) * uint64(pending)
+		}
+		return q.pool.Exhausted(estimate)
+	}
+	return false
 }
 
 // Has checks if a hash is within the download queue or not.
@@ -127,9 +455,13 @@ func (q *queue) Insert(hashes []common.Hash) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	// Insert all the hashes prioritized in the arrival order
+	// Insert all the hashes prioritized in the arrival order (reversed if the
+	// newest blocks are scheduled first)
 	for i, hash := range hashes {
 		index := q.hashCounter + i
+		if q.descending {
+			index = -index
+		}
 
 		if old, ok := q.hashPool[hash]; ok {
 			glog.V(logger.Warn).Infof("Hash %x already scheduled at index %v", hash, old)
@@ -142,6 +474,30 @@ func (q *queue) Insert(hashes []common.Hash) {
 	q.hashCounter += len(hashes)
 }
 
+// Extend adds a set of hashes newer than all the already queued ones (e.g. after
+// the sync target advanced), scheduling them after all the existing ones.
+func (q *queue) Extend(hashes []common.Hash) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// Insert all the hashes with priorities below any previously inserted one (or
+	// above in descending mode)
+	for i, hash := range hashes {
+		index := q.headCounter - len(hashes) + i
+		if q.descending {
+			index = -index
+		}
+
+		if old, ok := q.hashPool[hash]; ok {
+			glog.V(logger.Warn).Infof("Hash %x already scheduled at index %v", hash, old)
+			continue
+		}
+		q.hashPool[hash] = index
+		q.hashQueue.Push(hash, float32(index))
+	}
+	q.headCounter -= len(hashes)
+}
+
 // GetHeadBlock retrieves the first block from the cache, or nil if it hasn't
 // been downloaded yet (or simply non existent).
 func (q *queue) GetHeadBlock() *types.Block {
@@ -171,25 +527,148 @@ func (q *queue) GetBlock(hash common.Hash) *types.Block {
 	return nil
 }
 
+// Contiguous retrieves the number of blocks available for taking, starting from
+// the head of the cache.
+func (q *queue) Contiguous() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	count := 0
+	for _, block := range q.blockCache {
+		if block == nil {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// FirstMissing retrieves the number of the lowest block in the cache range which
+// hasn't been downloaded yet, or false if there's no such block.
+func (q *queue) FirstMissing() (uint64, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	for i, block := range q.blockCache {
+		if block == nil {
+			return uint64(q.blockOffset + i), true
+		}
+	}
+	return 0, false
+}
+
+// Gaps retrieves the ranges of blocks not yet downloaded, starting from the head
+// of the cache up to the last scheduled block. At most maxGapReport ranges are
+// returned, the last one covering everything missing beyond the previous ones.
+func (q *queue) Gaps() []Gap {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.gaps()
+}
+
+// gaps collects the ranges of blocks not yet downloaded. The caller must hold
+// the queue lock.
+func (q *queue) gaps() []Gap {
+	// Count the scheduled blocks, all of which are contiguous from the cache head
+	span := len(q.hashPool)
+	for _, block := range q.blockCache {
+		if block != nil {
+			span++
+		}
+	}
+	// Collect the missing ranges, the ones beyond the cache being a single one
+	gaps := []Gap{}
+	add := func(from, to uint64) {
+		if n := len(gaps); n > 0 && (gaps[n-1].ToNumber+1 == from || n == maxGapReport) {
+			gaps[n-1].ToNumber = to
+			return
+		}
+		gaps = append(gaps, Gap{FromNumber: from, ToNumber: to})
+	}
+	for i := 0; i < span && i < len(q.blockCache); i++ {
+		if q.blockCache[i] == nil {
+			add(uint64(q.blockOffset+i), uint64(q.blockOffset+i))
+		}
+	}
+	if span > len(q.blockCache) {
+		add(uint64(q.blockOffset+len(q.blockCache)), uint64(q.blockOffset+span-1))
+	}
+	return gaps
+}
+
+// ContiguousSize retrieves the total size of the blocks available for taking,
+// starting from the head of the cache.
+func (q *queue) ContiguousSize() common.StorageSize {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	size := common.StorageSize(0)
+	for _, block := range q.blockCache {
+		if block == nil {
+			break
+		}
+		size += block.Size()
+	}
+	return size
+}
+
 // TakeBlocks retrieves and permanently removes a batch of blocks from the cache.
 // The head parameter is required to prevent a race condition where concurrent
 // takes may fail parent verifications.
 func (q *queue) TakeBlocks(head *types.Block) types.Blocks {
+	blocks, _ := q.TakeBlocksWithOrigins(head)
+	return blocks
+}
+
+// TakeBlocksN retrieves and permanently removes a batch of at most max blocks
+// from the cache, leaving the rest of them in place for a successive take.
+func (q *queue) TakeBlocksN(head *types.Block, max int) types.Blocks {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	blocks, _ := q.take(head, max)
+	return blocks
+}
+
+// TakeBlocksWithOrigins retrieves and permanently removes a batch of blocks from
+// the cache, along with the ids of the peers that delivered each of them.
+func (q *queue) TakeBlocksWithOrigins(head *types.Block) (types.Blocks, []string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.take(head, 0)
+}
+
+// take retrieves and removes a batch of at most max blocks from the cache (zero
+// meaning no limit), along with the ids of the peers that delivered them. The
+// caller must hold the lock.
+func (q *queue) take(head *types.Block, max int) (types.Blocks, []string) {
+	if q.descending {
+		return q.takeRecent(head, max)
+	}
 	// Short circuit if the head block's different
 	if len(q.blockCache) == 0 || q.blockCache[0] != head {
-		return nil
+		return nil, nil
 	}
 	// Otherwise accumulate all available blocks
-	var blocks types.Blocks
+	var (
+		blocks  types.Blocks
+		origins []string
+	)
 	for _, block := range q.blockCache {
-		if block == nil {
+		if block == nil || (max > 0 && len(blocks) >= max) {
 			break
 		}
 		blocks = append(blocks, block)
+		origins = append(origins, q.blockPeer[block.Hash()])
 		delete(q.blockPool, block.Hash())
+
+		if q.pool != nil {
+			size := uint64(block.Size())
+			q.pool.Release(size)
+			q.memory -= size
+		}
 	}
 	// Delete the blocks from the slice and let them be garbage collected
 	// without this slice trick the blocks would stay in memory until nil
@@ -199,8 +678,100 @@ func (q *queue) TakeBlocks(head *types.Block) types.Blocks {
 		q.blockCache[k] = nil
 	}
 	q.blockOffset += len(blocks)
+	q.taken += len(blocks)
+	q.adoptOverflow()
 
-	return blocks
+	return blocks, origins
+}
+
+// takeRecent retrieves and removes the newest contiguous run of blocks from the
+// cache in descending mode, sliding the cache window down towards the older ones.
+// If head is set, the run is only taken if it reaches down to it, linking up with
+// the local chain. If max is set, only the newest max blocks of the run are taken,
+// unless it's linking up with the local chain, which is only taken whole. The
+// caller must hold the queue lock.
+func (q *queue) takeRecent(head *types.Block, max int) (types.Blocks, []string) {
+	// Find the newest contiguous run of blocks
+	start := len(q.blockCache)
+	for start > 0 && q.blockCache[start-1] != nil {
+		start--
+	}
+	if start == len(q.blockCache) || (head != nil && (start != 0 || q.blockCache[0] != head)) {
+		return nil, nil
+	}
+	// Only take the newest blocks of the run if limited
+	if max > 0 && len(q.blockCache)-start > max {
+		if head != nil {
+			return nil, nil
+		}
+		start = len(q.blockCache) - max
+	}
+	blocks := make(types.Blocks, 0, len(q.blockCache)-start)
+	origins := make([]string, 0, len(q.blockCache)-start)
+	for _, block := range q.blockCache[start:] {
+		blocks = append(blocks, block)
+		origins = append(origins, q.blockPeer[block.Hash()])
+		delete(q.blockPool, block.Hash())
+
+		if q.pool != nil {
+			size := uint64(block.Size())
+			q.pool.Release(size)
+			q.memory -= size
+		}
+	}
+	// Slide the cache window down, without reaching below the oldest block
+	copy(q.blockCache[len(blocks):], q.blockCache[:start])
+	for k := 0; k < len(blocks); k++ {
+		q.blockCache[k] = nil
+	}
+	q.blockOffset -= len(blocks)
+	if q.blockOffset < q.blockBase {
+		q.blockCache = q.blockCache[q.blockBase-q.blockOffset:]
+		q.blockOffset = q.blockBase
+	}
+	q.taken += len(blocks)
+	q.adoptOverflow()
+
+	return blocks, origins
+}
+
+// Duplicates counts the blocks of a delivery which were already downloaded, being
+// either still cached, or taken from the queue already (outside the cache window).
+func (q *queue) Duplicates(blocks []*types.Block) int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	duplicates := 0
+	for _, block := range blocks {
+		if q.downloaded(block) {
+			duplicates++
+		}
+	}
+	return duplicates
+}
+
+// downloaded checks whether a block was already downloaded, being either still
+// cached, or taken from the queue already. The caller must hold the lock.
+func (q *queue) downloaded(block *types.Block) bool {
+	number := int(block.NumberU64())
+	known := number < q.blockOffset
+	if q.descending {
+		known = number >= q.blockOffset+len(q.blockCache)
+	}
+	_, cached := q.blockPool[block.Hash()]
+	return cached || known
+}
+
+// BlockSource retrieves the id of the peer that delivered a block of the current
+// sync, either still cached or already taken. The attribution is retained until
+// the queue is reset for the next sync. The flag reports whether the block is
+// known at all.
+func (q *queue) BlockSource(hash common.Hash) (string, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	id, ok := q.blockPeer[hash]
+	return id, ok
 }
 
 // Reserve reserves a set of hashes for the given peer, skipping any previously
@@ -217,16 +788,102 @@ func (q *queue) Reserve(p *peer, max int) *fetchRequest {
 	if _, ok := q.pendPool[p.id]; ok {
 		return nil
 	}
+	request := q.reserve(p, max)
+	if request != nil {
+		q.pendPool[p.id] = request
+	}
+	return request
+}
+
+// ReserveHeaders reserves a set of hashes for the given peer just like Reserve,
+// but marks the request as retrieving only the headers of the blocks. Deliveries
+// answering it are cached as header-only blocks, any bodies being dropped.
+func (q *queue) ReserveHeaders(p *peer, max int) *fetchRequest {
+	request := q.Reserve(p, max)
+	if request != nil {
+		request.Headers = true
+	}
+	return request
+}
+
+// ReserveExtra reserves an additional set of hashes for a peer already busy
+// downloading, as long as it has less than limit requests in flight.
+func (q *queue) ReserveExtra(p *peer, max int, limit int) *fetchRequest {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// Short circuit if the pool has been depleted, or if the peer's not yet
+	// downloading anything (it should get a normal reservation first)
+	if q.hashQueue.Empty() {
+		return nil
+	}
+	if _, ok := q.pendPool[p.id]; !ok {
+		return nil
+	}
+	requests := 1
+	for _, request := range q.extraPool {
+		if request.Peer.id == p.id {
+			requests++
+		}
+	}
+	if requests >= limit {
+		return nil
+	}
+	request := q.reserve(p, max)
+	if request != nil {
+		q.extraPool[request.Id] = request
+	}
+	return request
+}
+
+// reserve assembles a new fetch request of at most max hashes for the given peer,
+// skipping any previously failed download. The caller must hold the lock and
+// file the request into the appropriate pending pool.
+func (q *queue) reserve(p *peer, max int) *fetchRequest {
+	// Cap the reservation at the room left below the queued block ceiling
+	if q.maxQueued > 0 {
+		if room := q.maxQueued - len(q.blockPool) - q.inFlightBlocks(); room < max {
+			max = room
+		}
+		if max <= 0 {
+			return nil
+		}
+	}
 	// Retrieve a batch of hashes, skipping previously failed ones
 	send := make(map[common.Hash]int)
 	skip := make(map[common.Hash]int)
 
-	for len(send) < max && !q.hashQueue.Empty() {
-		hash, priority := q.hashQueue.Pop()
-		if p.ignored.Has(hash) {
+	if q.scheduler == nil {
+		for len(send) < max && !q.hashQueue.Empty() {
+			hash, priority := q.hashQueue.Pop()
+			if _, ok := q.hashPool[hash.(common.Hash)]; !ok {
+				continue // Already filled from the overflow buffer
+			}
+			if p.ignored.Has(hash) {
+				skip[hash.(common.Hash)] = int(priority)
+			} else {
+				send[hash.(common.Hash)] = int(priority)
+			}
+		}
+	} else {
+		// Collect a window of candidates and let the scheduler choose from them
+		candidates, offered := make([]common.Hash, 0, max), make(map[common.Hash]bool)
+		for len(candidates) < scheduleWindow && !q.hashQueue.Empty() {
+			hash, priority := q.hashQueue.Pop()
+			if _, ok := q.hashPool[hash.(common.Hash)]; !ok {
+				continue // Already filled from the overflow buffer
+			}
 			skip[hash.(common.Hash)] = int(priority)
-		} else {
-			send[hash.(common.Hash)] = int(priority)
+			if !p.ignored.Has(hash) {
+				candidates = append(candidates, hash.(common.Hash))
+				offered[hash.(common.Hash)] = true
+			}
+		}
+		for _, hash := range q.scheduler.Select(p.id, candidates, max) {
+			if index, ok := skip[hash]; ok && offered[hash] && len(send) < max {
+				send[hash] = index
+				delete(skip, hash)
+			}
 		}
 	}
 	// Merge all the skipped hashes back
@@ -237,13 +894,13 @@ func (q *queue) Reserve(p *peer, max int) *fetchRequest {
 	if len(send) == 0 {
 		return nil
 	}
+	q.requestIds++
 	request := &fetchRequest{
+		Id:     q.requestIds,
 		Peer:   p,
 		Hashes: send,
-		Time:   time.Now(),
+		Time:   q.clock.Now(),
 	}
-	q.pendPool[p.id] = request
-
 	return request
 }
 
@@ -255,7 +912,33 @@ func (q *queue) Cancel(request *fetchRequest) {
 	for hash, index := range request.Hashes {
 		q.hashQueue.Push(hash, float32(index))
 	}
-	delete(q.pendPool, request.Peer.id)
+	if _, ok := q.extraPool[request.Id]; ok {
+		delete(q.extraPool, request.Id)
+	} else {
+		delete(q.pendPool, request.Peer.id)
+	}
+}
+
+// Revoke cancels all the fetch requests of a peer, returning their pending hashes
+// to the queue.
+func (q *queue) Revoke(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if request := q.pendPool[id]; request != nil {
+		for hash, index := range request.Hashes {
+			q.hashQueue.Push(hash, float32(index))
+		}
+		delete(q.pendPool, id)
+	}
+	for reqId, request := range q.extraPool {
+		if request.Peer.id == id {
+			for hash, index := range request.Hashes {
+				q.hashQueue.Push(hash, float32(index))
+			}
+			delete(q.extraPool, reqId)
+		}
+	}
 }
 
 // Expire checks for in flight requests that exceeded a timeout allowance,
@@ -267,7 +950,7 @@ func (q *queue) Expire(timeout time.Duration) []string {
 	// Iterate over the expired requests and return each to the queue
 	peers := []string{}
 	for id, request := range q.pendPool {
-		if time.Since(request.Time) > timeout {
+		if q.clock.Now().Sub(request.Time) > timeout {
 			for hash, index := range request.Hashes {
 				q.hashQueue.Push(hash, float32(index))
 			}
@@ -278,20 +961,75 @@ func (q *queue) Expire(timeout time.Duration) []string {
 	for _, id := range peers {
 		delete(q.pendPool, id)
 	}
+	for id, request := range q.extraPool {
+		if q.clock.Now().Sub(request.Time) > timeout {
+			for hash, index := range request.Hashes {
+				q.hashQueue.Push(hash, float32(index))
+			}
+			peers = append(peers, request.Peer.id)
+			delete(q.extraPool, id)
+		}
+	}
 	return peers
 }
 
-// Deliver injects a block retrieval response into the download queue.
-func (q *queue) Deliver(id string, blocks []*types.Block) (err error) {
+// Requested checks whether the given request is the one currently pending at the
+// peer, i.e. neither expired nor already answered.
+func (q *queue) Requested(id string, request uint64) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if extra := q.extraPool[request]; extra != nil {
+		return extra.Peer.id == id
+	}
+	pending := q.pendPool[id]
+	return pending != nil && pending.Id == request
+}
+
+// Busy checks whether the peer has its primary block request still in flight.
+func (q *queue) Busy(id string) bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	_, ok := q.pendPool[id]
+	return ok
+}
+
+// Deliver injects a block retrieval response into the download queue, returning
+// the breakdown of the delivered blocks.
+func (q *queue) Deliver(id string, blocks []*types.Block) (DeliverResult, error) {
+	return q.DeliverRequest(id, 0, blocks)
+}
+
+// DeliverRequest injects a block retrieval response answering a specific request
+// of a peer into the download queue. Unless the request id matches one of the
+// peer's additional concurrent requests, the response is credited to its primary
+// one. It returns the breakdown of the delivered blocks into the ones credited to
+// the reservation, the already downloaded duplicates and the rejected ones. If
+// the reservation was only partially filled, the unfilled portion is returned to
+// the queue, re-requestable just like any other pending hash.
+func (q *queue) DeliverRequest(id string, requestId uint64, blocks []*types.Block) (result DeliverResult, err error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
 	// Short circuit if the blocks were never requested
-	request := q.pendPool[id]
-	if request == nil {
-		return errors.New("no fetches pending")
+	request := q.extraPool[requestId]
+	if request != nil && request.Peer.id == id {
+		delete(q.extraPool, requestId)
+	} else {
+		if request = q.pendPool[id]; request == nil {
+			// Nothing to credit, but don't blame the peer for late duplicates
+			for _, block := range blocks {
+				if q.downloaded(block) {
+					result.Duplicate++
+				} else {
+					result.Rejected++
+				}
+			}
+			return result, errors.New("no fetches pending")
+		}
+		delete(q.pendPool, id)
 	}
-	delete(q.pendPool, id)
 
 	// If no blocks were retrieved, mark them as unavailable for the origin peer
 	if len(blocks) == 0 {
@@ -299,52 +1037,322 @@ func (q *queue) Deliver(id string, blocks []*types.Block) (err error) {
 			request.Peer.ignored.Add(hash)
 		}
 	}
-	// Iterate over the downloaded blocks and add each of them
-	errs := make([]error, 0)
-	for _, block := range blocks {
-		// Skip any blocks that fall outside the cache range
+	// Verify the proof-of-work of the blocks (concurrently if requested), and
+	// iterate over the downloaded blocks adding each of them
+	valid := q.verifyBlocks(blocks)
+
+	errs, poisoned, overflown := make([]error, 0), false, false
+	for i, block := range blocks {
+		// Drop any blocks too far in the future, the peer will not have better ones
+		if q.maxFuture > 0 && block.Time() > q.clock.Now().Add(q.maxFuture).Unix() {
+			request.Peer.ignored.Add(block.Hash())
+			errs = append(errs, fmt.Errorf("%v: %v", errFutureBlock, block.Hash()))
+			result.Rejected++
+			continue
+		}
+		// Skip any blocks that fall outside the cache range, unless a requested block
+		// precedes the cache, which indicates an inconsistent offset
 		index := int(block.NumberU64()) - q.blockOffset
+		if _, ok := request.Hashes[block.Hash()]; ok && index < 0 {
+			glog.V(logger.Debug).Infof("Requested block #%d below cache offset %d", block.NumberU64(), q.blockOffset)
+			request.Peer.ignored.Add(block.Hash())
+			poisoned = true
+			result.Rejected++
+			continue
+		}
+		// Reject any requested blocks numbered beyond the sync target, the peer sent a
+		// block that can't possibly be the one requested
+		if _, ok := request.Hashes[block.Hash()]; ok && q.beyondTip(block) {
+			glog.V(logger.Debug).Infof("Requested block #%d [%x] overflows sync target #%d", block.NumberU64(), block.Hash().Bytes()[:4], q.tip())
+			request.Peer.ignored.Add(block.Hash())
+			overflown = true
+			result.Rejected++
+			continue
+		}
+		// Reject any requested blocks not matching the number expected from their
+		// position in the hash chain, catching offsets shifting the blocks into
+		// wrong (yet empty) slots
+		if slot, ok := request.Hashes[block.Hash()]; ok && int(block.NumberU64()) != q.expected(slot) {
+			glog.V(logger.Debug).Infof("Requested block #%d [%x] mismatches expected #%d", block.NumberU64(), block.Hash().Bytes()[:4], q.expected(slot))
+			request.Peer.ignored.Add(block.Hash())
+			poisoned = true
+			result.Rejected++
+			continue
+		}
 		if index >= len(q.blockCache) || index < 0 {
 			//fmt.Printf("block cache overflown (N=%v O=%v, C=%v)", block.Number(), q.blockOffset, len(q.blockCache))
+			if index >= 0 && q.bufferOverflow && q.beyondTip(block) && len(q.overflow) < maxOverflow {
+				q.overflow[block.Hash()] = overflowBlock{block, id}
+			}
+			if q.downloaded(block) {
+				result.Duplicate++
+			}
 			continue
 		}
-		// Skip any blocks that were not requested
+		// Skip any blocks that were not requested, tolerating already downloaded ones
 		hash := block.Hash()
 		if _, ok := request.Hashes[hash]; !ok {
+			if q.downloaded(block) {
+				result.Duplicate++
+				continue
+			}
 			errs = append(errs, fmt.Errorf("non-requested block %v", hash))
+			result.Rejected++
+			continue
+		}
+		// Make sure the slot is not already occupied by a different block
+		if prev := q.blockCache[index]; prev != nil && prev.Hash() != hash {
+			glog.V(logger.Debug).Infof("Block #%d [%x] collides with cached [%x]", block.NumberU64(), hash[:4], prev.Hash().Bytes()[:4])
+			request.Peer.ignored.Add(hash)
+			poisoned = true
+			result.Rejected++
+			continue
+		}
+		// Skip any blocks already filled in meanwhile (i.e. from the overflow buffer)
+		if q.blockCache[index] != nil {
+			delete(request.Hashes, hash)
+			result.Duplicate++
+			continue
+		}
+		// Drop any blocks with an invalid proof-of-work (randomly sampled if requested)
+		if !valid[i] {
+			request.Peer.ignored.Add(hash)
+			errs = append(errs, fmt.Errorf("%v: %v", errInvalidPoW, hash))
+			result.Rejected++
 			continue
 		}
 		// Otherwise merge the block and mark the hash block
-		q.blockCache[index] = block
-
+		if request.Headers && (len(block.Transactions()) > 0 || len(block.Uncles()) > 0) {
+			stripped := types.NewBlockWithHeader(block.Header())
+			stripped.HeaderHash, stripped.ParentHeaderHash = block.HeaderHash, block.ParentHeaderHash
+			block = stripped
+		}
+		// Persist the block if requested, leaving it to be re-requested on failure
+		if q.persist != nil {
+			if err := q.persist(block); err != nil {
+				errs = append(errs, fmt.Errorf("failed to persist block %v: %v", hash, err))
+				result.Rejected++
+				continue
+			}
+		}
 		delete(request.Hashes, hash)
-		delete(q.hashPool, hash)
-		q.blockPool[hash] = int(block.NumberU64())
+		q.cache(index, block, id)
+		result.Accepted++
+	}
+	// Return all failed (or unfilled) fetches to the queue
+	if len(request.Hashes) > 0 && result.Accepted > 0 {
+		glog.V(logger.Detail).Infof("Peer %s filled %d of %d reserved blocks", id, result.Accepted, result.Accepted+len(request.Hashes))
 	}
-	// Return all failed fetches to the queue
 	for hash, index := range request.Hashes {
 		q.hashQueue.Push(hash, float32(index))
 	}
+	if poisoned {
+		return result, errInvalidSlot
+	}
+	if overflown {
+		return result, errBlockNumberOverflow
+	}
 	if len(errs) != 0 {
-		return fmt.Errorf("multiple failures: %v", errs)
+		return result, fmt.Errorf("multiple failures: %v", errs)
 	}
-	return nil
+	return result, nil
+}
+
+// cache merges a downloaded block into its slot of the cache, marking its hash
+// done. The caller must hold the lock.
+func (q *queue) cache(index int, block *types.Block, id string) {
+	q.blockCache[index] = block
+	if q.pool != nil {
+		size := uint64(block.Size())
+		q.pool.Acquire(size)
+		q.memory += size
+	}
+	hash := block.Hash()
+
+	delete(q.hashPool, hash)
+	q.blockPool[hash] = int(block.NumberU64())
+	q.blockPeer[hash] = id
+}
+
+// expected retrieves the number a block is expected to have, given the insertion
+// index of its hash: the hashes are scheduled newest first, the oldest of them
+// following the offset the cache was initially allocated at. The caller must
+// hold the lock.
+func (q *queue) expected(index int) int {
+	if q.descending {
+		index = -index
+	}
+	return q.blockStart + q.hashCounter - 1 - index
+}
+
+// tip retrieves the number of the newest block of the sync target. The caller
+// must hold the lock.
+func (q *queue) tip() int {
+	return q.blockOffset + len(q.hashPool) + len(q.blockPool) - 1
+}
+
+// beyondTip checks whether a block is numbered beyond the target of the sync,
+// i.e. the chain advanced during the sync. It's not tracked in descending mode,
+// where the already taken blocks are the newest ones. The caller must hold the
+// lock.
+func (q *queue) beyondTip(block *types.Block) bool {
+	return !q.descending && len(q.blockCache) > 0 && int(block.NumberU64()) > q.tip()
+}
+
+// BeyondTip counts the blocks of a delivery which are numbered beyond the target
+// of the sync.
+func (q *queue) BeyondTip(blocks []*types.Block) int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	overflown := 0
+	for _, block := range blocks {
+		if q.beyondTip(block) {
+			overflown++
+		}
+	}
+	return overflown
+}
+
+// adoptOverflow merges any buffered overflow blocks, which were scheduled since
+// (e.g. by a follow-up sync) and fit into the cache, as if they were delivered
+// now. The caller must hold the lock.
+func (q *queue) adoptOverflow() {
+	for hash, overflown := range q.overflow {
+		if _, ok := q.hashPool[hash]; !ok {
+			continue
+		}
+		index := int(overflown.block.NumberU64()) - q.blockOffset
+		if index < 0 || index >= len(q.blockCache) || q.blockCache[index] != nil {
+			continue
+		}
+		// Drop the buffered block if it can't be persisted, it'll be requested anew
+		if q.persist != nil {
+			if err := q.persist(overflown.block); err != nil {
+				glog.V(logger.Debug).Infof("Failed to persist overflown block #%d [%x]: %v", overflown.block.NumberU64(), hash[:4], err)
+				delete(q.overflow, hash)
+				continue
+			}
+		}
+		q.cache(index, overflown.block, overflown.peer)
+		delete(q.overflow, hash)
+	}
+}
+
+// verifyBlocks checks the proof-of-work of a batch of delivered blocks (randomly
+// sampled if requested), spreading the verifications over the configured number
+// of worker goroutines. The results retain the order of the blocks.
+func (q *queue) verifyBlocks(blocks []*types.Block) []bool {
+	valid := make([]bool, len(blocks))
+
+	// Select the blocks to verify, accepting all the others right away
+	tasks := make([]int, 0, len(blocks))
+	for i := range blocks {
+		if q.verifyPoW != nil && (q.verifySample <= 1 || rand.Intn(q.verifySample) == 0) {
+			tasks = append(tasks, i)
+		} else {
+			valid[i] = true
+		}
+	}
+	workers := q.verifyWorkers
+	if workers > maxVerifiers {
+		workers = maxVerifiers
+	}
+	if workers > len(tasks) {
+		workers = len(tasks)
+	}
+	if workers <= 1 {
+		for _, i := range tasks {
+			valid[i] = q.verifyPoW(blocks[i])
+		}
+		return valid
+	}
+	// Feed the verification tasks to a pool of workers and wait for them to finish
+	taskCh := make(chan int, len(tasks))
+	for _, i := range tasks {
+		taskCh <- i
+	}
+	close(taskCh)
+
+	var pend sync.WaitGroup
+	pend.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer pend.Done()
+			for i := range taskCh {
+				valid[i] = q.verifyPoW(blocks[i])
+			}
+		}()
+	}
+	pend.Wait()
+
+	return valid
 }
 
 // Alloc ensures that the block cache is the correct size, given a starting
-// offset, and a memory cap.
-func (q *queue) Alloc(offset int) {
+// offset, and a memory cap. If the cache would need to grow beyond the configured
+// allocation limit, nothing is allocated and errAllocLimit is returned.
+func (q *queue) Alloc(offset int) error {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
-	if q.blockOffset < offset {
-		q.blockOffset = offset
+	total := len(q.hashPool) + len(q.blockPool)
+	size := total
+	if limit := q.cacheLimit(); size > limit {
+		size = limit
 	}
-	size := len(q.hashPool)
-	if size > blockCacheLimit {
-		size = blockCacheLimit
+	if q.allocLimit > 0 && size > q.allocLimit {
+		return errAllocLimit
 	}
-	if len(q.blockCache) < size {
-		q.blockCache = append(q.blockCache, make([]*types.Block, size-len(q.blockCache))...)
+	// Extend the cache by the prefetch window, within the allocation limit
+	if size < total && q.prefetch > 0 {
+		if size += q.prefetch; size > total {
+			size = total
+		}
+		if q.allocLimit > 0 && size > q.allocLimit {
+			size = q.allocLimit
+		}
+	}
+	if len(q.blockCache) == 0 && q.taken == 0 {
+		q.blockStart = offset
+	}
+	if q.descending {
+		q.allocRecent(offset, size)
+	} else {
+		if q.blockOffset < offset {
+			q.blockOffset = offset
+		}
+		if len(q.blockCache) < size {
+			q.blockCache = append(q.blockCache, make([]*types.Block, size-len(q.blockCache))...)
+		}
 	}
+	q.adoptOverflow()
+	return nil
+}
+
+// allocRecent sizes the block cache in descending mode, anchoring its window at
+// the newest block to download. If the chain was extended since the last call,
+// the window is moved up, dropping any empty slots at its bottom beyond size. The
+// caller must hold the queue lock.
+func (q *queue) allocRecent(offset int, size int) {
+	total := len(q.hashPool) + len(q.blockPool)
+	if len(q.blockCache) == 0 {
+		q.blockBase = offset
+		q.blockOffset = offset + total - size
+	}
+	if top := q.blockBase + total; top > q.blockOffset+len(q.blockCache) {
+		q.blockCache = append(q.blockCache, make([]*types.Block, top-q.blockOffset-len(q.blockCache))...)
+	}
+	for len(q.blockCache) > size && q.blockCache[0] == nil {
+		q.blockCache = q.blockCache[1:]
+		q.blockOffset++
+	}
+}
+
+// Allocated retrieves the number of blocks the cache is currently allocated for.
+func (q *queue) Allocated() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return len(q.blockCache)
 }
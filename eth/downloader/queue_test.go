@@ -1,7 +1,11 @@
 package downloader
 
 import (
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -59,3 +63,720 @@ func TestChunking(t *testing.T) {
 		t.Error("expected chunk1 hashes to be 1, got", len(chunk2.Hashes))
 	}
 }
+
+func TestMemoryPoolAccounting(t *testing.T) {
+	hashes := createHashes(0, 9)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.pool = NewMemoryPool(1024 * 1024)
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Download a single block and make sure it's accounted for
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	request := queue.Reserve(peer, 1)
+	if request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	for hash, _ := range request.Hashes {
+		if _, err := queue.Deliver(peer.id, []*types.Block{blocks[hash]}); err != nil {
+			t.Fatalf("failed to deliver block: %v", err)
+		}
+	}
+	if queue.Memory() == 0 || queue.Memory() != queue.pool.Used() {
+		t.Fatalf("memory accounting mismatch: queue %v, pool %v", queue.Memory(), queue.pool.Used())
+	}
+	if queue.Throttle() {
+		t.Fatalf("throttled with sufficient memory budget")
+	}
+	// Exhaust the shared budget by another consumer and check throttling
+	queue.pool.Acquire(queue.pool.Limit())
+	if !queue.Throttle() {
+		t.Fatalf("not throttled with exhausted memory budget")
+	}
+	// Reset the queue and ensure its memory is returned to the pool
+	queue.Reset()
+	if queue.Memory() != 0 || queue.pool.Used() != queue.pool.Limit() {
+		t.Fatalf("memory not released: queue %v, pool %v", queue.Memory(), queue.pool.Used())
+	}
+}
+
+func TestFutureBlockDropping(t *testing.T) {
+	hashes := createHashes(0, 2)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.maxFuture = time.Minute
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Push one of the blocks far into the future and deliver both
+	future := blocks[hashes[0]]
+	future.Header().Time = uint64(time.Now().Add(time.Hour).Unix())
+
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	if request := queue.Reserve(peer, 2); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	if _, err := queue.Deliver(peer.id, []*types.Block{blocks[hashes[0]], blocks[hashes[1]]}); err == nil {
+		t.Fatalf("future block accepted")
+	}
+	if queue.GetBlock(hashes[0]) != nil {
+		t.Fatalf("future block cached")
+	}
+	if queue.GetBlock(hashes[1]) == nil {
+		t.Fatalf("valid block dropped")
+	}
+	if !peer.ignored.Has(hashes[0]) || queue.Pending() != 1 {
+		t.Fatalf("future block not rescheduled from a different peer")
+	}
+}
+
+func TestFutureBlockClock(t *testing.T) {
+	hashes := createHashes(0, 1)
+	blocks := createBlocksFromHashes(hashes)
+
+	clock := newFakeClock()
+	queue := newQueue()
+	queue.clock = clock
+	queue.maxFuture = time.Minute
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Stamp the block ahead of the queue's clock, but well in the wall clock's past
+	block := blocks[hashes[0]]
+	block.Header().Time = uint64(clock.Now().Add(2 * time.Minute).Unix())
+
+	first := newPeer("first", common.Hash{}, nil, nil)
+	if request := queue.Reserve(first, 1); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	if _, err := queue.Deliver(first.id, []*types.Block{block}); err == nil {
+		t.Fatalf("future block accepted")
+	}
+	// Advance the clock until the block falls within the allowance and redeliver
+	clock.Advance(time.Minute + time.Second)
+
+	second := newPeer("second", common.Hash{}, nil, nil)
+	if request := queue.Reserve(second, 1); request == nil {
+		t.Fatalf("failed to reserve the rescheduled chunk")
+	}
+	if _, err := queue.Deliver(second.id, []*types.Block{block}); err != nil {
+		t.Fatalf("block within the allowance rejected: %v", err)
+	}
+	if queue.GetBlock(hashes[0]) == nil {
+		t.Fatalf("block within the allowance not cached")
+	}
+}
+
+func TestInvalidPoWDropping(t *testing.T) {
+	hashes := createHashes(0, 2)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.verifyPoW = func(block *types.Block) bool { return block.Hash() != hashes[0] }
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Deliver both blocks, one of which carries an invalid proof-of-work
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	if request := queue.Reserve(peer, 2); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	if _, err := queue.Deliver(peer.id, []*types.Block{blocks[hashes[0]], blocks[hashes[1]]}); err == nil {
+		t.Fatalf("invalid proof-of-work accepted")
+	}
+	if queue.GetBlock(hashes[0]) != nil {
+		t.Fatalf("invalid block cached")
+	}
+	if queue.GetBlock(hashes[1]) == nil {
+		t.Fatalf("valid block dropped")
+	}
+	if !peer.ignored.Has(hashes[0]) || queue.Pending() != 1 {
+		t.Fatalf("invalid block not rescheduled from a different peer")
+	}
+}
+
+func TestDuplicateDelivery(t *testing.T) {
+	hashes := createHashes(0, 4)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Download the first chunk, and redeliver one of its blocks with the second
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	deliver := func(extra ...*types.Block) (DeliverResult, error) {
+		request := queue.Reserve(peer, 2)
+		if request == nil {
+			t.Fatalf("failed to reserve a chunk")
+		}
+		delivery := extra
+		for hash, _ := range request.Hashes {
+			delivery = append(delivery, blocks[hash])
+		}
+		return queue.Deliver(peer.id, delivery)
+	}
+	first, err := deliver()
+	if err != nil || first.Accepted != 2 {
+		t.Fatalf("failed to deliver first chunk: %+v, %v", first, err)
+	}
+	var dup *types.Block
+	for _, hash := range hashes[:4] {
+		if queue.GetBlock(hash) != nil {
+			dup = blocks[hash]
+			break
+		}
+	}
+	second, err := deliver(dup)
+	if err != nil {
+		t.Fatalf("duplicate block failed the delivery: %v", err)
+	}
+	if second != (DeliverResult{Accepted: 2, Duplicate: 1}) {
+		t.Fatalf("delivery breakdown mismatch: have %+v, want %+v", second, DeliverResult{Accepted: 2, Duplicate: 1})
+	}
+	// Late duplicates without a pending request aren't deemed rejected either
+	late, err := queue.Deliver(peer.id, []*types.Block{dup})
+	if err == nil || late != (DeliverResult{Duplicate: 1}) {
+		t.Fatalf("late duplicate breakdown mismatch: have %+v (%v), want %+v", late, err, DeliverResult{Duplicate: 1})
+	}
+	// Never downloaded blocks however are rejected
+	bogus := createBlock(3, knownHash, common.HexToHash("0xdeadbeef"))
+	if result, err := queue.Deliver(peer.id, []*types.Block{bogus}); err == nil || result.Rejected != 1 {
+		t.Fatalf("non-requested block not rejected: %+v, %v", result, err)
+	}
+}
+
+func TestGapReporting(t *testing.T) {
+	hashes := createHashes(0, 10)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Deliver every other block, leaving single block gaps in between
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	if request := queue.Reserve(peer, len(hashes)); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	delivery := []*types.Block{}
+	for _, hash := range hashes[:len(hashes)-1] {
+		if blocks[hash].NumberU64()%2 == 1 {
+			delivery = append(delivery, blocks[hash])
+		}
+	}
+	queue.Deliver(peer.id, delivery)
+
+	gaps := queue.Gaps()
+	if len(gaps) != 5 {
+		t.Fatalf("gap count mismatch: have %d, want %d (%v)", len(gaps), 5, gaps)
+	}
+	for i, gap := range gaps {
+		if want := uint64(2 * (i + 1)); gap.FromNumber != want || gap.ToNumber != want {
+			t.Errorf("gap %d mismatch: have %v, want [%d-%d]", i, gap, want, want)
+		}
+	}
+}
+
+// reverseScheduler is a test scheduling strategy assigning the candidates in
+// reverse order, also trying to sneak in a hash never offered.
+type reverseScheduler struct{}
+
+func (reverseScheduler) Select(peer string, candidates []common.Hash, max int) []common.Hash {
+	selected := []common.Hash{{0xff}}
+	for i := len(candidates) - 1; i >= 0 && len(selected) <= max; i-- {
+		selected = append(selected, candidates[i])
+	}
+	return selected
+}
+
+func TestCustomScheduler(t *testing.T) {
+	hashes := createHashes(0, 10)
+
+	queue := newQueue()
+	queue.scheduler = reverseScheduler{}
+	queue.Insert(hashes[:len(hashes)-1])
+
+	// Reserve a chunk and ensure the scheduler's selection was honored
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	request := queue.Reserve(peer, 3)
+	if request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	if len(request.Hashes) != 3 {
+		t.Fatalf("reserved hash count mismatch: have %d, want %d", len(request.Hashes), 3)
+	}
+	for _, hash := range hashes[:3] {
+		if _, ok := request.Hashes[hash]; !ok {
+			t.Errorf("hash %x not reserved", hash[:4])
+		}
+	}
+	if queue.Pending() != len(hashes)-1-3 {
+		t.Fatalf("pending hash count mismatch: have %d, want %d", queue.Pending(), len(hashes)-1-3)
+	}
+}
+
+func TestAllocLimit(t *testing.T) {
+	hashes := createHashes(0, 65)
+
+	// An excessive offset should not affect the allocation size
+	queue := newQueue()
+	queue.allocLimit = 64
+	queue.Insert(hashes[:64])
+	if err := queue.Alloc(1 << 30); err != nil {
+		t.Fatalf("failed to allocate cache: %v", err)
+	}
+	if alloc := queue.Allocated(); alloc != 64 {
+		t.Fatalf("allocation mismatch: have %v, want %v", alloc, 64)
+	}
+	// A chain requiring more than the limit should be refused
+	queue = newQueue()
+	queue.allocLimit = 64
+	queue.Insert(hashes)
+	if err := queue.Alloc(1 << 30); err != errAllocLimit {
+		t.Fatalf("allocation error mismatch: have %v, want %v", err, errAllocLimit)
+	}
+	if alloc := queue.Allocated(); alloc != 0 {
+		t.Fatalf("refused allocation performed: %v blocks", alloc)
+	}
+}
+
+func TestConcurrentPoWVerification(t *testing.T) {
+	hashes := createHashes(0, 64)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Reject every third block, tracking the concurrent verifications
+	var active, peak int32
+	queue := newQueue()
+	queue.verifyWorkers = 4
+	queue.verifyPoW = func(block *types.Block) bool {
+		if n := atomic.AddInt32(&active, 1); n > atomic.LoadInt32(&peak) {
+			atomic.StoreInt32(&peak, n)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+
+		return block.NumberU64()%3 != 0
+	}
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	request := queue.Reserve(peer, len(hashes))
+	if request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	delivery := make([]*types.Block, 0, len(request.Hashes))
+	for hash, _ := range request.Hashes {
+		delivery = append(delivery, blocks[hash])
+	}
+	queue.Deliver(peer.id, delivery)
+
+	for _, hash := range hashes[:len(hashes)-1] {
+		valid := blocks[hash].NumberU64()%3 != 0
+		if cached := queue.GetBlock(hash) != nil; cached != valid {
+			t.Errorf("block #%d: cached %v, valid %v", blocks[hash].NumberU64(), cached, valid)
+		}
+	}
+	if peak := atomic.LoadInt32(&peak); peak < 2 || peak > 4 {
+		t.Errorf("concurrent verification mismatch: have %d, want 2-4", peak)
+	}
+}
+
+func TestPoisonedOffset(t *testing.T) {
+	hashes := createHashes(0, 4)
+	blocks := createBlocksFromHashes(hashes)
+
+	// Allocate the cache with an offset beyond the oldest pending block
+	queue := newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(4)
+
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	if request := queue.Reserve(peer, len(hashes)); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	delivery := []*types.Block{blocks[hashes[0]], blocks[hashes[1]], blocks[hashes[2]]}
+	if _, err := queue.Deliver(peer.id, delivery); err != errInvalidSlot {
+		t.Fatalf("poisoned offset error mismatch: have %v, want %v", err, errInvalidSlot)
+	}
+	if !peer.ignored.Has(hashes[2]) {
+		t.Fatalf("misplaced block not rescheduled from a different peer")
+	}
+	// Allocate the cache with an offset below the oldest pending block, shifting
+	// all the blocks into higher, empty slots
+	queue = newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(1)
+
+	peer = newPeer("peer", common.Hash{}, nil, nil)
+	if request := queue.Reserve(peer, len(hashes)); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	if result, err := queue.Deliver(peer.id, delivery); err != errInvalidSlot || result.Accepted != 0 {
+		t.Fatalf("shifted offset result mismatch: have %d/%v, want 0/%v", result.Accepted, err, errInvalidSlot)
+	}
+	for _, hash := range hashes[:len(hashes)-1] {
+		if queue.GetBlock(hash) != nil {
+			t.Fatalf("shifted block %x cached", hash[:4])
+		}
+	}
+	// Deliver a block claiming the slot of an already cached one
+	queue = newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	peer = newPeer("peer", common.Hash{}, nil, nil)
+	if request := queue.Reserve(peer, len(hashes)); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	impostor := createBlock(int(blocks[hashes[0]].NumberU64()), knownHash, hashes[1])
+	if _, err := queue.Deliver(peer.id, []*types.Block{blocks[hashes[0]], impostor}); err != errInvalidSlot {
+		t.Fatalf("slot collision error mismatch: have %v, want %v", err, errInvalidSlot)
+	}
+	if queue.GetBlock(hashes[0]) == nil || queue.GetBlock(hashes[1]) != nil {
+		t.Fatalf("slot collision corrupted the cache")
+	}
+}
+
+func TestAdaptiveCapacity(t *testing.T) {
+	hashes := createHashes(0, 4*blockCacheLimit)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.setCapacity(maxBlockFetch, 4*maxBlockFetch)
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	if capacity := queue.Capacity(); capacity != maxBlockFetch {
+		t.Fatalf("initial capacity mismatch: have %d, want %d", capacity, maxBlockFetch)
+	}
+	// Fill the cache with in-flight requests, and ensure it grows up to the bound
+	for i, want := range []int{2, 4, 4} {
+		peer := newPeer(fmt.Sprintf("peer%d", i), common.Hash{}, nil, nil)
+		if request := queue.Reserve(peer, maxBlockFetch); request == nil {
+			t.Fatalf("round %d: failed to reserve a chunk", i)
+		}
+		queue.Grow()
+		if capacity := queue.Capacity(); capacity != want*maxBlockFetch {
+			t.Fatalf("round %d: capacity mismatch: have %d, want %d", i, capacity, want*maxBlockFetch)
+		}
+		if alloc := queue.Allocated(); alloc != want*maxBlockFetch {
+			t.Fatalf("round %d: allocation mismatch: have %d, want %d", i, alloc, want*maxBlockFetch)
+		}
+	}
+	// Reset the queue, and ensure a cache full of untaken blocks doesn't grow
+	queue.Reset()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	request := queue.Reserve(peer, maxBlockFetch)
+	if request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	delivery := []*types.Block{}
+	for hash, _ := range request.Hashes {
+		delivery = append(delivery, blocks[hash])
+	}
+	if _, err := queue.Deliver(peer.id, delivery); err != nil {
+		t.Fatalf("failed to deliver blocks: %v", err)
+	}
+	if !queue.Throttle() {
+		t.Fatalf("full cache not throttled")
+	}
+	if queue.Grow() || queue.Capacity() != maxBlockFetch {
+		t.Fatalf("cache of untaken blocks grown to %d", queue.Capacity())
+	}
+}
+
+func TestDescendingFetch(t *testing.T) {
+	hashes := createHashes(0, 3*maxBlockFetch)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.descending = true
+	queue.setCapacity(2*maxBlockFetch, 2*maxBlockFetch)
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Download the chain chunk by chunk, and ensure the newest runs come first
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	for i := 0; i < 3; i++ {
+		request := queue.Reserve(peer, maxBlockFetch)
+		if request == nil {
+			t.Fatalf("chunk %d: failed to reserve", i)
+		}
+		delivery := []*types.Block{}
+		for hash, _ := range request.Hashes {
+			delivery = append(delivery, blocks[hash])
+		}
+		if _, err := queue.Deliver(peer.id, delivery); err != nil {
+			t.Fatalf("chunk %d: failed to deliver blocks: %v", i, err)
+		}
+		took := queue.TakeBlocks(nil)
+		if len(took) != maxBlockFetch {
+			t.Fatalf("chunk %d: taken block count mismatch: have %d, want %d", i, len(took), maxBlockFetch)
+		}
+		for j, block := range took {
+			if want := uint64((3-i)*maxBlockFetch - maxBlockFetch + 2 + j); block.NumberU64() != want {
+				t.Fatalf("chunk %d, block %d: number mismatch: have %d, want %d", i, j, block.NumberU64(), want)
+			}
+		}
+	}
+	if pending, cached := queue.Size(); pending != 0 || cached != 0 {
+		t.Fatalf("queue not drained: %d pending, %d cached", pending, cached)
+	}
+}
+
+func TestPendingHashes(t *testing.T) {
+	hashes := createHashes(0, 10)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, descending := range []bool{false, true} {
+		queue := newQueue()
+		queue.descending = descending
+		queue.Insert(hashes[:len(hashes)-1])
+		queue.Alloc(2)
+
+		// Download a chunk and keep another one in flight
+		peer, busy := newPeer("peer", common.Hash{}, nil, nil), newPeer("busy", common.Hash{}, nil, nil)
+		request := queue.Reserve(peer, 3)
+		if request == nil {
+			t.Fatalf("descending %v: failed to reserve a chunk", descending)
+		}
+		delivery := []*types.Block{}
+		for hash, _ := range request.Hashes {
+			delivery = append(delivery, blocks[hash])
+		}
+		if _, err := queue.Deliver(peer.id, delivery); err != nil {
+			t.Fatalf("descending %v: failed to deliver blocks: %v", descending, err)
+		}
+		if request := queue.Reserve(busy, 3); request == nil {
+			t.Fatalf("descending %v: failed to reserve a chunk", descending)
+		}
+		// Ensure only the untouched hashes are reported, ordered by block number
+		want := []common.Hash{hashes[3], hashes[2], hashes[1], hashes[0]}
+		if descending {
+			want = []common.Hash{hashes[9], hashes[8], hashes[7], hashes[6]}
+		}
+		pending := queue.PendingHashes()
+		if len(pending) != len(want) {
+			t.Fatalf("descending %v: pending hash count mismatch: have %d, want %d", descending, len(pending), len(want))
+		}
+		for i, hash := range pending {
+			if hash != want[i] {
+				t.Fatalf("descending %v: pending hash %d mismatch: have %x, want %x", descending, i, hash[:4], want[i][:4])
+			}
+		}
+	}
+}
+
+func TestPrefetchWindow(t *testing.T) {
+	hashes := createHashes(0, 2*blockCacheLimit)
+
+	queue := newQueue()
+	queue.prefetch = prefetchBlocks(2)
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	if alloc := queue.Allocated(); alloc != blockCacheLimit+2*maxBlockFetch {
+		t.Fatalf("allocation mismatch: have %d, want %d", alloc, blockCacheLimit+2*maxBlockFetch)
+	}
+	// Reserve chunks until throttled, and ensure the prefetch window remains usable
+	reserve := func(i int) {
+		if request := queue.Reserve(newPeer(fmt.Sprintf("peer%d", i), common.Hash{}, nil, nil), maxBlockFetch); request == nil {
+			t.Fatalf("chunk %d: failed to reserve", i)
+		}
+	}
+	chunks := blockCacheLimit / maxBlockFetch
+	for i := 0; i < chunks; i++ {
+		reserve(i)
+	}
+	if !queue.Throttle() {
+		t.Fatalf("full cache not throttled")
+	}
+	for i := chunks; i < chunks+2; i++ {
+		if queue.Saturated() {
+			t.Fatalf("chunk %d: prefetch window saturated", i)
+		}
+		reserve(i)
+	}
+	if !queue.Saturated() {
+		t.Fatalf("exhausted prefetch window not saturated")
+	}
+	// Ensure the window is bounded
+	if blocks := prefetchBlocks(100); blocks != maxPrefetch*maxBlockFetch {
+		t.Fatalf("prefetch window mismatch: have %d, want %d", blocks, maxPrefetch*maxBlockFetch)
+	}
+}
+
+func TestPartialReservationFill(t *testing.T) {
+	hashes := createHashes(0, 10)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Reserve a chunk of blocks, and deliver only half of them
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	request := queue.Reserve(peer, 10)
+	if request == nil || len(request.Hashes) != 10 {
+		t.Fatalf("failed to reserve the chunk: %v", request)
+	}
+	delivery, unfilled := []*types.Block{}, make(map[common.Hash]bool)
+	for hash, _ := range request.Hashes {
+		if len(delivery) < 5 {
+			delivery = append(delivery, blocks[hash])
+		} else {
+			unfilled[hash] = true
+		}
+	}
+	result, err := queue.DeliverRequest(peer.id, 0, delivery)
+	if err != nil {
+		t.Fatalf("failed to deliver partial chunk: %v", err)
+	}
+	if result.Accepted != 5 {
+		t.Fatalf("credited block count mismatch: have %d, want %d", result.Accepted, 5)
+	}
+	// Ensure the unfilled half is pending again, re-requestable even from the same peer
+	if pending, cached := queue.Size(); pending != 5 || cached != 5 {
+		t.Fatalf("queue size mismatch: have %d/%d pending/cached, want %d/%d", pending, cached, 5, 5)
+	}
+	if inflight := queue.InFlight(); inflight != 0 {
+		t.Fatalf("partially filled reservation still in flight")
+	}
+	request = queue.Reserve(peer, 10)
+	if request == nil || len(request.Hashes) != 5 {
+		t.Fatalf("failed to reserve the unfilled portion: %v", request)
+	}
+	for hash, _ := range request.Hashes {
+		if !unfilled[hash] {
+			t.Fatalf("re-reserved hash %x not unfilled", hash[:4])
+		}
+	}
+}
+
+func TestPersistFailure(t *testing.T) {
+	hashes := createHashes(0, 10)
+	blocks := createBlocksFromHashes(hashes)
+
+	queue := newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	// Fail persisting one of the blocks, and make sure it's not cached
+	persisted, failing := make(map[common.Hash]bool), hashes[4]
+	queue.persist = func(block *types.Block) error {
+		if block.Hash() == failing {
+			return errors.New("disk full")
+		}
+		persisted[block.Hash()] = true
+		return nil
+	}
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	request := queue.Reserve(peer, 10)
+	if request == nil || len(request.Hashes) != 10 {
+		t.Fatalf("failed to reserve the chunk: %v", request)
+	}
+	delivery := make([]*types.Block, 0, len(request.Hashes))
+	for hash, _ := range request.Hashes {
+		delivery = append(delivery, blocks[hash])
+	}
+	result, err := queue.DeliverRequest(peer.id, 0, delivery)
+	if err == nil {
+		t.Fatalf("failed persist not reported")
+	}
+	if result.Accepted != 9 || result.Rejected != 1 {
+		t.Fatalf("delivery result mismatch: have %d/%d accepted/rejected, want %d/%d", result.Accepted, result.Rejected, 9, 1)
+	}
+	if len(persisted) != 9 || persisted[failing] {
+		t.Fatalf("persisted block mismatch: have %d, failing included: %v", len(persisted), persisted[failing])
+	}
+	if queue.GetBlock(failing) != nil {
+		t.Fatalf("unpersisted block cached")
+	}
+	// Ensure the failed block is re-requestable, even from the same peer
+	request = queue.Reserve(peer, 10)
+	if request == nil || len(request.Hashes) != 1 {
+		t.Fatalf("failed to reserve the unpersisted block: %v", request)
+	}
+	if _, ok := request.Hashes[failing]; !ok {
+		t.Fatalf("re-reserved hash mismatch")
+	}
+}
+
+func TestOverflowBuffering(t *testing.T) {
+	// Create a chain, the older half of which is synced, while the peer already
+	// delivers some of the newer half too
+	hashes := createHashes(0, 20)
+	blocks := createBlocksFromHashes(hashes)
+
+	for _, buffer := range []bool{false, true} {
+		queue := newQueue()
+		queue.bufferOverflow = buffer
+		queue.Insert(hashes[10:20])
+		queue.Alloc(2)
+
+		peer := newPeer("peer", common.Hash{}, nil, nil)
+		request := queue.Reserve(peer, 10)
+		if request == nil {
+			t.Fatalf("buffer %v: failed to reserve a chunk", buffer)
+		}
+		delivery := []*types.Block{}
+		for hash, _ := range request.Hashes {
+			delivery = append(delivery, blocks[hash])
+		}
+		for _, hash := range hashes[5:10] {
+			delivery = append(delivery, blocks[hash])
+		}
+		if overflown := queue.BeyondTip(delivery); overflown != 5 {
+			t.Fatalf("buffer %v: overflown block count mismatch: have %d, want %d", buffer, overflown, 5)
+		}
+		if result, err := queue.DeliverRequest(peer.id, 0, delivery); err != nil || result.Accepted != 10 {
+			t.Fatalf("buffer %v: overflowing delivery failed: %d credited, %v", buffer, result.Accepted, err)
+		}
+		if took := queue.TakeBlocks(blocks[hashes[19]]); len(took) != 10 {
+			t.Fatalf("buffer %v: taken block count mismatch: have %d, want %d", buffer, len(took), 10)
+		}
+		// Schedule a follow-up sync, and ensure any buffered blocks are filled in
+		queue.Reset()
+		queue.Insert(hashes[:10])
+		queue.Alloc(12)
+
+		want := 0
+		if buffer {
+			want = 5
+		}
+		if pending, cached := queue.Size(); pending != 10-want || cached != want {
+			t.Fatalf("buffer %v: queue size mismatch: have %d/%d pending/cached, want %d/%d", buffer, pending, cached, 10-want, want)
+		}
+		if request := queue.Reserve(peer, 10); request == nil || len(request.Hashes) != 10-want {
+			t.Fatalf("buffer %v: follow-up reservation mismatch: %v", buffer, request)
+		}
+	}
+}
+
+func TestThrottleStatus(t *testing.T) {
+	hashes := createHashes(0, 10)
+
+	queue := newQueue()
+	queue.Insert(hashes[:len(hashes)-1])
+	queue.Alloc(2)
+
+	if inflight, throttled := queue.Status(); inflight != 0 || throttled {
+		t.Fatalf("idle status mismatch: have %d/%v, want %d/%v", inflight, throttled, 0, false)
+	}
+	// Reserve the entire cache and ensure the status reports the throttling
+	peer := newPeer("peer", common.Hash{}, nil, nil)
+	if request := queue.Reserve(peer, 10); request == nil {
+		t.Fatalf("failed to reserve a chunk")
+	}
+	if inflight, throttled := queue.Status(); inflight != 1 || !throttled {
+		t.Fatalf("throttled status mismatch: have %d/%v, want %d/%v", inflight, throttled, 1, true)
+	}
+}
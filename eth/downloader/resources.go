@@ -0,0 +1,80 @@
+// Contains the accounting of the resources allocated by the synchronisation,
+// allowing to verify that none of them are leaked after a sync terminates.
+
+package downloader
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ResourceStats is a snapshot of the live resources allocated by the sync.
+type ResourceStats struct {
+	Goroutines int // Number of running goroutines started by the downloader
+	Timers     int // Number of active timers and tickers
+	Channels   int // Number of per-sync channels still in use
+}
+
+// resourceTracker counts the resources allocated by the sync machinery. All the
+// operations are simple atomic counters, so the production overhead is minimal.
+type resourceTracker struct {
+	goroutines int32
+	timers     int32
+	channels   int32
+}
+
+// newTimer creates a new tracked timer of the given clock, which must be released
+// via stopTimer.
+func (r *resourceTracker) newTimer(c clock, d time.Duration) timer {
+	atomic.AddInt32(&r.timers, 1)
+	return c.NewTimer(d)
+}
+
+// stopTimer stops a tracked timer, releasing it.
+func (r *resourceTracker) stopTimer(timer timer) {
+	timer.Stop()
+	atomic.AddInt32(&r.timers, -1)
+}
+
+// newTicker creates a new tracked ticker of the given clock, which must be
+// released via stopTicker.
+func (r *resourceTracker) newTicker(c clock, d time.Duration) ticker {
+	atomic.AddInt32(&r.timers, 1)
+	return c.NewTicker(d)
+}
+
+// stopTicker stops a tracked ticker, releasing it.
+func (r *resourceTracker) stopTicker(ticker ticker) {
+	ticker.Stop()
+	atomic.AddInt32(&r.timers, -1)
+}
+
+// newCancelCh creates a new tracked cancellation channel, which must be released
+// via releaseChannel once nobody listens on it any more.
+func (r *resourceTracker) newCancelCh() chan struct{} {
+	atomic.AddInt32(&r.channels, 1)
+	return make(chan struct{})
+}
+
+// releaseChannel marks a tracked channel as no longer in use.
+func (r *resourceTracker) releaseChannel() {
+	atomic.AddInt32(&r.channels, -1)
+}
+
+// spawn runs a function on a new tracked goroutine.
+func (r *resourceTracker) spawn(fn func()) {
+	atomic.AddInt32(&r.goroutines, 1)
+	go func() {
+		defer atomic.AddInt32(&r.goroutines, -1)
+		fn()
+	}()
+}
+
+// stats retrieves a snapshot of the currently live resources.
+func (r *resourceTracker) stats() ResourceStats {
+	return ResourceStats{
+		Goroutines: int(atomic.LoadInt32(&r.goroutines)),
+		Timers:     int(atomic.LoadInt32(&r.timers)),
+		Channels:   int(atomic.LoadInt32(&r.channels)),
+	}
+}
@@ -0,0 +1,100 @@
+// Contains the summary of a synchronisation run, collected while syncing and
+// retrievable after the sync terminated for telemetry purposes.
+
+package downloader
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SyncResult is a summary of the last synchronisation run.
+type SyncResult struct {
+	Peer  string      // Identifier of the peer the sync was started with
+	Head  common.Hash // Hash of the head block the sync targeted
+	Start time.Time   // Time when the synchronisation started
+	Err   error       // Error the synchronisation terminated with (nil = success)
+	Bytes uint64      // Total number of bytes received from the peers
+
+	Salvaged   int // Number of contiguous blocks salvaged from the failed sync
+	Duplicates int // Number of delivered blocks already downloaded or known locally
+	Overflown  int // Number of delivered blocks beyond the sync target (dropped or buffered)
+
+	AncestorHash common.Hash // Hash of the common ancestor found by the hash discovery (zero = not found)
+
+	Elapsed        time.Duration // Total duration of the synchronisation
+	CommonAncestor time.Duration // Time from the start until the common ancestor was found (0 = not found)
+	FirstBlock     time.Duration // Time from the start until the first block was cached (0 = none)
+}
+
+// LastSync retrieves the summary of the last synchronisation run, or of the one
+// currently in progress.
+func (d *Downloader) LastSync() SyncResult {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.result
+}
+
+// LastCommonAncestor retrieves the hash of the common ancestor of the local chain
+// and the sync target, as found by the hash discovery of the last (or current)
+// synchronisation. It's the zero hash until the discovery finds it.
+func (d *Downloader) LastCommonAncestor() common.Hash {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.result.AncestorHash
+}
+
+// startResult resets the sync summary at the beginning of a new run.
+func (d *Downloader) startResult(peer string, head common.Hash) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.result = SyncResult{Peer: peer, Head: head, Start: time.Now()}
+	d.lastProgress = d.result.Start
+}
+
+// finishResult records the termination of the current sync run.
+func (d *Downloader) finishResult(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.result.Err = err
+	d.result.Elapsed = time.Since(d.result.Start)
+}
+
+// account adds a number of bytes received from the network to the sync summary,
+// returning errBudgetExceeded if the total surpassed the configured budget.
+func (d *Downloader) account(size uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.result.Bytes += size
+	d.lastProgress = time.Now()
+	if budget := d.config.TrafficBudget; budget > 0 && d.result.Bytes > budget {
+		return errBudgetExceeded
+	}
+	return nil
+}
+
+// milestone records the time elapsed since the sync start into a summary field,
+// unless the milestone was already reached previously.
+func (d *Downloader) milestone(field *time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if *field == 0 {
+		*field = time.Since(d.result.Start)
+	}
+}
+
+// recordAncestor records the common ancestor found by the hash discovery into the
+// sync summary.
+func (d *Downloader) recordAncestor(hash common.Hash) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.result.AncestorHash = hash
+}
@@ -0,0 +1,38 @@
+// Contains the pluggable strategies deciding which of the pending blocks are
+// assigned to the individual peers for retrieval.
+
+package downloader
+
+import "github.com/ethereum/go-ethereum/common"
+
+const (
+	scheduleWindow = blockCacheLimit // Maximum number of candidate hashes offered to a scheduler at once
+)
+
+// Scheduler is a strategy deciding which of the pending block hashes to assign
+// to an idle peer for retrieval.
+//
+// Select is given the id of the peer, the candidate hashes it may be assigned in
+// their default (sequential) priority order, and the maximum number of hashes it
+// may request at once. It returns the subset to request: anything not among the
+// candidates is dropped, as is anything above the limit. The candidates not
+// selected remain pending, whereas an empty selection skips the peer until the
+// next scheduling round.
+//
+// Select is called from the sync goroutine with the download queue locked, so it
+// must be fast and must not call back into the downloader.
+type Scheduler interface {
+	Select(peer string, candidates []common.Hash, max int) []common.Hash
+}
+
+// SequentialScheduler is the default scheduling strategy, assigning the pending
+// blocks in chain order, in consecutive chunks.
+type SequentialScheduler struct{}
+
+// Select implements Scheduler, picking the first max candidates.
+func (SequentialScheduler) Select(peer string, candidates []common.Hash, max int) []common.Hash {
+	if len(candidates) > max {
+		candidates = candidates[:max]
+	}
+	return candidates
+}
@@ -0,0 +1,98 @@
+// Contains the persistence of the peer scoring across process restarts, letting
+// a node resume with prior knowledge of which peers are fast and reliable.
+
+package downloader
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	peerScoreTtl = 24 * time.Hour // Default age after which imported peer scores are discarded
+)
+
+// peerScore is the persisted reputation and latency data of a single peer.
+type peerScore struct {
+	Id      string // Unique identifier of the peer
+	Rep     uint64 // Reputation of the peer at the time of the export
+	Latency uint64 // Moving average of the peer's block delivery latency in nanoseconds
+	Samples uint64 // Number of block deliveries the latency was measured over
+	Updated uint64 // Unix timestamp of the last update of the score
+}
+
+// ExportPeerScores serialises the scores of the currently registered peers, along
+// with any previously imported ones for peers not registered now, into an opaque
+// blob the embedder may persist and import after a restart.
+func (d *Downloader) ExportPeerScores() ([]byte, error) {
+	d.mu.RLock()
+	scores := make(map[string]peerScore, len(d.scores))
+	for id, score := range d.scores {
+		scores[id] = score
+	}
+	d.mu.RUnlock()
+
+	now := uint64(time.Now().Unix())
+	for _, p := range d.peers.AllPeers() {
+		latency, samples := p.Latency()
+		scores[p.id] = peerScore{
+			Id:      p.id,
+			Rep:     uint64(atomic.LoadInt32(&p.rep)),
+			Latency: uint64(latency),
+			Samples: uint64(samples),
+			Updated: now,
+		}
+	}
+	list := make([]peerScore, 0, len(scores))
+	for _, score := range scores {
+		list = append(list, score)
+	}
+	return rlp.EncodeToBytes(list)
+}
+
+// ImportPeerScores loads a set of peer scores previously exported, discarding the
+// ones older than the configured age. The scores are applied to the currently
+// registered peers, and to any peers registering later on.
+func (d *Downloader) ImportPeerScores(blob []byte) error {
+	var list []peerScore
+	if err := rlp.DecodeBytes(blob, &list); err != nil {
+		return err
+	}
+	ttl := d.config.PeerScoreTTL
+	if ttl == 0 {
+		ttl = peerScoreTtl
+	}
+	cutoff := time.Now().Add(-ttl).Unix()
+
+	d.mu.Lock()
+	for _, score := range list {
+		if int64(score.Updated) >= cutoff {
+			d.scores[score.Id] = score
+		}
+	}
+	d.mu.Unlock()
+
+	for _, p := range d.peers.AllPeers() {
+		d.applyScore(p)
+	}
+	return nil
+}
+
+// applyScore initialises the reputation and latency statistics of a peer from
+// the imported scores, if any are known.
+func (d *Downloader) applyScore(p *peer) {
+	d.mu.RLock()
+	score, ok := d.scores[p.id]
+	d.mu.RUnlock()
+
+	if !ok {
+		return
+	}
+	atomic.StoreInt32(&p.rep, int32(score.Rep))
+
+	p.mu.Lock()
+	p.latency, p.samples = time.Duration(score.Latency), int(score.Samples)
+	p.mu.Unlock()
+}
@@ -0,0 +1,162 @@
+// Contains the parallel hash chain retrieval, splitting the discovery of a chain
+// across multiple peers, each walking down from a different starting hash.
+
+package downloader
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+)
+
+const (
+	maxHashSegments = 8 // Maximum number of hash chain segments retrieved in parallel
+)
+
+// hashSegment is a section of the hash chain retrieved by a secondary peer, in
+// parallel to the main discovery, walking down from the peer's advertised head.
+// Once the main discovery reaches the head, the segment is spliced in, and the
+// main discovery skips ahead to its end.
+type hashSegment struct {
+	peer    *peer                // Peer retrieving the segment
+	anchor  common.Hash          // Head of the peer the segment starts below
+	from    common.Hash          // Hash the pending request of the segment started from
+	hashes  []common.Hash        // Hashes retrieved below the anchor, newest first
+	seen    map[common.Hash]bool // Set of the retrieved hashes, to detect cycles
+	pending bool                 // Whether a request of the segment is in flight
+	done    bool                 // Whether the segment reached a locally known block
+}
+
+// hashSegments coordinates the hash chain segments retrieved in parallel to the
+// main discovery of a sync.
+type hashSegments struct {
+	byPeer   map[string]*hashSegment      // Segments being retrieved, keyed by peer id
+	byAnchor map[common.Hash]*hashSegment // Segments being retrieved, keyed by anchor
+	stale    map[string]int               // Number of pending segment deliveries of dropped segments
+}
+
+// startSegments starts the retrieval of a hash chain segment from each peer (bar
+// the origin) advertising a distinct, locally unknown head other than the sync
+// target, up to maxHashSegments of them.
+func (d *Downloader) startSegments(origin *peer, head common.Hash) *hashSegments {
+	segments := &hashSegments{
+		byPeer:   make(map[string]*hashSegment),
+		byAnchor: make(map[common.Hash]*hashSegment),
+		stale:    make(map[string]int),
+	}
+	for _, p := range d.peers.AllPeers() {
+		if len(segments.byPeer) >= maxHashSegments {
+			break
+		}
+		if p == origin || p.head == head || d.hasBlock(p.head) || segments.byAnchor[p.head] != nil || !d.compatible(p) {
+			continue
+		}
+		if err := d.requestHashes(p, p.head); err != nil {
+			continue
+		}
+		segment := &hashSegment{
+			peer:    p,
+			anchor:  p.head,
+			from:    p.head,
+			seen:    make(map[common.Hash]bool),
+			pending: true,
+		}
+		segments.byPeer[p.id], segments.byAnchor[p.head] = segment, segment
+		glog.V(logger.Debug).Infof("Started hash segment retrieval from %s at %x", p.id, p.head[:4])
+	}
+	return segments
+}
+
+// deliver injects a batch of hashes into the segment of the delivering peer,
+// requesting the next batch until a locally known block is reached. It returns
+// whether the delivery belonged to a segment. Any invalid delivery stalls the
+// segment, keeping the hashes retrieved so far.
+func (s *hashSegments) deliver(d *Downloader, pack hashPack) bool {
+	if s == nil {
+		return false
+	}
+	segment := s.byPeer[pack.peerId]
+	if segment == nil || !segment.pending {
+		return false
+	}
+	segment.pending = false
+
+	// Bring the delivery into newest first order and drop the echoed request
+	hashes := pack.hashes
+	if segment.peer.hashOrder == OldestFirst {
+		hashes = reverseHashes(hashes)
+	}
+	if len(hashes) > 0 && hashes[0] == segment.from {
+		hashes = hashes[1:]
+	}
+	if len(hashes) == 0 {
+		glog.V(logger.Debug).Infof("Hash segment of %s stalled on empty delivery", segment.peer.id)
+		return true
+	}
+	// Collect the hashes up to and including the first known block
+	for _, hash := range hashes {
+		if segment.seen[hash] {
+			glog.V(logger.Debug).Infof("Hash segment of %s stalled on cycle at %x", segment.peer.id, hash[:4])
+			return true
+		}
+		segment.seen[hash] = true
+		segment.hashes = append(segment.hashes, hash)
+
+		if d.hasBlock(hash) || d.queue.GetBlock(hash) != nil {
+			segment.done = true
+			return true
+		}
+	}
+	// Not yet done, continue the segment
+	segment.from = segment.hashes[len(segment.hashes)-1]
+	if err := d.requestHashes(segment.peer, segment.from); err == nil {
+		segment.pending = true
+	}
+	return true
+}
+
+// merge splices the segment anchored at the first matching hash of a delivery of
+// the main discovery into it, returning the extended delivery along with the
+// merged segment, which is dropped from the coordinator.
+func (s *hashSegments) merge(hashes []common.Hash) ([]common.Hash, *hashSegment) {
+	if s == nil || len(s.byAnchor) == 0 {
+		return hashes, nil
+	}
+	for i, hash := range hashes {
+		if segment := s.byAnchor[hash]; segment != nil {
+			delete(s.byPeer, segment.peer.id)
+			delete(s.byAnchor, segment.anchor)
+
+			merged := make([]common.Hash, 0, i+1+len(segment.hashes))
+			merged = append(merged, hashes[:i+1]...)
+			return append(merged, segment.hashes...), segment
+		}
+	}
+	return hashes, nil
+}
+
+// drop abandons the segment retrieval of a peer, e.g. when it's switched to for
+// the main discovery. If a segment request is still in flight, its delivery is
+// marked stale, to be discarded once it arrives.
+func (s *hashSegments) drop(id string) {
+	if s == nil {
+		return
+	}
+	if segment := s.byPeer[id]; segment != nil {
+		if segment.pending {
+			s.stale[id]++
+		}
+		delete(s.byPeer, id)
+		delete(s.byAnchor, segment.anchor)
+	}
+}
+
+// discard checks whether the next delivery of a peer answers the request of an
+// already dropped segment, consuming the stale marker if so.
+func (s *hashSegments) discard(id string) bool {
+	if s == nil || s.stale[id] == 0 {
+		return false
+	}
+	s.stale[id]--
+	return true
+}
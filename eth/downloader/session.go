@@ -0,0 +1,73 @@
+// Contains the isolated range synchronisations, running a secondary download with
+// its own queue and peer alongside the primary sync, e.g. to back-fill an old
+// section of the chain while the head is being synced.
+
+package downloader
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+)
+
+// SynchroniseRange runs an isolated secondary synchronisation with the given peer,
+// retrieving the section of the chain from the given hash down to the locally
+// known block to. The hash discovery stops at to, failing if the peer's chain links
+// up with the local one anywhere else. It doesn't interfere with the primary sync
+// (nor trips its ErrBusy): the secondary sync runs on a downloader of its own,
+// sharing only the configuration and the local chain callbacks of the primary one,
+// with the peer lent to it exclusively for the duration of the sync. Deliveries of
+// the peer arriving through the primary downloader are routed to the secondary one.
+//
+// The call is synchronous, returning the secondary downloader once the sync is
+// done, to take the retrieved blocks from. Unregistering the peer from the
+// primary downloader aborts the secondary sync too.
+func (d *Downloader) SynchroniseRange(id string, from, to common.Hash) (*Downloader, error) {
+	if !d.hasBlock(to) {
+		return nil, errUnknownRangeEnd
+	}
+	p := d.peers.Peer(id)
+	if p == nil {
+		return nil, errUnknownPeer
+	}
+	// Create the secondary downloader, inserting nothing into the chain on its own
+	config := d.config
+	config.InsertChain = nil
+
+	session := NewWithConfig(d.hasBlock, d.getBlock, config)
+	session.setClock(d.clock)
+	session.rangeEnd = to
+
+	peer := p.config()
+	peer.Head = from
+	if err := session.RegisterPeerConfig(peer); err != nil {
+		return nil, err
+	}
+	// Lend the peer to the secondary sync, routing its deliveries there
+	d.mu.Lock()
+	if _, ok := d.sessions[id]; ok {
+		d.mu.Unlock()
+		return nil, ErrBusy
+	}
+	d.sessions[id] = session
+	d.mu.Unlock()
+
+	d.peers.Lend(id, true)
+	defer func() {
+		d.peers.Lend(id, false)
+
+		d.mu.Lock()
+		delete(d.sessions, id)
+		d.mu.Unlock()
+	}()
+	glog.V(logger.Debug).Infof("Synchronising range [%x] .. [%x] with %s", from[:4], to[:4], id)
+	return session, session.Synchronise(id, from)
+}
+
+// session retrieves the secondary downloader the given peer is lent to, if any.
+func (d *Downloader) session(id string) *Downloader {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.sessions[id]
+}
@@ -0,0 +1,273 @@
+// Contains the state trie download scheduler used in fast sync mode, retrieving
+// the trie nodes of a state root in parallel from the available peers.
+
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"gopkg.in/karalabe/cookiejar.v2/collections/prque"
+)
+
+const (
+	maxStateFetch = 384 // Amount of max state trie nodes to be fetched per request
+)
+
+var emptyRoot = common.HexToHash("56e81f171bcc55a6ff8345e692c0f86e5b48e01b996cadc001622fb5e363b421")
+
+// stateQueue represents the state trie nodes that either need fetching or are
+// being fetched, along with the ones already retrieved.
+type stateQueue struct {
+	hashPool    map[common.Hash]int // Pending node hashes, mapping to their insertion index (priority)
+	hashQueue   *prque.Prque        // Priority queue of the node hashes to fetch
+	hashCounter int                 // Counter indexing the added hashes to ensure retrieval order
+
+	pendPool map[string]*fetchRequest // Currently pending node retrieval operations
+	donePool map[common.Hash]bool     // Set of the already retrieved nodes
+
+	clock clock // Source of the request times, expiring the reservations
+
+	lock sync.RWMutex
+}
+
+// newStateQueue creates a new download queue for scheduling state retrieval.
+func newStateQueue() *stateQueue {
+	return &stateQueue{
+		hashPool:  make(map[common.Hash]int),
+		hashQueue: prque.New(),
+		pendPool:  make(map[string]*fetchRequest),
+		donePool:  make(map[common.Hash]bool),
+		clock:     realClock{},
+	}
+}
+
+// Reset clears out the queue contents.
+func (q *stateQueue) Reset() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.hashPool = make(map[common.Hash]int)
+	q.hashQueue.Reset()
+	q.hashCounter = 0
+
+	q.pendPool = make(map[string]*fetchRequest)
+	q.donePool = make(map[common.Hash]bool)
+}
+
+// Pending retrieves the number of node hashes pending for retrieval.
+func (q *stateQueue) Pending() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.hashQueue.Size()
+}
+
+// InFlight retrieves the number of node requests currently in flight.
+func (q *stateQueue) InFlight() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return len(q.pendPool)
+}
+
+// Done retrieves the number of already retrieved state nodes.
+func (q *stateQueue) Done() int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return len(q.donePool)
+}
+
+// Schedule adds a set of node hashes to the download queue, skipping any that
+// are already known, scheduled or retrieved. Later insertions are prioritised,
+// resulting in a depth-first trie traversal, keeping the pending set small.
+func (q *stateQueue) Schedule(hashes []common.Hash) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, hash := range hashes {
+		if _, ok := q.hashPool[hash]; ok || q.donePool[hash] {
+			continue
+		}
+		q.hashPool[hash] = q.hashCounter
+		q.hashQueue.Push(hash, float32(q.hashCounter))
+		q.hashCounter++
+	}
+}
+
+// Reserve reserves a set of node hashes for the given peer, skipping any
+// previously failed download.
+func (q *stateQueue) Reserve(p *peer, max int) *fetchRequest {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// Short circuit if the pool has been depleted, or if the peer's already
+	// downloading something (sanity check not to corrupt state)
+	if q.hashQueue.Empty() {
+		return nil
+	}
+	if _, ok := q.pendPool[p.id]; ok {
+		return nil
+	}
+	// Retrieve a batch of hashes, skipping previously failed ones
+	send := make(map[common.Hash]int)
+	skip := make(map[common.Hash]int)
+
+	for len(send) < max && !q.hashQueue.Empty() {
+		hash, priority := q.hashQueue.Pop()
+		if p.ignored.Has(hash) {
+			skip[hash.(common.Hash)] = int(priority)
+		} else {
+			send[hash.(common.Hash)] = int(priority)
+		}
+	}
+	for hash, index := range skip {
+		q.hashQueue.Push(hash, float32(index))
+	}
+	if len(send) == 0 {
+		return nil
+	}
+	request := &fetchRequest{
+		Peer:   p,
+		Hashes: send,
+		Time:   q.clock.Now(),
+	}
+	q.pendPool[p.id] = request
+
+	return request
+}
+
+// Cancel aborts a node request, returning all pending hashes to the queue.
+func (q *stateQueue) Cancel(request *fetchRequest) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for hash, index := range request.Hashes {
+		q.hashQueue.Push(hash, float32(index))
+	}
+	delete(q.pendPool, request.Peer.id)
+}
+
+// Revoke cancels the node request of a peer, returning its pending hashes to the
+// queue.
+func (q *stateQueue) Revoke(id string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if request := q.pendPool[id]; request != nil {
+		for hash, index := range request.Hashes {
+			q.hashQueue.Push(hash, float32(index))
+		}
+		delete(q.pendPool, id)
+	}
+}
+
+// Expire checks for in flight requests that exceeded a timeout allowance,
+// canceling them and returning the responsible peers for penalization.
+func (q *stateQueue) Expire(timeout time.Duration) []string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	peers := []string{}
+	for id, request := range q.pendPool {
+		if q.clock.Now().Sub(request.Time) > timeout {
+			for hash, index := range request.Hashes {
+				q.hashQueue.Push(hash, float32(index))
+			}
+			peers = append(peers, id)
+		}
+	}
+	for _, id := range peers {
+		delete(q.pendPool, id)
+	}
+	return peers
+}
+
+// Deliver injects a node retrieval response into the download queue, returning
+// the validated nodes keyed by their hashes. Any requested nodes not delivered
+// are marked unavailable at the origin peer and returned to the queue.
+func (q *stateQueue) Deliver(id string, data [][]byte) (map[common.Hash][]byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// Short circuit if the nodes were never requested
+	request := q.pendPool[id]
+	if request == nil {
+		return nil, errors.New("no fetches pending")
+	}
+	delete(q.pendPool, id)
+
+	// Iterate over the downloaded nodes and validate each of them
+	nodes := make(map[common.Hash][]byte)
+	errs := make([]error, 0)
+	for _, blob := range data {
+		hash := crypto.Sha3Hash(blob)
+		if _, ok := request.Hashes[hash]; !ok {
+			errs = append(errs, fmt.Errorf("non-requested state node %x", hash))
+			continue
+		}
+		nodes[hash] = blob
+
+		delete(request.Hashes, hash)
+		delete(q.hashPool, hash)
+		q.donePool[hash] = true
+	}
+	// Return all failed fetches to the queue, they're not available at the peer
+	for hash, index := range request.Hashes {
+		request.Peer.ignored.Add(hash)
+		q.hashQueue.Push(hash, float32(index))
+	}
+	if len(errs) != 0 {
+		return nodes, fmt.Errorf("multiple failures: %v", errs)
+	}
+	return nodes, nil
+}
+
+// trieChildren extracts the hashes of the child nodes referenced by an encoded
+// state trie node, along with the children of any nodes embedded into it.
+func trieChildren(hash common.Hash, blob []byte) ([]common.Hash, error) {
+	var node []interface{}
+	if err := rlp.DecodeBytes(blob, &node); err != nil {
+		return nil, err
+	}
+	return trieReferences(node, nil), nil
+}
+
+// trieReferences collects the hash references of a decoded trie node.
+func trieReferences(node []interface{}, refs []common.Hash) []common.Hash {
+	switch len(node) {
+	case 2:
+		// Short node, only extensions reference other nodes (leaves hold values)
+		if key, ok := node[0].([]byte); ok && len(key) > 0 && key[0]>>4 >= 2 {
+			return refs
+		}
+		return trieReference(node[1], refs)
+
+	case 17:
+		// Full node, the first sixteen slots reference children
+		for _, child := range node[:16] {
+			refs = trieReference(child, refs)
+		}
+	}
+	return refs
+}
+
+// trieReference appends a single child reference (either a hash or an embedded
+// node) to the collected references.
+func trieReference(child interface{}, refs []common.Hash) []common.Hash {
+	switch child := child.(type) {
+	case []byte:
+		if len(child) == len(common.Hash{}) {
+			refs = append(refs, common.BytesToHash(child))
+		}
+	case []interface{}:
+		refs = trieReferences(child, refs)
+	}
+	return refs
+}
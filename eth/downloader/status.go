@@ -0,0 +1,51 @@
+// Contains the health check of the downloader, consolidating the peer, progress
+// and outcome signals needed by liveness and readiness probes.
+
+package downloader
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthMinPeers     = 1           // Default number of peers below which the downloader is unhealthy
+	healthStallTimeout = time.Minute // Default time without deliveries after which a sync is stuck
+)
+
+// Healthy reports whether the downloader is in a good state: it has enough peers,
+// and the running sync is progressing, or the last one succeeded (or was merely
+// cancelled). If unhealthy, the returned string gives a human readable reason.
+func (d *Downloader) Healthy() (bool, string) {
+	// Make sure there are enough peers to synchronise with
+	min := d.config.MinHealthyPeers
+	if min == 0 {
+		min = healthMinPeers
+	}
+	if peers := d.peers.Len(); peers < min {
+		return false, fmt.Sprintf("too few peers: have %d, want %d", peers, min)
+	}
+	d.mu.RLock()
+	result, progress := d.result, d.lastProgress
+	d.mu.RUnlock()
+
+	// If a sync is running, make sure it isn't stuck
+	if atomic.LoadInt32(&d.synchronising) == 1 {
+		timeout := d.config.StallTimeout
+		if timeout == 0 {
+			timeout = healthStallTimeout
+		}
+		if stall := time.Since(progress); stall > timeout {
+			return false, fmt.Sprintf("sync stuck: no data delivered for %v", stall)
+		}
+		return true, ""
+	}
+	// Otherwise make sure the last sync (if any) didn't fail
+	switch result.Err {
+	case nil, errCancelHashFetch, errCancelBlockFetch:
+		return true, ""
+	default:
+		return false, fmt.Sprintf("last sync failed: %v", result.Err)
+	}
+}